@@ -0,0 +1,64 @@
+package sqlds
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// ErrorAnnotationColumn is returned when the annotation format is used but a column is missing or has the wrong type
+var ErrorAnnotationColumn = errors.New("annotation format requires column")
+
+// annotationColumn is a column of the annotation frames
+type annotationColumn struct {
+	name     string
+	required bool
+	types    []data.FieldType
+}
+
+var (
+	annotationTimeTypes   = []data.FieldType{data.FieldTypeTime, data.FieldTypeNullableTime}
+	annotationStringTypes = []data.FieldType{data.FieldTypeString, data.FieldTypeNullableString}
+)
+
+// annotationColumns are the columns used by the annotations, in the order of the annotation frames.
+// The tags are a comma separated list.
+var annotationColumns = []annotationColumn{
+	{name: "time", required: true, types: annotationTimeTypes},
+	{name: "timeEnd", types: annotationTimeTypes},
+	{name: "title", types: annotationStringTypes},
+	{name: "text", required: true, types: annotationStringTypes},
+	{name: "tags", types: annotationStringTypes},
+}
+
+// toAnnotationsFrame validates that the frame contains the columns of the annotations (matched case insensitive) and
+// renames them, so they can be used by the annotation queries. The time and text columns are required.
+// The annotation columns come first, followed by the rest of the columns.
+func toAnnotationsFrame(frame *data.Frame) (*data.Frame, error) {
+	var (
+		fields = []*data.Field{}
+		rest   = frame.Fields
+	)
+
+	for _, column := range annotationColumns {
+		i := fieldIndex(rest, column.name)
+		if i < 0 {
+			if column.required {
+				return nil, fmt.Errorf("%w: %s", ErrorAnnotationColumn, column.name)
+			}
+			continue
+		}
+		field := rest[i]
+		if !hasFieldType(field, column.types) {
+			return nil, fmt.Errorf("%w: %s must be of type %s, got %s", ErrorAnnotationColumn, column.name, column.types[0].ItemTypeString(), field.Type().ItemTypeString())
+		}
+		field.Name = column.name
+		fields = append(fields, field)
+		rest = removeField(rest, i)
+	}
+
+	// The frames are only recognized as annotations in the panels when Meta.DataTopic is set, which this version
+	// of the SDK doesn't have yet. The annotation queries of Grafana use them as they are.
+	return reorderedFrame(frame, append(fields, rest...), data.VisTypeTable), nil
+}
@@ -0,0 +1,59 @@
+package sqlds
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_toAnnotationsFrame(t *testing.T) {
+	now := time.Now()
+	t.Run("it should map all the annotation columns", func(t *testing.T) {
+		frame, err := toAnnotationsFrame(data.NewFrame("A",
+			data.NewField("host", nil, []string{"a"}),
+			data.NewField("Tags", nil, []string{"deploy,prod"}),
+			data.NewField("text", nil, []string{"v1.2.0 deployed"}),
+			data.NewField("title", nil, []*string{nil}),
+			data.NewField("timeEnd", nil, []*time.Time{&now}),
+			data.NewField("TIME", nil, []time.Time{now}),
+		))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"time", "timeEnd", "title", "text", "tags", "host"}, fieldNames(frame))
+		require.NotNil(t, frame.Meta)
+		assert.Equal(t, data.VisType(data.VisTypeTable), frame.Meta.PreferredVisualization)
+		assert.Nil(t, frame.Meta.Custom)
+	})
+
+	t.Run("it should tolerate the missing optional columns", func(t *testing.T) {
+		frame, err := toAnnotationsFrame(data.NewFrame("A",
+			data.NewField("text", nil, []string{"restart"}),
+			data.NewField("time", nil, []time.Time{now}),
+		))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"time", "text"}, fieldNames(frame))
+		assert.Equal(t, 1, frame.Rows())
+	})
+
+	t.Run("it should return an error naming the missing column", func(t *testing.T) {
+		_, err := toAnnotationsFrame(data.NewFrame("A",
+			data.NewField("time", nil, []time.Time{now}),
+			data.NewField("title", nil, []string{"restart"}),
+		))
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorAnnotationColumn)
+		assert.Contains(t, err.Error(), "text")
+	})
+
+	t.Run("it should return an error if a column has the wrong type", func(t *testing.T) {
+		_, err := toAnnotationsFrame(data.NewFrame("A",
+			data.NewField("time", nil, []int64{1}),
+			data.NewField("text", nil, []string{"restart"}),
+		))
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorAnnotationColumn)
+		assert.Contains(t, err.Error(), "time")
+	})
+}
@@ -0,0 +1,140 @@
+package sqlds
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrorQueryArg is returned when the $__arg macro refers to an argument that is not defined in Query.Args
+var ErrorQueryArg = errors.New("query argument not defined")
+
+// PlaceholderStyle defines how the bind parameters created by the $__arg macro are written in the query
+type PlaceholderStyle string
+
+const (
+	// PlaceholderQuestion uses question marks (e.g. "col = ?"), as used by MySQL or SQLite. This is the default.
+	PlaceholderQuestion PlaceholderStyle = "?"
+	// PlaceholderDollar uses numbered parameters (e.g. "col = $1"), as used by Postgres
+	PlaceholderDollar PlaceholderStyle = "$"
+	// PlaceholderColon uses numbered parameters prefixed by a colon (e.g. "col = :1"), as used by Oracle
+	PlaceholderColon PlaceholderStyle = ":"
+	// PlaceholderAtP uses numbered parameters prefixed by @p (e.g. "col = @p1"), as used by SQL Server
+	PlaceholderAtP PlaceholderStyle = "@p"
+)
+
+// placeholder returns the placeholder of the nth (starting at 1) bind parameter
+func (p PlaceholderStyle) placeholder(n int) string {
+	switch p {
+	case PlaceholderDollar, PlaceholderColon, PlaceholderAtP:
+		return string(p) + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// Rewrite replaces the question mark placeholders of the statement with the ones of the style, ignoring the question
+// marks within strings and comments. It can be used as DriverSettings.RewritePlaceholders by the drivers whose queries
+// are written with question marks, e.g.
+//   RewritePlaceholders: sqlds.PlaceholderDollar.Rewrite
+//
+// Only the first n question marks are rewritten, n being the number of bind parameters, so that the statements
+// without parameters are kept as they are. Question marks used as operators before a placeholder (e.g. the ? operator
+// of PostgreSQL jsonb values) can't be told apart, so the $__arg macro should rather use DriverSettings.PlaceholderStyle.
+func (p PlaceholderStyle) Rewrite(statement string, n int) string {
+	if p == PlaceholderQuestion || p == "" || n <= 0 {
+		return statement
+	}
+	var (
+		rewritten strings.Builder
+		count     int
+	)
+	for i := 0; i < len(statement); i++ {
+		if end, _ := skipToken(statement, i); end > i {
+			rewritten.WriteString(statement[i:end])
+			i = end - 1
+			continue
+		}
+		if statement[i] != '?' || count == n {
+			rewritten.WriteByte(statement[i])
+			continue
+		}
+		count++
+		rewritten.WriteString(p.placeholder(count))
+	}
+	return rewritten.String()
+}
+
+// argMarkerRegex matches the markers left by the $__arg macro, which are replaced by placeholders before running the query
+var argMarkerRegex = regexp.MustCompile("\x00arg:([^\x00]*)\x00")
+
+// argNameRegex matches the names of the arguments accepted by the $__arg macro, so that the markers never contain
+// characters meaningful to SQL, like the semicolons splitting the statements
+var argNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Macro to pass a value of Query.Args as a bind parameter, instead of writing it in the query.
+// The placeholder style is defined by DriverSettings.PlaceholderStyle.
+// Example:
+//   $__arg(name) => "?"
+func macroArg(query *Query, args []string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
+		return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+	}
+	name := strings.Trim(args[0], `'"`)
+	if !argNameRegex.MatchString(name) {
+		return "", fmt.Errorf("%w: invalid argument name %q", ErrorInvalidMacroArg, name)
+	}
+	if _, ok := query.Args[name]; !ok {
+		return "", fmt.Errorf("%w: %s", ErrorQueryArg, name)
+	}
+	// The placeholders are numbered once the whole query has been interpolated,
+	// since macros are not applied in the order they appear in the query
+	return "\x00arg:" + name + "\x00", nil
+}
+
+// bindStatement is like bindArgs, writing the placeholders with DriverSettings.PlaceholderStyle and then applying
+// DriverSettings.RewritePlaceholders if it's set
+func bindStatement(settings DriverSettings, rawSQL string, values map[string]interface{}) (string, []interface{}) {
+	rawSQL, args := bindArgs(settings.PlaceholderStyle, rawSQL, values)
+	if settings.RewritePlaceholders != nil {
+		rawSQL = settings.RewritePlaceholders(rawSQL, len(args))
+	}
+	return rawSQL, args
+}
+
+// bindQuery splits the query in statements if DriverSettings.AllowMultipleStatements is set and binds the arguments of
+// each of them, numbering their placeholders separately. The returned query has the placeholders instead of the markers
+// in its RawSQL, so that they don't reach the frames, the logs or the database.
+func bindQuery(settings DriverSettings, q *Query) *Query {
+	if q.statements != nil {
+		return q
+	}
+	statements := []string{q.RawSQL}
+	if settings.AllowMultipleStatements {
+		statements = splitStatements(q.RawSQL)
+	}
+	args := make([][]interface{}, len(statements))
+	for i, s := range statements {
+		statements[i], args[i] = bindStatement(settings, s, q.Args)
+	}
+
+	bound := *q
+	bound.statements, bound.statementArgs = statements, args
+	if argMarkerRegex.MatchString(q.RawSQL) {
+		bound.RawSQL = strings.Join(statements, "; ")
+	}
+	return &bound
+}
+
+// bindArgs replaces the markers left by the $__arg macro with placeholders, returning the
+// values of the bind parameters in the order they appear in rawSQL
+func bindArgs(style PlaceholderStyle, rawSQL string, values map[string]interface{}) (string, []interface{}) {
+	var args []interface{}
+	rawSQL = argMarkerRegex.ReplaceAllStringFunc(rawSQL, func(marker string) string {
+		name := argMarkerRegex.FindStringSubmatch(marker)[1]
+		args = append(args, values[name])
+		return style.placeholder(len(args))
+	})
+	return rawSQL, args
+}
@@ -0,0 +1,191 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterpolate_arg(t *testing.T) {
+	driver := MockDB{}
+	args := map[string]interface{}{"a": "foo", "b": int64(2)}
+	input := "select * from t where b = $__arg(b) and $__args($__arg(a), x) and c > $__arg(b)"
+
+	tests := []struct {
+		name   string
+		style  PlaceholderStyle
+		output string
+	}{
+		{name: "question marks", output: "select * from t where b = ? and ?|x and c > ?"},
+		{name: "numbered", style: PlaceholderDollar, output: "select * from t where b = $1 and $2|x and c > $3"},
+		{name: "SQL Server", style: PlaceholderAtP, output: "select * from t where b = @p1 and @p2|x and c > @p3"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rawSQL, err := interpolateMacros(&driver, DriverSettings{}, driver.Macros(), &Query{RawSQL: input, Args: args})
+			require.NoError(t, err)
+			rawSQL, values := bindArgs(tc.style, rawSQL, args)
+			assert.Equal(t, tc.output, rawSQL)
+			assert.Equal(t, []interface{}{int64(2), "foo", int64(2)}, values)
+		})
+	}
+
+	t.Run("it should return an error if the argument is not defined", func(t *testing.T) {
+		_, err := Interpolate(&driver, &Query{RawSQL: "select $__arg(c)", Args: args})
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorQueryArg)
+	})
+
+	t.Run("it should reject the argument names that are not identifiers", func(t *testing.T) {
+		for _, name := range []string{"'a;drop table t'", "'a b'", "'1a'"} {
+			_, err := Interpolate(&driver, &Query{RawSQL: "select $__arg(" + name + ")", Args: map[string]interface{}{strings.Trim(name, "'"): 1}})
+			assert.ErrorIs(t, err, ErrorInvalidMacroArg, name)
+		}
+	})
+
+	t.Run("Interpolate should return placeholders", func(t *testing.T) {
+		rawSQL, err := Interpolate(&driver, &Query{RawSQL: "select $__arg(a)", Args: args})
+		require.NoError(t, err)
+		assert.Equal(t, "select ?", rawSQL)
+	})
+}
+
+func TestQuery_arg(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, nil
+	}}
+	driver := MockDB{}
+	settings := DriverSettings{PlaceholderStyle: PlaceholderDollar, AllowMultipleStatements: true}
+	q := &Query{
+		RawSQL: "set x = $__arg(b); select a from t where a = $__arg(a) and b = $__arg(b)",
+		Args:   map[string]interface{}{"a": "foo", "b": int64(2)},
+		Format: FormatOptionTable,
+	}
+
+	var err error
+	q.RawSQL, err = interpolateMacros(&driver, settings, driver.Macros(), q)
+	require.NoError(t, err)
+	frames, err := query(context.Background(), fd.DB(), nil, nil, settings, q)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"set x = $1", "select a from t where a = $1 and b = $2"}, fd.Queries())
+	assert.Equal(t, [][]interface{}{{int64(2)}, {"foo", int64(2)}}, fd.Args())
+	assert.Equal(t, "set x = $1; select a from t where a = $1 and b = $2", frames[0].Meta.ExecutedQueryString)
+}
+
+func TestPlaceholderStyle_Rewrite(t *testing.T) {
+	statement := "select '?' as q, a from t where a = ? and b > ? -- ?\nand c in (?) /* ? */"
+
+	tests := []struct {
+		name   string
+		style  PlaceholderStyle
+		output string
+	}{
+		{name: "question marks", style: PlaceholderQuestion, output: statement},
+		{name: "numbered", style: PlaceholderDollar, output: "select '?' as q, a from t where a = $1 and b > $2 -- ?\nand c in ($3) /* ? */"},
+		{name: "colon", style: PlaceholderColon, output: "select '?' as q, a from t where a = :1 and b > :2 -- ?\nand c in (:3) /* ? */"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.output, tc.style.Rewrite(statement, 3))
+		})
+	}
+
+	t.Run("it should not rewrite statements without bind parameters", func(t *testing.T) {
+		statement := "select a from t where data ? 'key'"
+		assert.Equal(t, statement, PlaceholderDollar.Rewrite(statement, 0))
+	})
+
+	t.Run("it should only rewrite the bind parameters", func(t *testing.T) {
+		assert.Equal(t, "select a from t where a = $1 and b = $2 and c ? 'key'", PlaceholderDollar.Rewrite("select a from t where a = ? and b = ? and c ? 'key'", 2))
+	})
+}
+
+func TestQuery_RewritePlaceholders(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, nil
+	}}
+	var counts []int
+	settings := DriverSettings{
+		RewritePlaceholders: func(sql string, n int) string {
+			counts = append(counts, n)
+			return PlaceholderDollar.Rewrite(sql, n)
+		},
+	}
+	q := &Query{
+		RawSQL: "select a from t where a = $__arg(a) and b = $__arg(b) and c = $__arg(a)",
+		Args:   map[string]interface{}{"a": "foo", "b": int64(2)},
+		Format: FormatOptionTable,
+	}
+
+	var err error
+	q.RawSQL, err = interpolateMacros(&MockDB{}, settings, nil, q)
+	require.NoError(t, err)
+	_, err = query(context.Background(), fd.DB(), nil, nil, settings, q)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"select a from t where a = $1 and b = $2 and c = $3"}, fd.Queries())
+	assert.Equal(t, [][]interface{}{{"foo", int64(2), "foo"}}, fd.Args())
+	assert.Equal(t, []int{3}, counts)
+}
+
+func TestQuery_PlaceholderStyle_jsonbOperator(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{true}}}, nil
+	}}
+	settings := DriverSettings{PlaceholderStyle: PlaceholderDollar}
+	q := &Query{
+		RawSQL: "select data ? 'k' from t where id = $__arg(id)",
+		Args:   map[string]interface{}{"id": int64(1)},
+		Format: FormatOptionTable,
+	}
+
+	var err error
+	q.RawSQL, err = interpolateMacros(&MockDB{}, settings, nil, q)
+	require.NoError(t, err)
+	_, err = query(context.Background(), fd.DB(), nil, nil, settings, q)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"select data ? 'k' from t where id = $1"}, fd.Queries())
+	assert.Equal(t, [][]interface{}{{int64(1)}}, fd.Args())
+}
+
+func TestQuery_argMarkers(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{}, errors.New("failed")
+	}}
+	db := fd.DB()
+	d := &loggerDriver{fakeDriver: fakeDriver{db: db}}
+	ds := &sqldatasource{c: d, driverSettings: DriverSettings{PlaceholderStyle: PlaceholderDollar}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+	dataQuery := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select a from t where a = $__arg(a)", "args": {"a": "x"}}`)}
+
+	t.Run("it should bind the arguments before logging the query", func(t *testing.T) {
+		frames, err := runDataQuery(context.Background(), ds, dataQuery, "uid1")
+		require.Error(t, err)
+		assert.Equal(t, []string{"start: select a from t where a = $1", "end: select a from t where a = $1"}, d.events)
+		assert.Equal(t, "select a from t where a = $1", frames[0].Meta.ExecutedQueryString)
+	})
+
+	t.Run("it should bind the arguments of the errors before running the query", func(t *testing.T) {
+		ds.driverSettings.ReadOnly = true
+		defer func() { ds.driverSettings.ReadOnly = false }()
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "delete from t where a = $__arg(a)", "args": {"a": "x"}}`)}, "uid1")
+		assert.ErrorIs(t, err, ErrorReadOnly)
+		assert.Equal(t, "delete from t where a = $1", frames[0].Meta.ExecutedQueryString)
+	})
+
+	t.Run("it should bind the arguments of the streams", func(t *testing.T) {
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{StreamRows: true}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+		frames, err := runDataQuery(context.Background(), ds, dataQuery, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, "select a from t where a = ?", frames[0].Meta.ExecutedQueryString)
+	})
+}
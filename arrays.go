@@ -0,0 +1,164 @@
+package sqlds
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+// ErrorArray is returned by the array converters when a value is not a valid array literal
+var ErrorArray = errors.New("invalid array")
+
+// ArrayElement is the type of the elements of an array column
+type ArrayElement int
+
+const (
+	// ArrayOfText keeps the elements as strings
+	ArrayOfText ArrayElement = iota
+	// ArrayOfInt parses the elements as 64-bit integers
+	ArrayOfInt
+)
+
+// ArrayConverter returns a converter for array columns returned as Postgres array literals (e.g. {1,2,NULL} or {a,"b c"}),
+// storing them as JSON arrays (e.g. [1,2,null]) in nullable string fields. Nested arrays result in nested JSON arrays.
+// It matches the columns of the given database type (e.g. "_INT8"), and can also be returned by ColumnConverters for
+// specific columns.
+func ArrayConverter(typeName string, elem ArrayElement) sqlutil.Converter {
+	return sqlutil.Converter{
+		Name:          fmt.Sprintf("Array converter for %s", typeName),
+		InputScanType: reflect.TypeOf(sql.NullString{}),
+		InputTypeName: typeName,
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType: data.FieldTypeNullableString,
+			ConverterFunc: func(in interface{}) (interface{}, error) {
+				v := in.(*sql.NullString)
+				if !v.Valid {
+					return (*string)(nil), nil
+				}
+				values, err := parseArray(v.String, elem)
+				if err != nil {
+					return nil, err
+				}
+				b, err := json.Marshal(values)
+				if err != nil {
+					return nil, err
+				}
+				s := string(b)
+				return &s, nil
+			},
+		},
+	}
+}
+
+// arrayParser parses Postgres array literals
+type arrayParser struct {
+	s    string
+	i    int
+	elem ArrayElement
+}
+
+// parseArray parses a Postgres array literal, returning nil for the NULL elements
+func parseArray(s string, elem ArrayElement) ([]interface{}, error) {
+	p := &arrayParser{s: strings.TrimSpace(s), elem: elem}
+	values, err := p.array()
+	if err != nil {
+		return nil, err
+	}
+	if p.i != len(p.s) {
+		return nil, fmt.Errorf("%w: unexpected %q after the array", ErrorArray, p.s[p.i:])
+	}
+	return values, nil
+}
+
+// array parses the array starting at the current position
+func (p *arrayParser) array() ([]interface{}, error) {
+	if p.i >= len(p.s) || p.s[p.i] != '{' {
+		return nil, fmt.Errorf("%w: %q doesn't start with {", ErrorArray, p.s)
+	}
+	p.i++
+
+	values := []interface{}{}
+	if p.i < len(p.s) && p.s[p.i] == '}' {
+		p.i++
+		return values, nil
+	}
+	for {
+		v, err := p.element()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		if p.i >= len(p.s) {
+			return nil, fmt.Errorf("%w: %q is not terminated", ErrorArray, p.s)
+		}
+		switch p.s[p.i] {
+		case ',':
+			p.i++
+		case '}':
+			p.i++
+			return values, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q in %q", ErrorArray, p.s[p.i], p.s)
+		}
+	}
+}
+
+// element parses the array element starting at the current position
+func (p *arrayParser) element() (interface{}, error) {
+	if p.i >= len(p.s) {
+		return nil, fmt.Errorf("%w: %q is not terminated", ErrorArray, p.s)
+	}
+	switch p.s[p.i] {
+	case '{':
+		return p.array()
+	case '"':
+		// Quoted elements are never NULL, and escape quotes and backslashes with a backslash
+		var b strings.Builder
+		for p.i++; p.i < len(p.s); p.i++ {
+			switch c := p.s[p.i]; c {
+			case '\\':
+				p.i++
+				if p.i < len(p.s) {
+					b.WriteByte(p.s[p.i])
+				}
+			case '"':
+				p.i++
+				return p.convert(b.String())
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return nil, fmt.Errorf("%w: %q has an unterminated quote", ErrorArray, p.s)
+	}
+
+	end := strings.IndexAny(p.s[p.i:], ",}")
+	if end < 0 {
+		return nil, fmt.Errorf("%w: %q is not terminated", ErrorArray, p.s)
+	}
+	v := strings.TrimSpace(p.s[p.i : p.i+end])
+	p.i += end
+	if strings.EqualFold(v, "NULL") {
+		return nil, nil
+	}
+	return p.convert(v)
+}
+
+// convert converts an element to the element type of the array
+func (p *arrayParser) convert(v string) (interface{}, error) {
+	if p.elem == ArrayOfInt {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q is not an integer", ErrorArray, v)
+		}
+		return n, nil
+	}
+	return v, nil
+}
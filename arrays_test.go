@@ -0,0 +1,67 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseArray(t *testing.T) {
+	tests := []struct {
+		desc     string
+		input    string
+		elem     ArrayElement
+		expected []interface{}
+	}{
+		{desc: "integers", input: "{1,2,3}", elem: ArrayOfInt, expected: []interface{}{int64(1), int64(2), int64(3)}},
+		{desc: "integers with NULL", input: "{1,NULL,-3}", elem: ArrayOfInt, expected: []interface{}{int64(1), nil, int64(-3)}},
+		{desc: "empty array", input: "{}", elem: ArrayOfInt, expected: []interface{}{}},
+		{desc: "text", input: "{a,b c}", expected: []interface{}{"a", "b c"}},
+		{desc: "quoted text", input: `{"a,b","c\"d","e\\f"}`, expected: []interface{}{"a,b", `c"d`, `e\f`}},
+		{desc: "text with NULL", input: `{a,NULL,null,"NULL"}`, expected: []interface{}{"a", nil, nil, "NULL"}},
+		{desc: "nested arrays", input: "{{1,2},{3,NULL}}", elem: ArrayOfInt, expected: []interface{}{[]interface{}{int64(1), int64(2)}, []interface{}{int64(3), nil}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			values, err := parseArray(tt.input, tt.elem)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, values)
+		})
+	}
+
+	for _, input := range []string{"1,2", "{1,2", "{1,a}", `{"a}`, "{1}x", ""} {
+		_, err := parseArray(input, ArrayOfInt)
+		assert.ErrorIs(t, err, ErrorArray, input)
+	}
+}
+
+func TestQuery_ArrayConverter(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"ids", "tags"},
+			types:   []string{"_INT8", "_TEXT"},
+			rows: [][]driver.Value{
+				{"{1,2,NULL}", `{a,"b c",NULL}`},
+				{nil, "{}"},
+			},
+		}, nil
+	}}
+	converters := []sqlutil.Converter{ArrayConverter("_INT8", ArrayOfInt)}
+	columnConverters := map[string]sqlutil.Converter{"tags": ArrayConverter("", ArrayOfText)}
+
+	frames, err := query(context.Background(), fd.DB(), converters, columnConverters, DriverSettings{}, &Query{Format: FormatOptionTable})
+	require.NoError(t, err)
+
+	ids, tags := frames[0].Fields[0], frames[0].Fields[1]
+	require.Equal(t, data.FieldTypeNullableString, ids.Type())
+	require.Equal(t, data.FieldTypeNullableString, tags.Type())
+	assert.Equal(t, "[1,2,null]", *ids.At(0).(*string))
+	assert.Nil(t, ids.At(1).(*string))
+	assert.Equal(t, `["a","b c",null]`, *tags.At(0).(*string))
+	assert.Equal(t, "[]", *tags.At(1).(*string))
+}
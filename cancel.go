@@ -0,0 +1,112 @@
+package sqlds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+)
+
+// runningQuery is a query being run, which can be cancelled through the /cancel resource
+type runningQuery struct {
+	cancel        context.CancelFunc
+	query         *Query
+	settings      backend.DataSourceInstanceSettings
+	datasourceUID string
+	tags          QueryTags
+}
+
+// CancelRequest is the body of the /cancel resource. The query is identified by the QueryID it was run with or, if it
+// doesn't have one, by its RefID, optionally narrowed down to a dashboard and a panel.
+type CancelRequest struct {
+	QueryID      string `json:"queryId,omitempty"`
+	RefID        string `json:"refId,omitempty"`
+	DashboardUID string `json:"dashboardUid,omitempty"`
+	PanelID      string `json:"panelId,omitempty"`
+}
+
+// matches reports whether the request identifies the running query. Only the queries of the user sending the request
+// can be cancelled.
+func (r CancelRequest) matches(datasourceUID, user string, running *runningQuery) bool {
+	if running.datasourceUID != datasourceUID || running.tags.User != user {
+		return false
+	}
+	if r.QueryID != "" {
+		return running.query.QueryID == r.QueryID
+	}
+	return r.RefID != "" && running.query.RefID == r.RefID &&
+		(r.DashboardUID == "" || running.tags.DashboardUID == r.DashboardUID) &&
+		(r.PanelID == "" || running.tags.PanelID == r.PanelID)
+}
+
+// trackQuery registers the query as running until the returned function is called, returning the context to run it with.
+// Every run is tracked separately, so concurrent queries with the same RefID can all be cancelled.
+func (ds *sqldatasource) trackQuery(ctx context.Context, datasourceUID string, q *Query, settings backend.DataSourceInstanceSettings) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	running := &runningQuery{cancel, q, settings, datasourceUID, QueryTagsFromContext(ctx)}
+	ds.runningQueries.Store(running, running)
+
+	return ctx, func() {
+		ds.runningQueries.Delete(running)
+		cancel()
+	}
+}
+
+// cancelQuery cancels the running queries of the user identified by the request body. If the driver implements
+// QueryCanceler, it's also asked to cancel the queries in the database.
+func (ds *sqldatasource) cancelQuery(rw http.ResponseWriter, req *http.Request) {
+	if !ds.getCapabilities().Cancellation {
+		handleError(rw, ErrorNotImplemented)
+		return
+	}
+
+	body := CancelRequest{}
+	if req.Body != nil {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			handleError(rw, fmt.Errorf("%w: %v", ErrorJSON, err))
+			return
+		}
+	}
+
+	datasourceUID, user := "", ""
+	config := httpadapter.PluginConfigFromContext(req.Context())
+	if config.DataSourceInstanceSettings != nil {
+		datasourceUID = getDatasourceUID(*config.DataSourceInstanceSettings)
+	}
+	if config.User != nil {
+		user = config.User.Login
+	}
+	var matched []*runningQuery
+	ds.runningQueries.Range(func(key, value interface{}) bool {
+		if running := value.(*runningQuery); body.matches(datasourceUID, user, running) {
+			matched = append(matched, running)
+		}
+		return true
+	})
+	if len(matched) == 0 {
+		id := body.QueryID
+		if id == "" {
+			id = body.RefID
+		}
+		rw.WriteHeader(http.StatusNotFound)
+		if _, err := rw.Write([]byte(fmt.Sprintf("%s: %s", ErrorQueryNotRunning, id))); err != nil {
+			backend.Logger.Error(err.Error())
+		}
+		return
+	}
+
+	canceler, ok := ds.c.(QueryCanceler)
+	for _, running := range matched {
+		running.cancel()
+		if ok {
+			if err := canceler.CancelQuery(req.Context(), running.settings, running.query); err != nil {
+				handleError(rw, err)
+				return
+			}
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
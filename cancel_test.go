@@ -0,0 +1,203 @@
+package sqlds
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+)
+
+// cancelerDriver records the queries cancelled in the database
+type cancelerDriver struct {
+	fakeDriver
+
+	mu        sync.Mutex
+	cancelled []string
+}
+
+func (d *cancelerDriver) CancelQuery(ctx context.Context, settings backend.DataSourceInstanceSettings, q *Query) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cancelled = append(d.cancelled, q.RawSQL)
+	return nil
+}
+
+// resourceRecorder records the response of a resource call
+type resourceRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (r resourceRecorder) Send(res *backend.CallResourceResponse) error {
+	r.WriteHeader(res.Status)
+	_, err := r.Write(res.Body)
+	return err
+}
+
+func callCancel(t *testing.T, ds *sqldatasource, datasourceUID, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return callCancelAs(t, ds, datasourceUID, "", body)
+}
+
+func callCancelAs(t *testing.T, ds *sqldatasource, datasourceUID, user, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	var pluginUser *backend.User
+	if user != "" {
+		pluginUser = &backend.User{Login: user}
+	}
+	mux := http.NewServeMux()
+	if err := ds.registerRoutes(mux); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	res := resourceRecorder{httptest.NewRecorder()}
+	err := httpadapter.New(mux).CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{
+			User:                       pluginUser,
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{UID: datasourceUID},
+		},
+		Path:   "cancel",
+		Method: http.MethodPost,
+		URL:    "/cancel",
+		Body:   []byte(body),
+	}, res)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return res.ResponseRecorder
+}
+
+func Test_cancelQuery(t *testing.T) {
+	started := make(chan struct{})
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			return fakeResult{}, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return fakeResult{}, nil
+		}
+	}}
+	db := fd.DB()
+	d := &cancelerDriver{fakeDriver: fakeDriver{db: db}}
+	ds := &sqldatasource{c: d}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	result := make(chan error)
+	go func() {
+		_, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select sleep(5)"}`)}, "uid1")
+		result <- err
+	}()
+	<-started
+
+	t.Run("it should return not found if the query is not running", func(t *testing.T) {
+		for _, tc := range []struct{ uid, body string }{{"uid1", `{"refId": "B"}`}, {"uid2", `{"refId": "A"}`}} {
+			if res := callCancel(t, ds, tc.uid, tc.body); res.Code != http.StatusNotFound {
+				t.Errorf("expecting code %v got %v", http.StatusNotFound, res.Code)
+			}
+		}
+	})
+
+	t.Run("it should cancel the running query", func(t *testing.T) {
+		if res := callCancel(t, ds, "uid1", `{"refId": "A"}`); res.Code != http.StatusNoContent {
+			t.Fatalf("expecting code %v got %v", http.StatusNoContent, res.Code)
+		}
+		select {
+		case err := <-result:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("expecting error %v, got %v", context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the query was not cancelled")
+		}
+		if len(d.cancelled) != 1 || d.cancelled[0] != "select sleep(5)" {
+			t.Errorf("expecting the driver to cancel the query, got %v", d.cancelled)
+		}
+		if len(fd.Queries()) != 1 {
+			t.Errorf("expecting the query to not be retried, got %v", fd.Queries())
+		}
+	})
+
+	t.Run("it should forget the query once it's done", func(t *testing.T) {
+		if res := callCancel(t, ds, "uid1", `{"refId": "A"}`); res.Code != http.StatusNotFound {
+			t.Errorf("expecting code %v got %v", http.StatusNotFound, res.Code)
+		}
+	})
+}
+
+func Test_cancelQuery_concurrent(t *testing.T) {
+	started := make(chan struct{}, 3)
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			return fakeResult{}, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return fakeResult{}, nil
+		}
+	}}
+	db := fd.DB()
+	ds := &sqldatasource{c: &fakeDriver{db: db}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	run := func(user, queryID string) chan error {
+		result := make(chan error, 1)
+		ctx := withQueryTags(context.Background(), QueryTags{User: user, DashboardUID: "dash1", PanelID: "2"})
+		go func() {
+			_, err := runDataQuery(ctx, ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select sleep(5)", "queryId": "` + queryID + `"}`)}, "uid1")
+			result <- err
+		}()
+		<-started
+		return result
+	}
+	first, second, other := run("alice", "q1"), run("alice", "q2"), run("bob", "q3")
+	expectCancelled := func(t *testing.T, result chan error) {
+		t.Helper()
+		select {
+		case err := <-result:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("expecting error %v, got %v", context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the query was not cancelled")
+		}
+	}
+
+	t.Run("it should not cancel the queries of another user", func(t *testing.T) {
+		for _, body := range []string{`{"queryId": "q1"}`, `{"refId": "A"}`} {
+			if res := callCancelAs(t, ds, "uid1", "mallory", body); res.Code != http.StatusNotFound {
+				t.Errorf("expecting code %v got %v", http.StatusNotFound, res.Code)
+			}
+		}
+	})
+
+	t.Run("it should cancel the query by id", func(t *testing.T) {
+		if res := callCancelAs(t, ds, "uid1", "alice", `{"queryId": "q1"}`); res.Code != http.StatusNoContent {
+			t.Fatalf("expecting code %v got %v", http.StatusNoContent, res.Code)
+		}
+		expectCancelled(t, first)
+		select {
+		case err := <-second:
+			t.Fatalf("expecting the other query to keep running, got %v", err)
+		default:
+		}
+	})
+
+	t.Run("it should cancel the queries of the user by RefID, panel and dashboard", func(t *testing.T) {
+		if res := callCancelAs(t, ds, "uid1", "alice", `{"refId": "A", "panelId": "3"}`); res.Code != http.StatusNotFound {
+			t.Errorf("expecting code %v got %v", http.StatusNotFound, res.Code)
+		}
+		if res := callCancelAs(t, ds, "uid1", "bob", `{"refId": "A", "dashboardUid": "dash1", "panelId": "2"}`); res.Code != http.StatusNoContent {
+			t.Fatalf("expecting code %v got %v", http.StatusNoContent, res.Code)
+		}
+		expectCancelled(t, other)
+		if res := callCancelAs(t, ds, "uid1", "alice", `{"refId": "A"}`); res.Code != http.StatusNoContent {
+			t.Fatalf("expecting code %v got %v", http.StatusNoContent, res.Code)
+		}
+		expectCancelled(t, second)
+	})
+}
@@ -5,15 +5,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
 )
 
 const (
-	schemas = "schemas"
-	tables  = "tables"
-	columns = "columns"
+	schemas   = "schemas"
+	tables    = "tables"
+	columns   = "columns"
+	functions = "functions"
 )
 
 var (
@@ -33,6 +38,12 @@ type Completable interface {
 	Columns(ctx context.Context, options Options) ([]string, error)
 }
 
+// FunctionCompletable can be implemented by a Completable to also autocomplete the functions or keywords of the SQL dialect.
+// If it's not implemented, the /functions resource returns an empty list.
+type FunctionCompletable interface {
+	Functions(ctx context.Context) ([]string, error)
+}
+
 func handleError(rw http.ResponseWriter, err error) {
 	rw.WriteHeader(http.StatusBadRequest)
 	_, err = rw.Write([]byte(err.Error()))
@@ -49,6 +60,82 @@ func sendResourceResponse(rw http.ResponseWriter, res []string) {
 	}
 }
 
+// completionCacheEntry is a cached result of the Completable interface
+type completionCacheEntry struct {
+	datasourceUID string
+	res           []string
+	expires       time.Time
+}
+
+// completionDatasourceUID returns the UID of the datasource of the resource request, or an empty string if it's unknown
+func completionDatasourceUID(ctx context.Context) string {
+	if settings := httpadapter.PluginConfigFromContext(ctx).DataSourceInstanceSettings; settings != nil {
+		return getDatasourceUID(*settings)
+	}
+	return ""
+}
+
+// completionCacheKey identifies the request by datasource, resource type and options
+func completionCacheKey(datasourceUID string, rtype string, options Options) (string, error) {
+	// Map keys are sorted when encoded so the same options always produce the same key
+	opts, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%s", datasourceUID, rtype, string(opts)), nil
+}
+
+// complete calls the Completable interface. If DriverSettings.CompletionCacheTTL is set, the results are cached
+// for that duration and refreshed on the first request after they expire. The expired entries are removed when a result
+// is cached.
+func (ds *sqldatasource) complete(ctx context.Context, rtype string, options Options) ([]string, error) {
+	ttl := ds.driverSettings.CompletionCacheTTL
+	datasourceUID := completionDatasourceUID(ctx)
+	key := ""
+	if ttl != 0 {
+		var err error
+		key, err = completionCacheKey(datasourceUID, rtype, options)
+		if err != nil {
+			return nil, err
+		}
+		if cached, ok := ds.completionCache.Load(key); ok {
+			if entry := cached.(completionCacheEntry); time.Now().Before(entry.expires) {
+				return entry.res, nil
+			}
+		}
+	}
+
+	var res []string
+	var err error
+	switch rtype {
+	case schemas:
+		res, err = ds.Completable.Schemas(ctx, options)
+	case tables:
+		res, err = ds.Completable.Tables(ctx, options)
+	case columns:
+		res, err = ds.Completable.Columns(ctx, options)
+	case functions:
+		res = []string{}
+		if c, ok := ds.Completable.(FunctionCompletable); ok {
+			res, err = c.Functions(ctx)
+		}
+	default:
+		err = fmt.Errorf("unexpected resource type: %s", rtype)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl != 0 {
+		now := time.Now()
+		deleteMatching(&ds.completionCache, func(key, value interface{}) bool {
+			return now.After(value.(completionCacheEntry).expires)
+		})
+		ds.completionCache.Store(key, completionCacheEntry{datasourceUID, res, now.Add(ttl)})
+	}
+	return res, nil
+}
+
 func (ds *sqldatasource) getResources(rtype string) func(rw http.ResponseWriter, req *http.Request) {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		if ds.Completable == nil {
@@ -65,18 +152,7 @@ func (ds *sqldatasource) getResources(rtype string) func(rw http.ResponseWriter,
 			}
 		}
 
-		var res []string
-		var err error
-		switch rtype {
-		case schemas:
-			res, err = ds.Completable.Schemas(req.Context(), options)
-		case tables:
-			res, err = ds.Completable.Tables(req.Context(), options)
-		case columns:
-			res, err = ds.Completable.Columns(req.Context(), options)
-		default:
-			err = fmt.Errorf("unexpected resource type: %s", rtype)
-		}
+		res, err := ds.complete(req.Context(), rtype, options)
 		if err != nil {
 			handleError(rw, err)
 			return
@@ -86,11 +162,147 @@ func (ds *sqldatasource) getResources(rtype string) func(rw http.ResponseWriter,
 	}
 }
 
+// MacroInfo describes a macro that can be used in the queries
+type MacroInfo struct {
+	Name string `json:"name"`
+	// Default is false if the macro is defined or overridden by the driver
+	Default bool `json:"default"`
+	MacroDoc
+}
+
+// getMacros returns the macros available for the driver, sorted by name, with their documentation. The macros defined by
+// the driver are documented by its MacroDocumenter, and the default ones by DefaultMacroDocs.
+func (ds *sqldatasource) getMacros(rw http.ResponseWriter, req *http.Request) {
+	defaults := RegisterMacros(defaultMacros(ds.c, ds.driverSettings), ds.datasourceMacros())
+	custom := RegisterMacros(ds.macros, ds.c.Macros())
+
+	var docs map[string]MacroDoc
+	if d, ok := ds.c.(MacroDocumenter); ok {
+		docs = d.MacroDocs()
+	}
+
+	res := []MacroInfo{}
+	for name := range RegisterMacros(defaults, custom) {
+		_, overridden := custom[name]
+		info := MacroInfo{Name: name, Default: !overridden}
+		if doc, ok := docs[name]; ok {
+			info.MacroDoc = doc
+		} else if !overridden {
+			info.MacroDoc = DefaultMacroDocs[name]
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	rw.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		handleError(rw, err)
+	}
+}
+
+// InterpolationResult is the response of the /interpolate endpoint
+type InterpolationResult struct {
+	RawSQL string `json:"rawSql"`
+	Error  string `json:"error,omitempty"`
+}
+
+// interpolateQuery returns the SQL that would be sent to the database for the query in the request body, without
+// running it. The body is a backend.DataQuery, with the query model in its JSON, or only the query model.
+func (ds *sqldatasource) interpolateQuery(rw http.ResponseWriter, req *http.Request) {
+	dataQuery := backend.DataQuery{}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			handleError(rw, err)
+			return
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &dataQuery); err != nil {
+				handleError(rw, fmt.Errorf("%w: %v", ErrorJSON, err))
+				return
+			}
+		}
+		if len(dataQuery.JSON) == 0 {
+			dataQuery.JSON = body
+		}
+	}
+	if len(dataQuery.JSON) == 0 {
+		dataQuery.JSON = []byte("{}")
+	}
+	q, err := GetQuery(dataQuery)
+	if err != nil {
+		handleError(rw, err)
+		return
+	}
+
+	ctx := req.Context()
+	if user := httpadapter.PluginConfigFromContext(ctx).User; user != nil {
+		ctx = withQueryTags(ctx, QueryTags{User: user.Login})
+	}
+	q, err = ds.prepareQuery(ctx, q)
+	res := InterpolationResult{RawSQL: q.RawSQL}
+
+	rw.Header().Add("Content-Type", "application/json")
+	if err != nil {
+		res.Error = err.Error()
+		rw.WriteHeader(http.StatusBadRequest)
+	}
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		backend.Logger.Error(err.Error())
+	}
+}
+
+// ValidationResult is the response of the /validate endpoint
+type ValidationResult struct {
+	Valid  bool         `json:"valid"`
+	Errors []MacroError `json:"errors"`
+}
+
+// validateQuery checks the macros of the query in the request body, without interpolating or running the query
+func (ds *sqldatasource) validateQuery(rw http.ResponseWriter, req *http.Request) {
+	q := &Query{}
+	if req.Body != nil {
+		if err := json.NewDecoder(req.Body).Decode(q); err != nil {
+			handleError(rw, fmt.Errorf("%w: %v", ErrorJSON, err))
+			return
+		}
+	}
+
+	res := ValidationResult{Errors: []MacroError{}}
+	if !q.SkipInterpolation {
+		builtin := defaultMacros(ds.c, ds.driverSettings)
+		extra := RegisterMacros(ds.datasourceMacros(), RegisterMacros(ds.macros, ds.c.Macros()))
+		// The datasource and driver macros can reach the database (e.g. $__columns), so only the built-in ones are
+		// called to check their arguments
+		checked := Macros{}
+		for name, macro := range builtin {
+			if _, ok := extra[name]; !ok {
+				checked[name] = macro
+			}
+		}
+		_, allowUnknown := ds.c.(DefaultMacroHandler)
+		res.Errors = validateMacros(RegisterMacros(builtin, extra), checked, getMacroPrefix(ds.c), q, ds.driverSettings.IgnoreCommentedMacros, allowUnknown)
+	}
+	res.Valid = len(res.Errors) == 0
+
+	rw.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		backend.Logger.Error(err.Error())
+	}
+}
+
 func (ds *sqldatasource) registerRoutes(mux *http.ServeMux) error {
 	defaultRoutes := map[string]func(http.ResponseWriter, *http.Request){
-		"/tables":  ds.getResources(tables),
-		"/schemas": ds.getResources(schemas),
-		"/columns": ds.getResources(columns),
+		"/tables":      ds.getResources(tables),
+		"/schemas":     ds.getResources(schemas),
+		"/columns":     ds.getResources(columns),
+		"/functions":   ds.getResources(functions),
+		"/macros":      ds.getMacros,
+		"/interpolate": ds.interpolateQuery,
+		"/validate":    ds.validateQuery,
+		"/cancel":      ds.cancelQuery,
 	}
 	for route, handler := range defaultRoutes {
 		mux.HandleFunc(route, handler)
@@ -10,7 +10,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -127,6 +129,439 @@ func TestCompletable(t *testing.T) {
 	}
 }
 
+// functionCompletable also autocompletes functions
+type functionCompletable struct {
+	fakeCompletable
+	functions []string
+}
+
+func (f *functionCompletable) Functions(ctx context.Context) ([]string, error) {
+	return f.functions, f.err
+}
+
+func TestCompletable_functions(t *testing.T) {
+	tests := []struct {
+		description string
+		impl        Completable
+		expectedRes string
+	}{
+		{"it should return the functions", &functionCompletable{functions: []string{"avg", "count"}}, `["avg","count"]` + "\n"},
+		{"it should return an empty list if the functions are not implemented", &fakeCompletable{}, `[]` + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sqlds := &sqldatasource{Completable: test.impl}
+			sqlds.getResources(functions)(w, &http.Request{})
+
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expecting code %v got %v", http.StatusOK, resp.StatusCode)
+			}
+			if string(body) != test.expectedRes {
+				t.Errorf("expecting response %v got %v", test.expectedRes, string(body))
+			}
+		})
+	}
+
+	t.Run("it should return the error of the driver", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		sqlds := &sqldatasource{Completable: &functionCompletable{fakeCompletable: fakeCompletable{err: errors.New("boom")}}}
+		sqlds.getResources(functions)(w, &http.Request{})
+
+		if resp := w.Result(); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expecting code %v got %v", http.StatusBadRequest, resp.StatusCode)
+		}
+	})
+}
+
+// countingCompletable counts the calls to the Completable interface
+type countingCompletable struct {
+	calls int
+
+	fakeCompletable
+}
+
+func (c *countingCompletable) Tables(ctx context.Context, options Options) ([]string, error) {
+	c.calls++
+	return c.fakeCompletable.Tables(ctx, options)
+}
+
+func (c *countingCompletable) Columns(ctx context.Context, options Options) ([]string, error) {
+	c.calls++
+	return c.fakeCompletable.Columns(ctx, options)
+}
+
+func TestCompletable_cache(t *testing.T) {
+	getTables := func(ds *sqldatasource, schema string) string {
+		w := httptest.NewRecorder()
+		b := ioutil.NopCloser(bytes.NewReader([]byte(fmt.Sprintf(`{"schema":"%s"}`, schema))))
+		ds.getResources(tables)(w, &http.Request{Body: b})
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+	impl := func() *countingCompletable {
+		return &countingCompletable{fakeCompletable: fakeCompletable{tables: map[string][]string{"foo": {"a"}, "bar": {"b"}}}}
+	}
+
+	t.Run("it should cache the results within the TTL", func(t *testing.T) {
+		c := impl()
+		sqlds := &sqldatasource{Completable: c, driverSettings: DriverSettings{CompletionCacheTTL: time.Minute}}
+		for i := 0; i < 3; i++ {
+			if res := getTables(sqlds, "foo"); res != `["a"]`+"\n" {
+				t.Errorf("unexpected response %v", res)
+			}
+		}
+		if c.calls != 1 {
+			t.Errorf("expecting 1 call got %d", c.calls)
+		}
+		if res := getTables(sqlds, "bar"); res != `["b"]`+"\n" {
+			t.Errorf("unexpected response %v", res)
+		}
+		if c.calls != 2 {
+			t.Errorf("expecting a separate entry for each set of options, got %d calls", c.calls)
+		}
+	})
+
+	t.Run("it should refresh expired entries", func(t *testing.T) {
+		c := impl()
+		sqlds := &sqldatasource{Completable: c, driverSettings: DriverSettings{CompletionCacheTTL: time.Millisecond}}
+		getTables(sqlds, "foo")
+		time.Sleep(5 * time.Millisecond)
+		getTables(sqlds, "foo")
+		if c.calls != 2 {
+			t.Errorf("expecting 2 calls got %d", c.calls)
+		}
+	})
+
+	t.Run("it should remove the expired entries", func(t *testing.T) {
+		c := impl()
+		sqlds := &sqldatasource{Completable: c, driverSettings: DriverSettings{CompletionCacheTTL: time.Millisecond}}
+		getTables(sqlds, "foo")
+		time.Sleep(5 * time.Millisecond)
+		getTables(sqlds, "bar")
+		entries := 0
+		sqlds.completionCache.Range(func(key, value interface{}) bool {
+			entries++
+			return true
+		})
+		if entries != 1 {
+			t.Errorf("expecting 1 entry, got %d", entries)
+		}
+	})
+
+	t.Run("it should not cache without a TTL", func(t *testing.T) {
+		c := impl()
+		sqlds := &sqldatasource{Completable: c}
+		getTables(sqlds, "foo")
+		getTables(sqlds, "foo")
+		if c.calls != 2 {
+			t.Errorf("expecting 2 calls got %d", c.calls)
+		}
+	})
+}
+
+func Test_getMacros(t *testing.T) {
+	t.Run("it should list the default and the driver macros", func(t *testing.T) {
+		sqlds := NewDatasource(&MockDB{})
+		mux := http.NewServeMux()
+		if err := sqlds.registerRoutes(mux); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/macros", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		mux.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expecting code %v got %v", http.StatusOK, resp.Code)
+		}
+		res := []MacroInfo{}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		macros := map[string]bool{}
+		for _, m := range res {
+			macros[m.Name] = m.Default
+		}
+		expected := map[string]bool{"timeFilter": true, "quoteIdentifier": true, "foo": false, "timeGroup": false}
+		for name, isDefault := range expected {
+			if d, ok := macros[name]; !ok || d != isDefault {
+				t.Errorf("expecting macro %s with default %v, got %v", name, isDefault, res)
+			}
+		}
+	})
+}
+
+type documentedDB struct {
+	MockDB
+}
+
+func (d *documentedDB) MacroDocs() map[string]MacroDoc {
+	return map[string]MacroDoc{
+		"foo":     {Summary: "Returns bar"},
+		"timeTo":  {Summary: "Filters the column by the end of the dashboard period", Args: []string{"column"}},
+		"missing": {Summary: "Not a macro"},
+	}
+}
+
+func Test_getMacros_docs(t *testing.T) {
+	getMacros := func(t *testing.T, driver Driver) map[string]MacroInfo {
+		sqlds := NewDatasource(driver)
+		mux := http.NewServeMux()
+		if err := sqlds.registerRoutes(mux); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/macros", nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		mux.ServeHTTP(resp, req)
+		res := []MacroInfo{}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		macros := map[string]MacroInfo{}
+		for _, m := range res {
+			macros[m.Name] = m
+		}
+		return macros
+	}
+
+	t.Run("it should document the default macros", func(t *testing.T) {
+		macros := getMacros(t, &MockDB{})
+		expected := MacroInfo{Name: "timeFilter", Default: true, MacroDoc: MacroDoc{Summary: "Filters the column by the query period", Args: []string{"column", "[cast]"}}}
+		if !reflect.DeepEqual(macros["timeFilter"], expected) {
+			t.Errorf("expecting %+v, got %+v", expected, macros["timeFilter"])
+		}
+		if doc := macros["timeGroup"].MacroDoc; doc.Summary != "" {
+			t.Errorf("expecting the macro redefined by the driver to not use the default docs, got %+v", doc)
+		}
+	})
+
+	t.Run("it should use the docs of the driver", func(t *testing.T) {
+		macros := getMacros(t, &documentedDB{})
+		if macros["foo"].Summary != "Returns bar" {
+			t.Errorf("expecting the driver docs, got %+v", macros["foo"])
+		}
+		if macros["timeTo"].Summary != "Filters the column by the end of the dashboard period" || !macros["timeTo"].Default {
+			t.Errorf("expecting the driver docs of the default macro, got %+v", macros["timeTo"])
+		}
+		if _, ok := macros["missing"]; ok {
+			t.Errorf("expecting only the macros to be listed")
+		}
+	})
+
+	t.Run("all the default macros should be documented", func(t *testing.T) {
+		ds := NewDatasource(&MockDB{})
+		ds.Completable = &fakeCompletable{}
+		macros := RegisterMacros(defaultMacros(ds.c, DriverSettings{}), ds.datasourceMacros())
+		for name := range macros {
+			if DefaultMacroDocs[name].Summary == "" {
+				t.Errorf("expecting macro %s to be documented", name)
+			}
+		}
+		for name := range DefaultMacroDocs {
+			if _, ok := macros[name]; !ok {
+				t.Errorf("expecting documented macro %s to be defined", name)
+			}
+		}
+	})
+}
+
+func Test_interpolateQuery(t *testing.T) {
+	tests := []struct {
+		desc     string
+		body     string
+		code     int
+		expected InterpolationResult
+	}{
+		{
+			desc:     "valid query",
+			body:     `{"rawSql": "select $__column from $__table where $__foo()", "table": "t", "column": "c"}`,
+			code:     http.StatusOK,
+			expected: InterpolationResult{RawSQL: "select c from t where bar"},
+		},
+		{
+			desc:     "macro error",
+			body:     `{"rawSql": "select $__timeGroupAlias(time) from t"}`,
+			code:     http.StatusBadRequest,
+			expected: InterpolationResult{RawSQL: "select $__timeGroupAlias(time) from t", Error: "Could not apply macros: macro timeGroupAlias at offset 7: unexpected number of arguments: timeGroupAlias expected 2 or 3 arguments, received 1"},
+		},
+		{
+			desc:     "data query",
+			body:     `{"refId": "A", "maxDataPoints": 100, "interval": 60000000000, "timeRange": {"from": "2021-07-01T10:00:00Z", "to": "2021-07-01T11:00:00Z"}, "json": {"rawSql": "select $__refId, $__interval_s, $__maxDataPoints from t where $__timeFilter(time)"}}`,
+			code:     http.StatusOK,
+			expected: InterpolationResult{RawSQL: "select 'A', 60, 100 from t where time >= '2021-07-01T10:00:00Z' AND time <= '2021-07-01T11:00:00Z'"},
+		},
+		{
+			desc:     "paginated query",
+			body:     `{"json": {"rawSql": "select * from t", "offset": 20, "pageSize": 10}}`,
+			code:     http.StatusOK,
+			expected: InterpolationResult{RawSQL: "select * from t LIMIT 10 OFFSET 20"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			sqlds := NewDatasource(&MockDB{})
+			mux := http.NewServeMux()
+			if err := sqlds.registerRoutes(mux); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/interpolate", bytes.NewBufferString(tc.body))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			mux.ServeHTTP(resp, req)
+
+			if resp.Code != tc.code {
+				t.Fatalf("expecting code %v got %v", tc.code, resp.Code)
+			}
+			res := InterpolationResult{}
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if res != tc.expected {
+				t.Errorf("unexpected response %+v", res)
+			}
+		})
+	}
+
+	t.Run("it should mutate the query", func(t *testing.T) {
+		mux := http.NewServeMux()
+		if err := NewDatasource(&tenantDriver{}).registerRoutes(mux); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		resp := httptest.NewRecorder()
+		req, err := http.NewRequest("POST", "/interpolate", bytes.NewBufferString(`{"rawSql": "select * from $__table", "table": "foo"}`))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		mux.ServeHTTP(resp, req)
+
+		res := InterpolationResult{}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if expected := "select * from tenant_foo WHERE tenant = 'x'"; res.RawSQL != expected {
+			t.Errorf("expecting %q, got %+v", expected, res)
+		}
+	})
+}
+
+func Test_validateQuery(t *testing.T) {
+	tests := []struct {
+		desc     string
+		body     string
+		code     int
+		expected ValidationResult
+	}{
+		{
+			desc:     "valid query",
+			body:     `{"rawSql": "select $__column from $__table where $__timeFilter(time) and $__foo()"}`,
+			code:     http.StatusOK,
+			expected: ValidationResult{Valid: true, Errors: []MacroError{}},
+		},
+		{
+			desc: "unknown macro and parse error",
+			body: `{"rawSql": "select $__unknown(a) from t where $__timeFilter(time"}`,
+			code: http.StatusOK,
+			expected: ValidationResult{Errors: []MacroError{
+				{Macro: "unknown", Offset: 7, Message: "unknown macro"},
+				{Macro: "timeFilter", Offset: 34, Message: "error parsing macro arguments: missing closing parenthesis"},
+			}},
+		},
+		{
+			desc: "invalid arguments",
+			body: `{"rawSql": "select a from t where $__timeFilter(a, b, c) and b = $__arg(1b)"}`,
+			code: http.StatusOK,
+			expected: ValidationResult{Errors: []MacroError{
+				{Macro: "timeFilter", Offset: 22, Message: "unexpected number of arguments: expected 1 or 2 arguments, received 3"},
+				{Macro: "arg", Offset: 53, Message: `invalid macro argument: invalid argument name "1b"`},
+			}},
+		},
+		{
+			desc:     "nested macros",
+			body:     `{"rawSql": "select $__timeGroup($__column, 1m) from t where $__timeFilter(time) and b = $__arg(b)", "args": {"b": 1}}`,
+			code:     http.StatusOK,
+			expected: ValidationResult{Valid: true, Errors: []MacroError{}},
+		},
+		{
+			desc:     "skipped interpolation",
+			body:     `{"rawSql": "select $__unknown(a", "skipInterpolation": true}`,
+			code:     http.StatusOK,
+			expected: ValidationResult{Valid: true, Errors: []MacroError{}},
+		},
+		{
+			desc:     "invalid JSON",
+			body:     `{"rawSql": 1}`,
+			code:     http.StatusBadRequest,
+			expected: ValidationResult{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			sqlds := NewDatasource(&MockDB{})
+			mux := http.NewServeMux()
+			if err := sqlds.registerRoutes(mux); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			resp := httptest.NewRecorder()
+			req, err := http.NewRequest("POST", "/validate", bytes.NewBufferString(tc.body))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			mux.ServeHTTP(resp, req)
+
+			if resp.Code != tc.code {
+				t.Fatalf("expecting code %v got %v", tc.code, resp.Code)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			res := ValidationResult{}
+			if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(res, tc.expected) {
+				t.Errorf("unexpected response %+v", res)
+			}
+		})
+	}
+}
+
+func Test_validateQuery_datasourceMacros(t *testing.T) {
+	c := &countingCompletable{fakeCompletable: fakeCompletable{columns: map[string][]string{"t": {"a", "b"}}}}
+	sqlds := NewDatasource(&MockDB{})
+	sqlds.Completable = c
+	mux := http.NewServeMux()
+	if err := sqlds.registerRoutes(mux); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	resp := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/validate", bytes.NewBufferString(`{"rawSql": "select $__columns(t) from t"}`))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	mux.ServeHTTP(resp, req)
+
+	res := ValidationResult{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !res.Valid {
+		t.Errorf("unexpected response %+v", res)
+	}
+	if c.calls != 0 {
+		t.Errorf("expecting the columns not to be looked up, got %d calls", c.calls)
+	}
+}
+
 func Test_registerRoutes(t *testing.T) {
 	t.Run("it should add a new route", func(t *testing.T) {
 		sqlds := &sqldatasource{}
@@ -204,3 +639,65 @@ func TestParseOptions(t *testing.T) {
 		})
 	}
 }
+
+// contextCompletable fails if the context is done
+type contextCompletable struct {
+	fakeCompletable
+	options Options
+}
+
+func (c *contextCompletable) Columns(ctx context.Context, options Options) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.options = options
+	return c.fakeCompletable.Columns(ctx, options)
+}
+
+func Test_interpolate_columns(t *testing.T) {
+	completable := &contextCompletable{fakeCompletable: fakeCompletable{columns: map[string][]string{
+		"metrics": {"time", "host", `my "value"`},
+	}}}
+	ds := NewDatasource(&MockDB{})
+	ds.Completable = completable
+
+	t.Run("it should list the quoted columns of the table", func(t *testing.T) {
+		rawSQL, err := ds.interpolate(context.Background(), &Query{RawSQL: "select $__columns(metrics) from metrics", Schema: "public"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expected := `select "time", "host", "my ""value""" from metrics`
+		if rawSQL != expected {
+			t.Errorf("expecting %s, got %s", expected, rawSQL)
+		}
+		if completable.options["table"] != "metrics" || completable.options["schema"] != "public" {
+			t.Errorf("expecting the table and the schema in the options, got %v", completable.options)
+		}
+	})
+
+	t.Run("it should use the query context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := ds.interpolate(ctx, &Query{RawSQL: "select $__columns(metrics) from metrics"})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expecting error %v, got %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("it should return an error if the table has no columns", func(t *testing.T) {
+		_, err := ds.interpolate(context.Background(), &Query{RawSQL: "select $__columns(other) from other"})
+		if !errors.Is(err, ErrorInvalidMacroArg) {
+			t.Errorf("expecting error %v, got %v", ErrorInvalidMacroArg, err)
+		}
+	})
+
+	t.Run("it should not be defined without a Completable", func(t *testing.T) {
+		rawSQL, err := NewDatasource(&MockDB{}).interpolate(context.Background(), &Query{RawSQL: "select $__columns(metrics) from metrics"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if rawSQL != "select $__columns(metrics) from metrics" {
+			t.Errorf("expecting the macro to be kept, got %s", rawSQL)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package sqlds
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+var (
+	// uuidTypeNames are the database type names of UUID columns
+	uuidTypeNames = []string{"UUID", "UNIQUEIDENTIFIER"}
+	// jsonTypeNames are the database type names of JSON columns
+	jsonTypeNames = []string{"JSON", "JSONB"}
+	// decimalTypeNames are the database type names of fixed precision numbers
+	decimalTypeNames = []string{"DECIMAL", "NUMERIC"}
+)
+
+// CommonConverters returns converters for types that are common to many databases, but that sqlutil doesn't convert:
+// UUID, JSON and DECIMAL (or NUMERIC) columns. They are converted to nullable strings, so decimals keep their precision.
+// Drivers can append them to the converters they return in Converters:
+//   return append(myConverters, sqlds.CommonConverters()...)
+func CommonConverters() []sqlutil.Converter {
+	var converters []sqlutil.Converter
+	for _, types := range []struct {
+		kind  string
+		names []string
+	}{
+		{"UUID", uuidTypeNames},
+		{"JSON", jsonTypeNames},
+		{"DECIMAL", decimalTypeNames},
+	} {
+		for _, name := range types.names {
+			converters = append(converters, stringConverter(fmt.Sprintf("%s converter for %s", types.kind, name), name))
+		}
+	}
+	return converters
+}
+
+// stringConverter returns a converter that scans the columns of the given database type into nullable strings
+func stringConverter(name, typeName string) sqlutil.Converter {
+	return sqlutil.Converter{
+		Name:          name,
+		InputScanType: reflect.TypeOf(sql.NullString{}),
+		InputTypeName: typeName,
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType: data.FieldTypeNullableString,
+			ConverterFunc: func(in interface{}) (interface{}, error) {
+				v := in.(*sql.NullString)
+				if !v.Valid {
+					return (*string)(nil), nil
+				}
+				s := v.String
+				return &s, nil
+			},
+		},
+	}
+}
+
+// RegexConverter applies a converter to the columns whose database type name matches TypeRegex, e.g. `^NUMERIC` for
+// all the NUMERIC(p,s) variants. Use ^ and $ to match the whole type name.
+type RegexConverter struct {
+	TypeRegex *regexp.Regexp
+	Converter sqlutil.Converter
+}
+
+// matchRegexConverter returns the converter of the first RegexConverter matching the database type
+func matchRegexConverter(converters []RegexConverter, typeName string) (sqlutil.Converter, bool) {
+	for _, c := range converters {
+		if c.TypeRegex != nil && c.TypeRegex.MatchString(typeName) {
+			return c.Converter, true
+		}
+	}
+	return sqlutil.Converter{}, false
+}
+
+// numericTypeRegex matches the database type names of integer, decimal and floating point columns,
+// e.g. INT, BIGINT UNSIGNED, INT8, NUMERIC(10,2) or DOUBLE PRECISION
+var numericTypeRegex = regexp.MustCompile(`(?i)^(U?(TINY|SMALL|MEDIUM|BIG)?INT(EGER)?\d*|DEC(IMAL)?|NUMERIC|NUMBER|FLOAT\d*|DOUBLE|REAL|MONEY)\b`)
+
+// isNumericColumn reports whether the column is numeric, by its database type name or the type it's scanned into
+func isNumericColumn(column *sql.ColumnType) bool {
+	if numericTypeRegex.MatchString(column.DatabaseTypeName()) {
+		return true
+	}
+	if t := column.ScanType(); t != nil {
+		return isNumericKind(t.Kind())
+	}
+	return false
+}
+
+// floatConverter scans numeric columns into nullable float64 fields, used by DriverSettings.CoerceNumericToFloat.
+// The values are read as strings, so that decimals using DriverSettings.DecimalSeparator and the NaN and Inf values
+// returned as strings can be parsed too. NaN and Inf are null if DriverSettings.NonFiniteAsNull is set.
+func floatConverter(settings DriverSettings) sqlutil.Converter {
+	return sqlutil.Converter{
+		Name:          "numeric to float64 converter",
+		InputScanType: reflect.TypeOf(sql.NullString{}),
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType: data.FieldTypeNullableFloat64,
+			ConverterFunc: func(in interface{}) (interface{}, error) {
+				v := in.(*sql.NullString)
+				if !v.Valid {
+					return (*float64)(nil), nil
+				}
+				f, err := parseFloat(v.String, settings.DecimalSeparator)
+				if err != nil {
+					return nil, err
+				}
+				if settings.NonFiniteAsNull && (math.IsNaN(f) || math.IsInf(f, 0)) {
+					return (*float64)(nil), nil
+				}
+				return &f, nil
+			},
+		},
+	}
+}
+
+// parseFloat parses a number using the given decimal separator, or a dot if it's empty.
+// NaN, Inf and Infinity are accepted in any case, optionally signed.
+func parseFloat(s string, decimalSeparator string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if decimalSeparator != "" && decimalSeparator != "." {
+		s = strings.Replace(s, decimalSeparator, ".", 1)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("could not convert %q to float64: %w", s, err)
+	}
+	return f, nil
+}
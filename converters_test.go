@@ -0,0 +1,215 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+func TestCommonConverters(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"id", "doc", "amount", "price"},
+			types:   []string{"UUID", "JSONB", "NUMERIC", "DECIMAL"},
+			rows: [][]driver.Value{
+				{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", []byte(`{"a": 1}`), "12345678901234567890.123456789", []byte("0.10")},
+				{nil, nil, nil, nil},
+			},
+		}, nil
+	}}
+
+	frames, err := query(context.Background(), fd.DB(), CommonConverters(), nil, DriverSettings{}, &Query{Format: FormatOptionTable})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []string{"6ba7b810-9dad-11d1-80b4-00c04fd430c8", `{"a": 1}`, "12345678901234567890.123456789", "0.10"}
+	for i, field := range frames[0].Fields {
+		if field.Type() != data.FieldTypeNullableString {
+			t.Errorf("expecting column %s to be a nullable string, got %s", field.Name, field.Type())
+			continue
+		}
+		if v, ok := field.At(0).(*string); !ok || v == nil || *v != expected[i] {
+			t.Errorf("expecting column %s to be %s, got %v", field.Name, expected[i], field.At(0))
+		}
+		if v := field.At(1).(*string); v != nil {
+			t.Errorf("expecting column %s to be null, got %s", field.Name, *v)
+		}
+	}
+}
+
+func TestRegexConverters(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"amount", "price", "total"},
+			types:   []string{"NUMERIC(10,2)", "NUMERIC", "DECIMAL(38,0)"},
+			rows:    [][]driver.Value{{"12.50", "0.10", "12345678901234567890"}},
+		}, nil
+	}}
+	exact := stringConverter("exact", "NUMERIC")
+	exact.FrameConverter.ConverterFunc = func(in interface{}) (interface{}, error) {
+		s := "exact"
+		return &s, nil
+	}
+	settings := DriverSettings{RegexConverters: []RegexConverter{
+		{TypeRegex: regexp.MustCompile(`^NUMERIC.*`), Converter: stringConverter("numeric", "")},
+		{TypeRegex: regexp.MustCompile(`^DECIMAL.*`), Converter: stringConverter("decimal", "")},
+	}}
+
+	frames, err := query(context.Background(), fd.DB(), []sqlutil.Converter{exact}, nil, settings, &Query{Format: FormatOptionTable})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// The exact match takes priority for NUMERIC
+	expected := []string{"12.50", "exact", "12345678901234567890"}
+	for i, field := range frames[0].Fields {
+		if field.Type() != data.FieldTypeNullableString {
+			t.Errorf("expecting column %s to be a nullable string, got %s", field.Name, field.Type())
+			continue
+		}
+		if v, ok := field.At(0).(*string); !ok || v == nil || *v != expected[i] {
+			t.Errorf("expecting column %s to be %s, got %v", field.Name, expected[i], field.At(0))
+		}
+	}
+}
+
+func TestCoerceNumericToFloat(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"id", "amount", "ratio", "count", "name", "interval"},
+			types:   []string{"INT", "DECIMAL(10,2)", "DOUBLE PRECISION", "", "VARCHAR", "INTERVAL"},
+			rows: [][]driver.Value{
+				{int64(1), "12.50", float64(0.5), int64(3), "a", "1 day"},
+				{nil, nil, nil, int64(4), "b", "2 days"},
+			},
+		}, nil
+	}}
+
+	t.Run("it should convert the numeric columns to float64", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{CoerceNumericToFloat: true}, &Query{Format: FormatOptionTable})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expected := []float64{1, 12.5, 0.5, 3}
+		for i, field := range frames[0].Fields[:4] {
+			if field.Type() != data.FieldTypeNullableFloat64 {
+				t.Errorf("expecting column %s to be a nullable float64, got %s", field.Name, field.Type())
+				continue
+			}
+			if v, ok := field.At(0).(*float64); !ok || v == nil || *v != expected[i] {
+				t.Errorf("expecting column %s to be %v, got %v", field.Name, expected[i], field.At(0))
+			}
+		}
+		if v := frames[0].Fields[0].At(1).(*float64); v != nil {
+			t.Errorf("expecting the NULL id to be nil, got %v", *v)
+		}
+		for _, field := range frames[0].Fields[4:] {
+			if field.Type() == data.FieldTypeNullableFloat64 {
+				t.Errorf("expecting column %s not to be converted", field.Name)
+			}
+		}
+	})
+
+	t.Run("it should keep the driver converters", func(t *testing.T) {
+		idConverter := sqlutil.Converter{
+			Name:          "id",
+			InputScanType: reflect.TypeOf(sql.NullInt64{}),
+			InputTypeName: "INT",
+			FrameConverter: sqlutil.FrameConverter{
+				FieldType: data.FieldTypeNullableString,
+				ConverterFunc: func(in interface{}) (interface{}, error) {
+					v := in.(*sql.NullInt64)
+					if !v.Valid {
+						return (*string)(nil), nil
+					}
+					s := fmt.Sprintf("id-%d", v.Int64)
+					return &s, nil
+				},
+			},
+		}
+		converters := append(CommonConverters(), idConverter)
+		frames, err := query(context.Background(), fd.DB(), converters, nil, DriverSettings{CoerceNumericToFloat: true}, &Query{Format: FormatOptionTable, RawSQL: "select 1"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		field := frames[0].Fields[0]
+		if field.Type() != data.FieldTypeNullableString {
+			t.Fatalf("expecting column %s to use the driver converter, got %s", field.Name, field.Type())
+		}
+		if v := field.At(0).(*string); v == nil || *v != "id-1" {
+			t.Errorf("expecting id-1, got %v", v)
+		}
+		if field := frames[0].Fields[1]; field.Type() != data.FieldTypeNullableFloat64 {
+			t.Errorf("expecting column %s to be a nullable float64, got %s", field.Name, field.Type())
+		}
+	})
+}
+
+func TestCoerceNumericToFloat_decimalSeparatorAndNonFinite(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"value"},
+			types:   []string{"DOUBLE"},
+			rows:    [][]driver.Value{{"1,5"}, {"NaN"}, {"-Infinity"}, {float64(2.25)}, {nil}},
+		}, nil
+	}}
+	values := func(t *testing.T, settings DriverSettings) []*float64 {
+		settings.CoerceNumericToFloat = true
+		frames, err := query(context.Background(), fd.DB(), nil, nil, settings, &Query{Format: FormatOptionTable})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		res := []*float64{}
+		for i := 0; i < frames[0].Rows(); i++ {
+			res = append(res, frames[0].Fields[0].At(i).(*float64))
+		}
+		return res
+	}
+
+	t.Run("it should parse the decimal separator and the non finite values", func(t *testing.T) {
+		res := values(t, DriverSettings{DecimalSeparator: ","})
+		if len(res) != 5 {
+			t.Fatalf("expecting 5 values, got %d", len(res))
+		}
+		if res[0] == nil || *res[0] != 1.5 {
+			t.Errorf("expecting 1,5 to be 1.5, got %v", res[0])
+		}
+		if res[1] == nil || !math.IsNaN(*res[1]) {
+			t.Errorf("expecting NaN, got %v", res[1])
+		}
+		if res[2] == nil || !math.IsInf(*res[2], -1) {
+			t.Errorf("expecting -Inf, got %v", res[2])
+		}
+		if res[3] == nil || *res[3] != 2.25 {
+			t.Errorf("expecting the float values to be kept, got %v", res[3])
+		}
+		if res[4] != nil {
+			t.Errorf("expecting null, got %v", *res[4])
+		}
+	})
+
+	t.Run("it should return null for the non finite values", func(t *testing.T) {
+		res := values(t, DriverSettings{DecimalSeparator: ",", NonFiniteAsNull: true})
+		if res[1] != nil || res[2] != nil {
+			t.Errorf("expecting NaN and Inf to be null, got %v and %v", res[1], res[2])
+		}
+		if res[0] == nil || *res[0] != 1.5 {
+			t.Errorf("expecting 1,5 to be 1.5, got %v", res[0])
+		}
+	})
+
+	t.Run("it should fail without the decimal separator", func(t *testing.T) {
+		_, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{CoerceNumericToFloat: true}, &Query{Format: FormatOptionTable})
+		if err == nil || !strings.Contains(err.Error(), `"1,5"`) {
+			t.Errorf("expecting an error parsing 1,5, got %v", err)
+		}
+	})
+}
@@ -7,12 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 )
 
 const defaultKeySuffix = "default"
@@ -35,12 +38,31 @@ type dbConnection struct {
 	settings backend.DataSourceInstanceSettings
 }
 
+// healthCheck is a successful CheckHealth result, cached until it expires
+type healthCheck struct {
+	result  *backend.CheckHealthResult
+	expires time.Time
+}
+
 type sqldatasource struct {
 	Completable
 
-	dbConnections  sync.Map
-	c              Driver
-	driverSettings DriverSettings
+	dbConnections   sync.Map
+	connectionLocks sync.Map
+	healthChecks    sync.Map
+	completionCache sync.Map
+	streams         sync.Map
+	querySlots      sync.Map
+	querySlotsMu    sync.Mutex
+	runningQueries  sync.Map
+	c               Driver
+	capabilities    Capabilities
+	capsOnce        sync.Once
+	resultCache     *resultCache
+	resultCacheOnce sync.Once
+	driverSettings  DriverSettings
+	macros          Macros
+	metrics         Metrics
 
 	backend.CallResourceHandler
 	CustomRoutes map[string]func(http.ResponseWriter, *http.Request)
@@ -62,6 +84,68 @@ func (ds *sqldatasource) storeDBConnection(key string, dbConn dbConnection) {
 	ds.dbConnections.Store(key, dbConn)
 }
 
+// getDefaultDBConnection returns the default connection of the datasource, reconnecting if it has been evicted
+func (ds *sqldatasource) getDefaultDBConnection(datasourceUID string) (string, dbConnection, error) {
+	key := defaultKey(datasourceUID)
+	dbConn, ok := ds.getDBConnection(key)
+	if !ok {
+		return "", dbConnection{}, MissingDBConnection
+	}
+	if dbConn.db != nil {
+		return key, dbConn, nil
+	}
+
+	dbConn, err := ds.reconnect(key, dbConn, nil)
+	if err != nil {
+		return "", dbConnection{}, err
+	}
+	return key, dbConn, nil
+}
+
+// lockConnection locks the connection of the key until the returned function is called, so that it's replaced or
+// evicted by a single query at a time
+func (ds *sqldatasource) lockConnection(key string) func() {
+	v, _ := ds.connectionLocks.LoadOrStore(key, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// reconnect replaces the stale connection of the key with a new one, unless another query replaced it already, in which
+// case the connection of that query is returned. stale.db is nil if there's no connection yet.
+func (ds *sqldatasource) reconnect(key string, stale dbConnection, args json.RawMessage) (dbConnection, error) {
+	defer ds.lockConnection(key)()
+	if current, ok := ds.getDBConnection(key); ok && current.db != nil && current.db != stale.db {
+		return current, nil
+	}
+	db, err := ds.connect(stale.settings, args)
+	if err != nil {
+		return dbConnection{}, err
+	}
+	dbConn := dbConnection{db, stale.settings}
+	ds.storeDBConnection(key, dbConn)
+	return dbConn, nil
+}
+
+// evictDBConnection closes the connection, so that a new one is created for the next query.
+// The settings of the default connection are kept to be able to reconnect.
+func (ds *sqldatasource) evictDBConnection(key string, stale *sql.DB) {
+	defer ds.lockConnection(key)()
+	// Another query may have replaced the stale connection already
+	dbConn, ok := ds.getDBConnection(key)
+	if !ok || dbConn.db == nil || dbConn.db != stale {
+		return
+	}
+	if strings.HasSuffix(key, "-"+defaultKeySuffix) {
+		ds.storeDBConnection(key, dbConnection{nil, dbConn.settings})
+	} else {
+		ds.dbConnections.Delete(key)
+	}
+	if err := dbConn.db.Close(); err != nil {
+		backend.Logger.Error(err.Error())
+	}
+}
+
 func getDatasourceUID(settings backend.DataSourceInstanceSettings) string {
 	datasourceUID := settings.UID
 	// Grafana < 8.0 won't include the UID yet
@@ -71,14 +155,116 @@ func getDatasourceUID(settings backend.DataSourceInstanceSettings) string {
 	return datasourceUID
 }
 
+// checkHealthQuery runs the health check query, which must return at least one row
+func checkHealthQuery(ctx context.Context, db Connection, query string) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return queryError(err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return queryError(err)
+		}
+		return ErrorNoResults
+	}
+	return nil
+}
+
+// healthDetails returns the health details of the driver encoded as JSON, or nil if there are none
+func healthDetails(ctx context.Context, d HealthDetailer, db Connection) ([]byte, error) {
+	details, err := d.HealthDetails(ctx, db)
+	if err != nil || len(details) == 0 {
+		return nil, err
+	}
+	return json.Marshal(details)
+}
+
+// poolConfigurer is satisfied by the *sql.DB type
+type poolConfigurer interface {
+	SetMaxOpenConns(n int)
+	SetMaxIdleConns(n int)
+	SetConnMaxLifetime(d time.Duration)
+}
+
+// applyPoolSettings configures the connection pool. Zero values keep the database/sql defaults.
+func applyPoolSettings(db poolConfigurer, settings DriverSettings) {
+	if settings.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(settings.MaxOpenConns)
+	}
+	if settings.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(settings.MaxIdleConns)
+	}
+	if settings.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(settings.ConnMaxLifetime)
+	}
+}
+
+// defaultRetryBackoff is the time to wait before the first retry if DriverSettings.RetryBackoff is not set
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// retry calls fn until it succeeds or returns an error that is not transient according to DriverSettings.RetryOn,
+// doubling the time between attempts. It gives up after DriverSettings.RetryAttempts attempts or when ctx is done.
+func retry(ctx context.Context, settings DriverSettings, fn func() error) error {
+	backoff := settings.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || settings.RetryOn == nil || !settings.RetryOn(err) || attempt >= settings.RetryAttempts {
+			return err
+		}
+		backend.Logger.Debug("retrying after transient error", "attempt", attempt, "error", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// connect calls the driver to connect to the database and applies the connection pool settings
+func (ds *sqldatasource) connect(settings backend.DataSourceInstanceSettings, args json.RawMessage) (*sql.DB, error) {
+	var db *sql.DB
+	err := ds.retry(context.Background(), ds.driverSettings, func() error {
+		var err error
+		db, err = ds.c.Connect(settings, args)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ds.count(MetricConnectionsOpened)
+	applyPoolSettings(db, ds.driverSettings)
+	return db, nil
+}
+
 // NewDatasource creates a new `sqldatasource`.
 // It uses the provided settings argument to call the ds.Driver to connect to the SQL server
 func (ds *sqldatasource) NewDatasource(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
-	db, err := ds.c.Connect(settings, nil)
-	if err != nil {
+	if err := ValidateMacros(RegisterMacros(ds.macros, ds.c.Macros())); err != nil {
 		return nil, err
 	}
-	key := defaultKey(getDatasourceUID(settings))
+	ds.driverSettings = ds.c.Settings(settings)
+	datasourceUID := getDatasourceUID(settings)
+	// The instance manager creates the instance again when the settings of the datasource are saved, so nothing obtained
+	// with the previous settings is kept. The other datasources are not affected.
+	ds.dispose(func(uid string) bool { return uid == datasourceUID })
+	key := defaultKey(datasourceUID)
+	db, err := ds.connect(settings, nil)
+	if err != nil {
+		if !ds.driverSettings.WarmupOnStart {
+			return nil, err
+		}
+		// The first query will try to connect again
+		backend.Logger.Warn("Could not connect to warm up the datasource", "error", err)
+	} else if ds.driverSettings.WarmupOnStart {
+		ds.warmup(db)
+	}
 	ds.storeDBConnection(key, dbConnection{db, settings})
 
 	mux := http.NewServeMux()
@@ -88,11 +274,24 @@ func (ds *sqldatasource) NewDatasource(settings backend.DataSourceInstanceSettin
 	}
 
 	ds.CallResourceHandler = httpadapter.New(mux)
-	ds.driverSettings = ds.c.Settings(settings)
 
 	return ds, nil
 }
 
+// warmup opens a connection to the database, so that it's ready for the first query.
+// Failures are only logged, since the connection is opened again when needed.
+func (ds *sqldatasource) warmup(db *sql.DB) {
+	ctx := context.Background()
+	if ds.driverSettings.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ds.driverSettings.Timeout)
+		defer cancel()
+	}
+	if err := db.PingContext(ctx); err != nil {
+		backend.Logger.Warn("Could not ping the database to warm up the datasource", "error", err)
+	}
+}
+
 // NewDatasource initializes the Datasource wrapper and instance manager
 func NewDatasource(c Driver) *sqldatasource {
 	return &sqldatasource{
@@ -100,37 +299,170 @@ func NewDatasource(c Driver) *sqldatasource {
 	}
 }
 
-// Dispose cleans up datasource instance resources.
-// Note: Called when testing and saving a datasource
+// RegisterMacros adds macros to the ones defined by the driver. The driver macros take precedence
+// over the registered ones, which take precedence over the DefaultMacros.
+// It should be called before the datasource starts handling queries.
+func (ds *sqldatasource) RegisterMacros(macros Macros) {
+	ds.macros = RegisterMacros(ds.macros, macros)
+}
+
+// interpolate applies the driver macros and the registered ones to the query
+func (ds *sqldatasource) interpolate(ctx context.Context, q *Query) (string, error) {
+	macros := RegisterMacros(ds.datasourceMacros(), RegisterMacros(ds.macros, ds.c.Macros()))
+	return interpolateMacros(ds.c, ds.driverSettings, macros, q.WithContext(ctx))
+}
+
+// datasourceMacros returns the default macros that depend on the datasource, like $__columns, which needs the
+// Completable to read the columns of the tables
+func (ds *sqldatasource) datasourceMacros() Macros {
+	macros := Macros{}
+	if ds.Completable != nil {
+		macros["columns"] = macroColumns(ds.Completable, ds.driverSettings)
+	}
+	return disableMacros(ds.c, macros)
+}
+
+// Dispose cancels the running queries and closes the connections of all the datasources, e.g. when the plugin shuts down.
+// The settings of their default connections are kept, so that they connect again on their next query.
 func (ds *sqldatasource) Dispose() {
+	ds.dispose(func(string) bool { return true })
 }
 
-// QueryData creates the Responses list and executes each query
+// dispose cancels the running queries and closes the connections of the datasources matched by their UID.
+// Their cached health checks, completions and results, pending streams and query slots are dropped too, so that
+// nothing obtained with the previous settings is used after they change.
+func (ds *sqldatasource) dispose(match func(datasourceUID string) bool) {
+	// The queries are cancelled first, since closing a connection waits for its queries to finish
+	ds.runningQueries.Range(func(key, value interface{}) bool {
+		if running := value.(*runningQuery); match(running.datasourceUID) {
+			ds.runningQueries.Delete(key)
+			running.cancel()
+		}
+		return true
+	})
+
+	closed := map[*sql.DB]bool{}
+	ds.dbConnections.Range(func(key, value interface{}) bool {
+		dbConn := value.(dbConnection)
+		if !match(getDatasourceUID(dbConn.settings)) {
+			return true
+		}
+		if strings.HasSuffix(key.(string), "-"+defaultKeySuffix) {
+			ds.storeDBConnection(key.(string), dbConnection{nil, dbConn.settings})
+		} else {
+			ds.dbConnections.Delete(key)
+		}
+		if dbConn.db != nil && !closed[dbConn.db] {
+			closed[dbConn.db] = true
+			if err := dbConn.db.Close(); err != nil {
+				backend.Logger.Error(err.Error())
+			}
+		}
+		return true
+	})
+
+	deleteMatching(&ds.healthChecks, func(key, value interface{}) bool { return match(key.(string)) })
+	deleteMatching(&ds.querySlots, func(key, value interface{}) bool { return match(key.(string)) })
+	deleteMatching(&ds.completionCache, func(key, value interface{}) bool {
+		return match(value.(completionCacheEntry).datasourceUID)
+	})
+	deleteMatching(&ds.streams, func(key, value interface{}) bool {
+		return match(value.(pendingStream).datasourceUID)
+	})
+	ds.getResultCache().deleteDatasources(match)
+}
+
+// deleteMatching deletes the entries of the map matched by the function
+func deleteMatching(m *sync.Map, match func(key, value interface{}) bool) {
+	m.Range(func(key, value interface{}) bool {
+		if match(key, value) {
+			m.Delete(key)
+		}
+		return true
+	})
+}
+
+// QueryData creates the Responses list and executes each query.
+// The responses are built once all the queries are done, in the order the queries were submitted, so the result doesn't
+// depend on which query finishes first. The frames of each response keep the order of the result sets, and the frames of
+// the queries sharing a RefID are concatenated in the order of the queries.
 func (ds *sqldatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
 	var (
 		response = NewResponse(backend.NewQueryDataResponse())
+		results  = make([]backend.DataResponse, len(req.Queries))
 		wg       = sync.WaitGroup{}
 	)
 
 	wg.Add(len(req.Queries))
 
-	// Execute each query and store the results by query RefID
-	for _, q := range req.Queries {
-		go func(query backend.DataQuery) {
-			frames, err := ds.handleQuery(ctx, query, getDatasourceUID(*req.PluginContext.DataSourceInstanceSettings))
-
-			response.Set(query.RefID, backend.DataResponse{
+	// The drivers can get the user and the dashboard running the queries from the context
+	ctx = withQueryTags(ctx, getQueryTags(req))
+
+	// Execute each query and store the results by query position
+	for i, q := range req.Queries {
+		go func(i int, query backend.DataQuery) {
+			defer wg.Done()
+			var frames data.Frames
+			q, err := GetQuery(query)
+			if err != nil {
+				ds.count(MetricQueries)
+				ds.count(MetricQueryErrors)
+				frames, err = getErrorFrameFromQuery(&Query{RefID: query.RefID}), ds.mapError(err)
+			} else {
+				frames, err = ds.RunQuery(ctx, *req.PluginContext.DataSourceInstanceSettings, q)
+			}
+
+			results[i] = backend.DataResponse{
 				Frames: frames,
 				Error:  err,
-			})
-
-			wg.Done()
-		}(q)
+			}
+		}(i, q)
 	}
 
 	wg.Wait()
+	for i, query := range req.Queries {
+		response.Append(query.RefID, results[i])
+	}
 	return response.Response(), nil
+}
+
+// querySlotPool are the slots of the queries running for a datasource, as many as the limit they were created for
+type querySlotPool struct {
+	limit int
+	slots chan struct{}
+}
+
+// getQuerySlots returns the slots of the datasource, replacing them if DriverSettings.MaxConcurrentQueries changed.
+// The queries running with the previous slots free them when they're done.
+func (ds *sqldatasource) getQuerySlots(datasourceUID string, limit int) chan struct{} {
+	ds.querySlotsMu.Lock()
+	defer ds.querySlotsMu.Unlock()
+	if v, ok := ds.querySlots.Load(datasourceUID); ok && v.(querySlotPool).limit == limit {
+		return v.(querySlotPool).slots
+	}
+	slots := make(chan struct{}, limit)
+	ds.querySlots.Store(datasourceUID, querySlotPool{limit, slots})
+	return slots
+}
+
+// acquireQuerySlot waits until less than DriverSettings.MaxConcurrentQueries queries are running for the datasource.
+// The returned function must be called to free the slot once the query is done.
+func (ds *sqldatasource) acquireQuerySlot(ctx context.Context, datasourceUID string) (func(), error) {
+	limit := ds.driverSettings.MaxConcurrentQueries
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	slots := ds.getQuerySlots(datasourceUID, limit)
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func (ds *sqldatasource) getDBConnectionFromQuery(q *Query, datasourceUID string) (string, dbConnection, error) {
@@ -139,50 +471,181 @@ func (ds *sqldatasource) getDBConnectionFromQuery(q *Query, datasourceUID string
 	}
 	// The database connection may vary depending on query arguments
 	// The raw arguments are used as key to store the db connection in memory so they can be reused
-	key := defaultKey(datasourceUID)
-	dbConn, ok := ds.getDBConnection(key)
-	if !ok {
-		return "", dbConnection{}, MissingDBConnection
+	key, dbConn, err := ds.getDefaultDBConnection(datasourceUID)
+	if err != nil {
+		return "", dbConnection{}, err
 	}
-	if !ds.EnableMultipleConnections || len(q.ConnectionArgs) == 0 {
+	if keyer, ok := ds.c.(ConnectionKeyer); ok {
+		// The driver chooses the connection of each query
+		connKey := keyer.ConnectionKey(dbConn.settings, q)
+		if connKey == "" {
+			return key, dbConn, nil
+		}
+		key = fmt.Sprintf("%s-%s", datasourceUID, connKey)
+	} else if !ds.EnableMultipleConnections || len(q.ConnectionArgs) == 0 {
 		return key, dbConn, nil
+	} else {
+		key = keyWithConnectionArgs(datasourceUID, q.ConnectionArgs)
 	}
-
-	key = keyWithConnectionArgs(datasourceUID, q.ConnectionArgs)
 	if cachedConn, ok := ds.getDBConnection(key); ok {
 		return key, cachedConn, nil
 	}
 
-	var err error
-	db, err := ds.c.Connect(dbConn.settings, q.ConnectionArgs)
+	// Assign this connection in the cache
+	dbConn, err = ds.reconnect(key, dbConnection{nil, dbConn.settings}, q.ConnectionArgs)
 	if err != nil {
 		return "", dbConnection{}, err
 	}
-	// Assign this connection in the cache
-	dbConn = dbConnection{db, dbConn.settings}
-	ds.storeDBConnection(key, dbConn)
-
 	return key, dbConn, nil
 }
 
-// handleQuery will call query, and attempt to reconnect if the query failed
-func (ds *sqldatasource) handleQuery(ctx context.Context, req backend.DataQuery, datasourceUID string) (data.Frames, error) {
-	// Convert the backend.DataQuery into a Query object
-	q, err := GetQuery(req)
+// getCapabilities returns the features supported by the driver, asking it only once
+func (ds *sqldatasource) getCapabilities() Capabilities {
+	ds.capsOnce.Do(func() {
+		ds.capabilities = defaultCapabilities
+		if p, ok := ds.c.(CapabilitiesProvider); ok {
+			ds.capabilities = p.Capabilities()
+		}
+	})
+	return ds.capabilities
+}
+
+// querySettings returns the driver settings for the query, disabling the features not supported by the driver
+func (ds *sqldatasource) querySettings(q *Query) DriverSettings {
+	settings := ds.driverSettings
+	// Apply the default FillMode, overwritting it if the query specifies it
+	if q.FillMissing != nil {
+		settings.FillMode = q.FillMissing
+	}
+
+	caps := ds.getCapabilities()
+	settings.AllowMultipleStatements = settings.AllowMultipleStatements && caps.MultipleStatements
+	settings.MultipleResultSets = settings.MultipleResultSets && caps.MultipleResultSets
+	settings.StreamRows = settings.StreamRows && caps.Streaming
+	// The timeout computed by the driver is the one set in the database
+	settings.Timeout = ds.queryTimeout(q)
+	return settings
+}
+
+// columnConverters returns the converters defined by the driver for specific columns
+func (ds *sqldatasource) columnConverters() map[string]sqlutil.Converter {
+	if p, ok := ds.c.(ColumnConverterProvider); ok {
+		return p.ColumnConverters()
+	}
+	return nil
+}
+
+// queryTimeout returns the timeout for the query. Drivers may compute the timeout for each query.
+func (ds *sqldatasource) queryTimeout(q *Query) time.Duration {
+	if t, ok := ds.c.(QueryTimeouter); ok {
+		if timeout := t.QueryTimeout(q); timeout != 0 {
+			return timeout
+		}
+	}
+	return ds.driverSettings.Timeout
+}
+
+// RunQuery interpolates and executes a single query of the datasource, returning its frames.
+// It behaves like QueryData for one query, so it can be used to run queries that are not part of a request.
+// The query is not modified, the macros are applied to a copy of it. It waits for a slot if the datasource is already
+// running DriverSettings.MaxConcurrentQueries queries.
+func (ds *sqldatasource) RunQuery(ctx context.Context, settings backend.DataSourceInstanceSettings, q *Query) (data.Frames, error) {
+	datasourceUID := getDatasourceUID(settings)
+	release, err := ds.acquireQuerySlot(ctx, datasourceUID)
 	if err != nil {
 		return getErrorFrameFromQuery(q), err
 	}
+	defer release()
+
+	query := *q
+	frames, err := ds.executeQuery(ctx, &query, datasourceUID)
+	if mutator, ok := ds.c.(ResponseMutator); ok && err == nil {
+		frames, err = mutator.MutateResponse(ctx, frames)
+	}
+	ds.count(MetricQueries)
+	if err != nil {
+		ds.count(MetricQueryErrors)
+		err = ds.mapError(err)
+	}
+	return frames, err
+}
+
+// mapError lets the driver replace the error of a query
+func (ds *sqldatasource) mapError(err error) error {
+	if mapper, ok := ds.c.(ErrorMapper); ok {
+		if mapped := mapper.MapError(err); mapped != nil {
+			return mapped
+		}
+	}
+	return err
+}
+
+// prepareQuery returns the SQL sent to the database for the query: the query is mutated by the driver, interpolated,
+// paginated, checked if the datasource is read only, commented and bound. On error, it returns the query as it was
+// prepared so far.
+func (ds *sqldatasource) prepareQuery(ctx context.Context, q *Query) (*Query, error) {
+	q, err := ds.rewriteQuery(ctx, q)
+	// The arguments are bound before anything else reads the SQL, so that the markers of $__arg don't leak
+	return bindQuery(ds.querySettings(q), q), err
+}
+
+// rewriteQuery applies the steps of prepareQuery but the binding of the arguments
+func (ds *sqldatasource) rewriteQuery(ctx context.Context, q *Query) (*Query, error) {
+	var err error
+	// Let the driver rewrite the query
+	if mutator, ok := ds.c.(QueryMutator); ok {
+		mutated, err := mutator.MutateQuery(ctx, q)
+		if err != nil {
+			return q, fmt.Errorf("%s: %w", "Could not mutate query", err)
+		}
+		q = mutated
+	}
 
 	// Apply supported macros to the query
-	q.RawSQL, err = Interpolate(ds.c, q)
+	q.RawSQL, err = ds.interpolate(ctx, q)
+	if err != nil {
+		return q, fmt.Errorf("%s: %w", "Could not apply macros", err)
+	}
+	q.RawSQL, err = paginate(ds.driverSettings, q)
+	if err != nil {
+		return q, err
+	}
+	if ds.driverSettings.ReadOnly {
+		if err := checkReadOnly(q.RawSQL); err != nil {
+			return q, err
+		}
+	}
+	if ds.driverSettings.AnnotateQueries {
+		if comment := QueryTagsFromContext(ctx).comment(); comment != "" {
+			q.RawSQL = comment + " " + q.RawSQL
+		}
+	}
+	if ds.driverSettings.CommentQueries {
+		if comment := QueryTagsFromContext(ctx).statementComment(q.RefID); comment != "" {
+			q.RawSQL = comment + " " + q.RawSQL
+		}
+	}
+	return q, nil
+}
+
+// executeQuery will call query, and attempt to reconnect if the query failed.
+// The returned frames include the interpolated SQL in their metadata, even if the query failed.
+func (ds *sqldatasource) executeQuery(ctx context.Context, q *Query, datasourceUID string) (data.Frames, error) {
+	q, err := ds.prepareQuery(ctx, q)
 	if err != nil {
-		return getErrorFrameFromQuery(q), fmt.Errorf("%s: %w", "Could not apply macros", err)
+		return getErrorFrameFromQuery(q), err
 	}
 
-	// Apply the default FillMode, overwritting it if the query specifies it
-	fillMode := ds.driverSettings.FillMode
-	if q.FillMissing != nil {
-		fillMode = q.FillMissing
+	settings := ds.querySettings(q)
+
+	// Identical queries for the same time range may be answered from the cache
+	resultKey := ds.cachedResultKey(datasourceUID, q, settings)
+	if resultKey != "" {
+		if frames, ok := ds.getResultCache().get(resultKey); ok {
+			ds.count(MetricCacheHits)
+			return frames, nil
+		}
+		ds.count(MetricCacheMisses)
 	}
 
 	// Retrieve the database connection
@@ -191,57 +654,154 @@ func (ds *sqldatasource) handleQuery(ctx context.Context, req backend.DataQuery,
 		return getErrorFrameFromQuery(q), err
 	}
 
-	if ds.driverSettings.Timeout != 0 {
-		tctx, cancel := context.WithTimeout(ctx, ds.driverSettings.Timeout)
+	// The results are sent through a stream, once Grafana subscribes to it
+	if settings.StreamRows {
+		return ds.newStream(q, datasourceUID, settings)
+	}
+
+	if settings.Timeout != 0 {
+		tctx, cancel := context.WithTimeout(ctx, settings.Timeout)
 		defer cancel()
 
 		ctx = tctx
 	}
 
+	// The query can be cancelled through the /cancel resource while it's running
+	if ds.getCapabilities().Cancellation {
+		var done func()
+		ctx, done = ds.trackQuery(ctx, datasourceUID, q, dbConn.settings)
+		defer done()
+	}
+
+	// The driver can log or measure the execution of the query
+	logger, logging := ds.c.(QueryLogger)
+	if logging {
+		logger.OnQueryStart(ctx, q)
+	}
+	start := time.Now()
+	res, err := ds.runQuery(ctx, q, settings, cacheKey, dbConn)
+	if logging {
+		logger.OnQueryEnd(ctx, q, err, countRows(res), time.Since(start))
+	}
+	if err == nil && resultKey != "" {
+		if err := ds.getResultCache().set(resultKey, datasourceUID, res, settings.ResultCacheTTL); err != nil {
+			backend.Logger.Warn("Could not cache the query result", "error", err)
+		}
+	}
+	return res, err
+}
+
+// countRows returns the number of rows of the frames
+func countRows(frames data.Frames) int {
+	rows := 0
+	for _, frame := range frames {
+		rows += frame.Rows()
+	}
+	return rows
+}
+
+// runQuery runs the query in the given connection, reconnecting if the query fails
+func (ds *sqldatasource) runQuery(ctx context.Context, q *Query, settings DriverSettings, cacheKey string, dbConn dbConnection) (data.Frames, error) {
 	// FIXES:
 	//  * Some datasources (snowflake) expire connections or have an authentication token that expires if not used in 1 or 4 hours.
 	//    Because the datasource driver does not include an option for permanent connections, we retry the connection
 	//    if the query fails. NOTE: this does not include some errors like "ErrNoRows"
-	res, err := query(ctx, dbConn.db, ds.c.Converters(), fillMode, q)
+	var res data.Frames
+	err := ds.retry(ctx, settings, func() error {
+		var err error
+		res, err = query(ctx, dbConn.db, ds.c.Converters(), ds.columnConverters(), settings, q)
+		return err
+	})
 	if err == nil {
 		return res, nil
 	}
 
+	// The connection can't be used anymore, e.g. because the credentials were rotated
+	if settings.FatalOn != nil && settings.FatalOn(err) {
+		ds.evictDBConnection(cacheKey, dbConn.db)
+		return res, err
+	}
+
 	if errors.Is(err, ErrorNoResults) {
 		return res, nil
 	}
 
 	// If there's a query error that didn't exceed the
-	// context deadline retry the query
-	if errors.Is(err, ErrorQuery) && !errors.Is(err, context.DeadlineExceeded) {
-		db, err := ds.c.Connect(dbConn.settings, q.ConnectionArgs)
+	// context deadline and wasn't cancelled retry the query
+	if errors.Is(err, ErrorQuery) && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		dbConn, err := ds.reconnect(cacheKey, dbConn, q.ConnectionArgs)
 		if err != nil {
-			return nil, err
+			return getErrorFrameFromQuery(q), err
 		}
-		ds.storeDBConnection(cacheKey, dbConnection{db, dbConn.settings})
 
-		return query(ctx, db, ds.c.Converters(), fillMode, q)
+		ds.count(MetricRetries)
+		return query(ctx, dbConn.db, ds.c.Converters(), ds.columnConverters(), settings, q)
 	}
 
-	return nil, err
+	return res, err
 }
 
-// CheckHealth pings the connected SQL database
+// defaultHealthCheckTimeout limits the health checks if DriverSettings.Timeout is not set
+const defaultHealthCheckTimeout = 30 * time.Second
+
+// CheckHealth pings the connected SQL database, and runs DriverSettings.HealthCheckQuery if set.
+// Both are limited by DriverSettings.Timeout, or defaultHealthCheckTimeout if it's not set.
+// If DriverSettings.HealthCheckTTL is set, successful results are cached for that duration.
 func (ds *sqldatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	key := defaultKey(getDatasourceUID(*req.PluginContext.DataSourceInstanceSettings))
-	dbConn, ok := ds.getDBConnection(key)
-	if !ok {
-		return nil, MissingDBConnection
+	datasourceUID := getDatasourceUID(*req.PluginContext.DataSourceInstanceSettings)
+	if cached, ok := ds.healthChecks.Load(datasourceUID); ok {
+		if check := cached.(healthCheck); time.Now().Before(check.expires) {
+			return check.result, nil
+		}
 	}
-	if err := dbConn.db.Ping(); err != nil {
+
+	// The connection may have failed when warming up the datasource, and fail again
+	_, dbConn, err := ds.getDefaultDBConnection(datasourceUID)
+	if err != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: err.Error(),
 		}, nil
 	}
 
-	return &backend.CheckHealthResult{
+	timeout := ds.driverSettings.Timeout
+	if timeout == 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := dbConn.db.PingContext(ctx); err != nil {
+		// Make sure the next check reaches the database
+		ds.healthChecks.Delete(datasourceUID)
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: err.Error(),
+		}, nil
+	}
+	if ds.driverSettings.HealthCheckQuery != "" {
+		if err := checkHealthQuery(ctx, dbConn.db, ds.driverSettings.HealthCheckQuery); err != nil {
+			ds.healthChecks.Delete(datasourceUID)
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: err.Error(),
+			}, nil
+		}
+	}
+
+	result := &backend.CheckHealthResult{
 		Status:  backend.HealthStatusOk,
 		Message: "Data source is working",
-	}, nil
+	}
+	if d, ok := ds.c.(HealthDetailer); ok {
+		details, err := healthDetails(ctx, d, dbConn.db)
+		if err != nil {
+			// The database is working, the details are only informative
+			backend.Logger.Warn("Could not get the health details", "error", err)
+		}
+		result.JSONDetails = details
+	}
+	if ds.driverSettings.HealthCheckTTL != 0 {
+		ds.healthChecks.Store(datasourceUID, healthCheck{result, time.Now().Add(ds.driverSettings.HealthCheckTTL)})
+	}
+	return result, nil
 }
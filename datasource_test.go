@@ -1,12 +1,22 @@
 package sqlds
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 )
 
 type fakeDriver struct {
@@ -19,6 +29,539 @@ func (d *fakeDriver) Connect(backend.DataSourceInstanceSettings, json.RawMessage
 	return d.db, nil
 }
 
+func (d *fakeDriver) Macros() Macros {
+	return Macros{}
+}
+
+func (d *fakeDriver) Settings(backend.DataSourceInstanceSettings) DriverSettings {
+	return DriverSettings{}
+}
+
+func (d *fakeDriver) Converters() []sqlutil.Converter {
+	return nil
+}
+
+// tenantDriver adds a tenant filter to every query
+type tenantDriver struct {
+	fakeDriver
+}
+
+func (d *tenantDriver) MutateQuery(ctx context.Context, q *Query) (*Query, error) {
+	if q.Table == "" {
+		return nil, errors.New("missing table")
+	}
+	mutated := q.WithSQL(q.RawSQL + " WHERE tenant = 'x'")
+	mutated.Table = "tenant_" + q.Table
+	return mutated, nil
+}
+
+// responseDriver applies mutate to the responses
+type responseDriver struct {
+	mutate func(frames data.Frames) (data.Frames, error)
+
+	fakeDriver
+}
+
+func (d *responseDriver) MutateResponse(ctx context.Context, frames data.Frames) (data.Frames, error) {
+	return d.mutate(frames)
+}
+
+// runDataQuery runs the data query with RunQuery, as QueryData does for each query of the request
+func runDataQuery(ctx context.Context, ds *sqldatasource, req backend.DataQuery, datasourceUID string) (data.Frames, error) {
+	q, err := GetQuery(req)
+	if err != nil {
+		return nil, err
+	}
+	return ds.RunQuery(ctx, backend.DataSourceInstanceSettings{UID: datasourceUID}, q)
+}
+
+func Test_QueryData_ResponseMutator(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"name", "secret"}, rows: [][]driver.Value{{"foo", "bar"}}}, nil
+	}}
+	db := fd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+		Queries: []backend.DataQuery{
+			{RefID: "A", JSON: []byte(`{"rawSql": "select * from foo", "format": 1}`)},
+			{RefID: "B", JSON: []byte(`{"rawSql": "select * from bar", "format": 1}`)},
+		},
+	}
+
+	t.Run("it should add a notice to each frame", func(t *testing.T) {
+		d := &responseDriver{fakeDriver: fakeDriver{db: db}, mutate: func(frames data.Frames) (data.Frames, error) {
+			for _, frame := range frames {
+				frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityWarning, Text: "mutated"})
+			}
+			return frames, nil
+		}}
+		ds := &sqldatasource{c: d}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+		res, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, refID := range []string{"A", "B"} {
+			r := res.Responses[refID]
+			if r.Error != nil || len(r.Frames) != 1 {
+				t.Fatalf("unexpected response %v", r)
+			}
+			notices := r.Frames[0].Meta.Notices
+			if len(notices) != 1 || notices[0].Text != "mutated" {
+				t.Errorf("unexpected notices %v", notices)
+			}
+		}
+	})
+
+	t.Run("it should drop a column", func(t *testing.T) {
+		d := &responseDriver{fakeDriver: fakeDriver{db: db}, mutate: func(frames data.Frames) (data.Frames, error) {
+			for _, frame := range frames {
+				fields := []*data.Field{}
+				for _, f := range frame.Fields {
+					if f.Name != "secret" {
+						fields = append(fields, f)
+					}
+				}
+				frame.Fields = fields
+			}
+			return frames, nil
+		}}
+		ds := &sqldatasource{c: d}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+		res, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := res.Responses["A"].Frames[0]
+		if len(frame.Fields) != 1 || frame.Fields[0].Name != "name" {
+			t.Errorf("unexpected fields %v", frame.Fields)
+		}
+	})
+
+	t.Run("it should return the mutator errors", func(t *testing.T) {
+		d := &responseDriver{fakeDriver: fakeDriver{db: db}, mutate: func(frames data.Frames) (data.Frames, error) {
+			return nil, errors.New("mutator error")
+		}}
+		ds := &sqldatasource{c: d}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+		res, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Responses["A"].Error == nil {
+			t.Errorf("expecting error")
+		}
+	})
+}
+
+func Test_QueryData_MaxConcurrentQueries(t *testing.T) {
+	var (
+		mtx              sync.Mutex
+		running, maxSeen int
+	)
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		mtx.Lock()
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		mtx.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mtx.Lock()
+		running--
+		mtx.Unlock()
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, nil
+	}}
+	db := fd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.QueryDataRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings}}
+	for i := 0; i < 10; i++ {
+		req.Queries = append(req.Queries, backend.DataQuery{RefID: fmt.Sprintf("%d", i), JSON: []byte(`{"rawSql": "select 1", "format": 1}`)})
+	}
+
+	t.Run("it should not run more queries than the limit", func(t *testing.T) {
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{MaxConcurrentQueries: 3}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+		res, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for refID, r := range res.Responses {
+			if r.Error != nil {
+				t.Errorf("unexpected error in query %s: %v", refID, r.Error)
+			}
+		}
+		if maxSeen > 3 {
+			t.Errorf("expecting at most 3 concurrent queries, got %d", maxSeen)
+		}
+		if len(fd.Queries()) != 10 {
+			t.Errorf("expecting 10 queries, got %d", len(fd.Queries()))
+		}
+	})
+
+	t.Run("it should stop waiting if the context is canceled", func(t *testing.T) {
+		ds := &sqldatasource{driverSettings: DriverSettings{MaxConcurrentQueries: 1}}
+		release, err := ds.acquireQuerySlot(context.Background(), "uid1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := ds.acquireQuerySlot(ctx, "uid1"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+		}
+		if _, err := ds.acquireQuerySlot(ctx, "uid2"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expecting context.DeadlineExceeded for a canceled context, got %v", err)
+		}
+	})
+
+	t.Run("it should apply the new limit once the settings change", func(t *testing.T) {
+		ds := &sqldatasource{driverSettings: DriverSettings{MaxConcurrentQueries: 1}}
+		release, err := ds.acquireQuerySlot(context.Background(), "uid1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+
+		ds.driverSettings.MaxConcurrentQueries = 2
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		for i := 0; i < 2; i++ {
+			release, err := ds.acquireQuerySlot(ctx, "uid1")
+			if err != nil {
+				t.Fatalf("expecting a free slot, got %v", err)
+			}
+			defer release()
+		}
+		if _, err := ds.acquireQuerySlot(ctx, "uid1"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+		}
+	})
+
+	t.Run("it should limit the queries run with RunQuery", func(t *testing.T) {
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{MaxConcurrentQueries: 1}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+		release, err := ds.acquireQuerySlot(context.Background(), "uid1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := ds.RunQuery(ctx, *settings, &Query{RawSQL: "select 1"}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+		}
+	})
+}
+
+func Test_QueryData_ExecutedQueryString(t *testing.T) {
+	var queryErr error
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, queryErr
+	}}
+	db := fd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	timeRange := backend.TimeRange{
+		From: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2021, 7, 1, 1, 0, 0, 0, time.UTC),
+	}
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+		Queries: []backend.DataQuery{
+			{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"rawSql": "select a from foo where $__timeFilter(time)", "format": 1}`)},
+		},
+	}
+	d := &fakeDriver{db: db}
+	expected, err := Interpolate(d, &Query{RawSQL: "select a from foo where $__timeFilter(time)", TimeRange: timeRange})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc string
+		err  error
+	}{
+		{desc: "successful query"},
+		{desc: "failed query", err: errors.New("syntax error")},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			queryErr = tc.err
+			ds := &sqldatasource{c: d}
+			ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+			res, err := ds.QueryData(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := res.Responses["A"]
+			if (r.Error != nil) != (tc.err != nil) {
+				t.Fatalf("unexpected error %v", r.Error)
+			}
+			if len(r.Frames) != 1 || r.Frames[0].Meta == nil {
+				t.Fatalf("unexpected frames %v", r.Frames)
+			}
+			if r.Frames[0].Meta.ExecutedQueryString != expected {
+				t.Errorf("expecting %q, got %q", expected, r.Frames[0].Meta.ExecutedQueryString)
+			}
+		})
+	}
+}
+
+func Test_QueryData_Order(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		// The first queries take longer, so that they finish last
+		var delay int
+		fmt.Sscanf(query, "select %d", &delay)
+		time.Sleep(time.Duration(delay) * 10 * time.Millisecond)
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{query}}}, nil
+	}}
+	db := fd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+		Queries: []backend.DataQuery{
+			{RefID: "A", JSON: []byte(`{"rawSql": "select 4", "format": 1}`)},
+			{RefID: "B", JSON: []byte(`{"rawSql": "select 3", "format": 1}`)},
+			{RefID: "A", JSON: []byte(`{"rawSql": "select 2", "format": 1}`)},
+			{RefID: "A", JSON: []byte(`{"rawSql": "select 1", "format": 1}`)},
+		},
+	}
+	ds := &sqldatasource{c: &fakeDriver{db: db}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+
+	for i := 0; i < 3; i++ {
+		res, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Responses) != 2 {
+			t.Fatalf("expecting 2 responses, got %d", len(res.Responses))
+		}
+		expected := map[string][]string{"A": {"select 4", "select 2", "select 1"}, "B": {"select 3"}}
+		for refID, queries := range expected {
+			frames := res.Responses[refID].Frames
+			if len(frames) != len(queries) {
+				t.Fatalf("expecting %d frames for %s, got %d", len(queries), refID, len(frames))
+			}
+			for j, frame := range frames {
+				if frame.Meta.ExecutedQueryString != queries[j] {
+					t.Errorf("expecting frame %d of %s to be %q, got %q", j, refID, queries[j], frame.Meta.ExecutedQueryString)
+				}
+			}
+		}
+	}
+}
+
+var errTableNotFound = errors.New("ORA-00942: table or view does not exist")
+
+// errorMapperDriver translates the ORA-00942 error code into a friendly message
+type errorMapperDriver struct {
+	fakeDriver
+}
+
+func (d *errorMapperDriver) MapError(err error) error {
+	if strings.Contains(err.Error(), "ORA-00942") {
+		return fmt.Errorf("the table does not exist: %w", err)
+	}
+	return nil
+}
+
+func Test_QueryData_ErrorMapper(t *testing.T) {
+	var queryErr error
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{}, queryErr
+	}}
+	db := fd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+		Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(`{"rawSql": "select * from foo", "format": 1}`)}},
+	}
+	ds := &sqldatasource{c: &errorMapperDriver{fakeDriver{db: db}}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+
+	t.Run("it should map the error", func(t *testing.T) {
+		queryErr = errTableNotFound
+		res, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := res.Responses["A"]
+		if r.Error == nil || !strings.HasPrefix(r.Error.Error(), "the table does not exist") {
+			t.Errorf("unexpected error %v", r.Error)
+		}
+		if len(r.Frames) != 1 || r.Frames[0].Meta.ExecutedQueryString != "select * from foo" {
+			t.Errorf("expecting the error frame, got %v", r.Frames)
+		}
+	})
+
+	t.Run("it should keep the errors that are not mapped", func(t *testing.T) {
+		queryErr = errors.New("other error")
+		res, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := res.Responses["A"]; r.Error == nil || !strings.Contains(r.Error.Error(), "other error") {
+			t.Errorf("unexpected error %v", r.Error)
+		}
+	})
+}
+
+func Test_RunQuery(t *testing.T) {
+	var queryErr error
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"foo"}, {"bar"}}}, queryErr
+	}}
+	db := fd.DB()
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	ds := &sqldatasource{c: &errorMapperDriver{fakeDriver{db: db}}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+
+	t.Run("it should interpolate and run the query", func(t *testing.T) {
+		queryErr = nil
+		q := &Query{RefID: "A", RawSQL: "select a from $__table", Table: "t", Format: FormatOptionTable}
+		frames, err := ds.RunQuery(context.Background(), settings, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != 1 || frames[0].Rows() != 2 {
+			t.Fatalf("expecting one frame with 2 rows, got %v", frames)
+		}
+		if frames[0].Name != "A" || frames[0].Meta.ExecutedQueryString != "select a from t" {
+			t.Errorf("unexpected frame %q %q", frames[0].Name, frames[0].Meta.ExecutedQueryString)
+		}
+		if q.RawSQL != "select a from $__table" {
+			t.Errorf("the query should not be modified, got %q", q.RawSQL)
+		}
+	})
+
+	t.Run("it should map the errors", func(t *testing.T) {
+		queryErr = errTableNotFound
+		frames, err := ds.RunQuery(context.Background(), settings, &Query{RefID: "A", RawSQL: "select a from missing", Format: FormatOptionTable})
+		if err == nil || !strings.HasPrefix(err.Error(), "the table does not exist") {
+			t.Errorf("unexpected error %v", err)
+		}
+		if len(frames) != 1 || frames[0].Meta.ExecutedQueryString != "select a from missing" {
+			t.Errorf("expecting the error frame, got %v", frames)
+		}
+	})
+}
+
+// timeoutDriver uses a fixed timeout for the queries
+type timeoutDriver struct {
+	timeout time.Duration
+
+	fakeDriver
+}
+
+func (d *timeoutDriver) QueryTimeout(q *Query) time.Duration {
+	return d.timeout
+}
+
+func Test_RunQuery_QueryTimeout(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		select {
+		case <-ctx.Done():
+			return fakeResult{}, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return fakeResult{}, nil
+		}
+	}}
+	db := fd.DB()
+	ds := &sqldatasource{c: &timeoutDriver{timeout: time.Millisecond, fakeDriver: fakeDriver{db: db}}, driverSettings: DriverSettings{Timeout: time.Minute}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select sleep(5)"}`)}, "uid1")
+	if !errors.Is(err, ErrorTimeout) {
+		t.Fatalf("expecting error %v, got %v", ErrorTimeout, err)
+	}
+	if len(frames) != 1 || frames[0].Meta.ExecutedQueryString != "select sleep(5)" {
+		t.Errorf("expecting an error frame, got %v", frames)
+	}
+	if len(fd.Queries()) != 1 {
+		t.Errorf("expecting the query to not be retried, got %v", fd.Queries())
+	}
+}
+
+func Test_RunQuery_StatementTimeoutSQL(t *testing.T) {
+	fd := &fakeSQLDriver{}
+	db := fd.DB()
+	ds := &sqldatasource{c: &timeoutDriver{timeout: 2 * time.Second, fakeDriver: fakeDriver{db: db}}, driverSettings: DriverSettings{Timeout: time.Minute, StatementTimeoutSQL: "SET statement_timeout = %d", StatementTimeoutResetSQL: "RESET statement_timeout"}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	if _, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select 1"}`)}, "uid1"); err != nil && !errors.Is(err, ErrorNoResults) {
+		t.Fatal(err)
+	}
+	expected := []string{"SET statement_timeout = 2000", "select 1", "RESET statement_timeout"}
+	if queries := fd.Queries(); !reflect.DeepEqual(queries, expected) {
+		t.Errorf("expecting the timeout of the driver to be set and reset, got %v", queries)
+	}
+}
+
+func Test_RunQuery_QueryMutator(t *testing.T) {
+	fd := &fakeSQLDriver{}
+	db := fd.DB()
+	ds := &sqldatasource{c: &tenantDriver{fakeDriver{db: db}}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	t.Run("it should apply the macros to the mutated query", func(t *testing.T) {
+		_, err := runDataQuery(context.Background(), ds, backend.DataQuery{JSON: []byte(`{"rawSql": "select * from $__table", "table": "foo", "format": 1}`)}, "uid1")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		queries := fd.Queries()
+		expected := "select * from tenant_foo WHERE tenant = 'x'"
+		if len(queries) != 1 || queries[0] != expected {
+			t.Errorf("expecting query %q, got %v", expected, queries)
+		}
+	})
+
+	t.Run("it should return the mutator errors", func(t *testing.T) {
+		_, err := runDataQuery(context.Background(), ds, backend.DataQuery{JSON: []byte(`{"rawSql": "select 1"}`)}, "uid1")
+		if err == nil {
+			t.Errorf("expecting error")
+		}
+	})
+}
+
+func Test_RunQuery_SkipInterpolation(t *testing.T) {
+	fd := &fakeSQLDriver{}
+	db := fd.DB()
+	ds := &sqldatasource{c: &fakeDriver{db: db}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	t.Run("it should send the query without applying the macros", func(t *testing.T) {
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{JSON: []byte(`{"rawSql": "select $__id from t where $__timeFilter(t)", "skipInterpolation": true, "format": 1}`)}, "uid1")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expected := "select $__id from t where $__timeFilter(t)"
+		if queries := fd.Queries(); len(queries) != 1 || queries[0] != expected {
+			t.Errorf("expecting query %q, got %v", expected, queries)
+		}
+		if frames[0].Meta.ExecutedQueryString != expected {
+			t.Errorf("expecting executed query %q, got %q", expected, frames[0].Meta.ExecutedQueryString)
+		}
+	})
+
+	t.Run("it should apply the macros otherwise", func(t *testing.T) {
+		_, err := runDataQuery(context.Background(), ds, backend.DataQuery{JSON: []byte(`{"rawSql": "select a from t where $__timeFilter(t)", "format": 1}`)}, "uid1")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		queries := fd.Queries()
+		expected := "select a from t where t >= '0001-01-01T00:00:00Z' AND t <= '0001-01-01T00:00:00Z'"
+		if queries[len(queries)-1] != expected {
+			t.Errorf("expecting query %q, got %v", expected, queries)
+		}
+	})
+}
+
 func Test_getDBConnectionFromQuery(t *testing.T) {
 	db := &sql.DB{}
 	db2 := &sql.DB{}
@@ -97,19 +640,852 @@ func Test_getDBConnectionFromQuery(t *testing.T) {
 	})
 }
 
-func Test_Dispose(t *testing.T) {
-	t.Run("it should not delete connections", func(t *testing.T) {
+// shardDriver connects to a different database for each table
+type shardDriver struct {
+	mu       sync.Mutex
+	connects int
+
+	fakeDriver
+}
+
+func (d *shardDriver) Connect(settings backend.DataSourceInstanceSettings, args json.RawMessage) (*sql.DB, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connects++
+	return (&fakeSQLDriver{}).DB(), nil
+}
+
+func (d *shardDriver) ConnectionKey(settings backend.DataSourceInstanceSettings, q *Query) string {
+	return q.Table
+}
+
+func Test_getDBConnectionFromQuery_ConnectionKeyer(t *testing.T) {
+	d := &shardDriver{}
+	db := &sql.DB{}
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	ds := &sqldatasource{c: d}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+
+	key, conn, err := ds.getDBConnectionFromQuery(&Query{}, "uid1")
+	if err != nil || key != defaultKey("uid1") || conn.db != db {
+		t.Fatalf("expecting the default connection without a key, got %s %v", key, err)
+	}
+
+	keyA, connA, err := ds.getDBConnectionFromQuery(&Query{Table: "a"}, "uid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, connB, err := ds.getDBConnectionFromQuery(&Query{Table: "b"}, "uid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyA != "uid1-a" || keyB != "uid1-b" {
+		t.Errorf("unexpected keys %s %s", keyA, keyB)
+	}
+	if connA.db == connB.db || connA.db == db {
+		t.Errorf("expecting different connections for different keys")
+	}
+
+	_, connA2, err := ds.getDBConnectionFromQuery(&Query{Table: "a"}, "uid1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connA2.db != connA.db {
+		t.Errorf("expecting the connection to be reused for the same key")
+	}
+	if d.connects != 2 {
+		t.Errorf("expecting 2 connections, got %d", d.connects)
+	}
+}
+
+var errFatal = errors.New("password authentication failed")
+
+func Test_RunQuery_FatalOn(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{}, errFatal
+	}}
+	db := fd.DB()
+	d := &shardDriver{}
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	ds := &sqldatasource{c: d, driverSettings: DriverSettings{FatalOn: func(err error) bool {
+		return errors.Is(err, errFatal)
+	}}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+	req := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select 1", "format": 1}`)}
+
+	if _, err := runDataQuery(context.Background(), ds, req, "uid1"); !errors.Is(err, errFatal) {
+		t.Fatalf("expecting error %v, got %v", errFatal, err)
+	}
+	if d.connects != 0 {
+		t.Errorf("expecting the connection to be evicted without reconnecting, got %d connections", d.connects)
+	}
+	if err := db.Ping(); err == nil {
+		t.Errorf("expecting the evicted connection to be closed")
+	}
+
+	if _, err := runDataQuery(context.Background(), ds, req, "uid1"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d.connects != 1 {
+		t.Errorf("expecting 1 new connection, got %d", d.connects)
+	}
+	if len(fd.Queries()) != 1 {
+		t.Errorf("expecting the evicted connection not to be used again, got queries %v", fd.Queries())
+	}
+
+	_, conn, err := ds.getDBConnectionFromQuery(&Query{}, "uid1")
+	if err != nil || conn.db == db {
+		t.Errorf("expecting the new connection to be cached, got %v", err)
+	}
+}
+
+func Test_RunQuery_FatalOn_concurrent(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{}, errFatal
+	}}
+	db := fd.DB()
+	d := &shardDriver{}
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+	ds := &sqldatasource{c: d, driverSettings: DriverSettings{FatalOn: func(err error) bool {
+		return errors.Is(err, errFatal)
+	}}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, settings})
+	req := backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select 1", "format": 1}`)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = runDataQuery(context.Background(), ds, req, "uid1")
+		}()
+	}
+	wg.Wait()
+
+	if d.connects > 1 {
+		t.Errorf("expecting at most 1 new connection, got %d", d.connects)
+	}
+	if err := db.Ping(); err == nil {
+		t.Errorf("expecting the stale connection to be closed")
+	}
+	_, conn, err := ds.getDBConnectionFromQuery(&Query{}, "uid1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if conn.db == db {
+		t.Errorf("expecting the stale connection to be replaced")
+	}
+	if err := conn.db.Ping(); err != nil {
+		t.Errorf("expecting the new connection not to be evicted, got %v", err)
+	}
+
+	t.Run("it should not evict a connection that replaced the stale one", func(t *testing.T) {
+		ds.evictDBConnection(defaultKey("uid1"), db)
+		if err := conn.db.Ping(); err != nil {
+			t.Errorf("expecting the new connection not to be closed, got %v", err)
+		}
+	})
+}
+
+type fakePool struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	calls           int
+}
+
+func (p *fakePool) SetMaxOpenConns(n int) {
+	p.maxOpenConns = n
+	p.calls++
+}
+
+func (p *fakePool) SetMaxIdleConns(n int) {
+	p.maxIdleConns = n
+	p.calls++
+}
+
+func (p *fakePool) SetConnMaxLifetime(d time.Duration) {
+	p.connMaxLifetime = d
+	p.calls++
+}
+
+func Test_applyPoolSettings(t *testing.T) {
+	t.Run("it should configure the connection pool", func(t *testing.T) {
+		pool := &fakePool{}
+		applyPoolSettings(pool, DriverSettings{MaxOpenConns: 10, MaxIdleConns: 5, ConnMaxLifetime: time.Minute})
+		if pool.maxOpenConns != 10 || pool.maxIdleConns != 5 || pool.connMaxLifetime != time.Minute {
+			t.Errorf("unexpected pool settings %+v", pool)
+		}
+	})
+
+	t.Run("it should keep the defaults for zero values", func(t *testing.T) {
+		pool := &fakePool{}
+		applyPoolSettings(pool, DriverSettings{})
+		if pool.calls != 0 {
+			t.Errorf("unexpected calls to the pool setters: %d", pool.calls)
+		}
+	})
+
+	t.Run("it should apply the settings to new connections", func(t *testing.T) {
+		db, err := sql.Open("mysql", "user:pass@/db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{MaxOpenConns: 3}}
+		db, err = ds.connect(backend.DataSourceInstanceSettings{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.Stats().MaxOpenConnections != 3 {
+			t.Errorf("unexpected max open connections %d", db.Stats().MaxOpenConnections)
+		}
+	})
+}
+
+func Test_CheckHealth(t *testing.T) {
+	pd := &fakeSQLDriver{}
+	db := pd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.CheckHealthRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings}}
+
+	ds := &sqldatasource{driverSettings: DriverSettings{HealthCheckTTL: time.Minute}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+
+	t.Run("it should cache successful results", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			res, err := ds.CheckHealth(context.Background(), req)
+			if err != nil || res.Status != backend.HealthStatusOk {
+				t.Fatalf("unexpected result %v %v", res, err)
+			}
+		}
+		if pd.Pings() != 1 {
+			t.Errorf("expecting 1 ping, got %d", pd.Pings())
+		}
+	})
+
+	t.Run("it should not cache failures", func(t *testing.T) {
+		ds.healthChecks = sync.Map{}
+		pd.SetPingError(errors.New("unavailable"))
+		pings := pd.Pings()
+		for i := 0; i < 2; i++ {
+			res, err := ds.CheckHealth(context.Background(), req)
+			if err != nil || res.Status != backend.HealthStatusError {
+				t.Fatalf("unexpected result %v %v", res, err)
+			}
+		}
+		if pd.Pings() <= pings+1 {
+			t.Errorf("expecting the database to be pinged on every check")
+		}
+
+		pd.SetPingError(nil)
+		res, err := ds.CheckHealth(context.Background(), req)
+		if err != nil || res.Status != backend.HealthStatusOk {
+			t.Fatalf("unexpected result %v %v", res, err)
+		}
+	})
+
+	t.Run("it should not cache results without a TTL", func(t *testing.T) {
 		ds := &sqldatasource{}
-		ds.dbConnections.Store(defaultKey("uid1"), dbConnection{})
-		ds.dbConnections.Store("foo", dbConnection{})
-		ds.Dispose()
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+		pings := pd.Pings()
+		for i := 0; i < 2; i++ {
+			if _, err := ds.CheckHealth(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if pd.Pings() != pings+2 {
+			t.Errorf("expecting 2 pings, got %d", pd.Pings()-pings)
+		}
+	})
+}
+
+func Test_CheckHealth_HealthCheckQuery(t *testing.T) {
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.CheckHealthRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings}}
+
+	tests := []struct {
+		desc    string
+		query   string
+		result  fakeResult
+		err     error
+		status  backend.HealthStatus
+		queries []string
+	}{
+		{
+			desc:    "passing query",
+			query:   "SELECT 1 FROM users",
+			result:  fakeResult{columns: []string{"1"}, rows: [][]driver.Value{{int64(1)}}},
+			status:  backend.HealthStatusOk,
+			queries: []string{"SELECT 1 FROM users"},
+		},
+		{
+			desc:    "failing query",
+			query:   "SELECT 1 FROM users",
+			err:     errors.New("permission denied"),
+			status:  backend.HealthStatusError,
+			queries: []string{"SELECT 1 FROM users"},
+		},
+		{
+			desc:    "query without rows",
+			query:   "SELECT 1 FROM users",
+			result:  fakeResult{columns: []string{"1"}},
+			status:  backend.HealthStatusError,
+			queries: []string{"SELECT 1 FROM users"},
+		},
+		{
+			desc:   "ping only",
+			status: backend.HealthStatusOk,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			pd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+				return tc.result, tc.err
+			}}
+			ds := &sqldatasource{driverSettings: DriverSettings{HealthCheckQuery: tc.query}}
+			ds.storeDBConnection(defaultKey("uid1"), dbConnection{pd.DB(), *settings})
+
+			res, err := ds.CheckHealth(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != tc.status {
+				t.Errorf("unexpected status %v: %s", res.Status, res.Message)
+			}
+			if tc.err != nil && !strings.Contains(res.Message, tc.err.Error()) {
+				t.Errorf("expecting the message to contain the SQL error, got %q", res.Message)
+			}
+			if pd.Pings() != 1 {
+				t.Errorf("expecting 1 ping, got %d", pd.Pings())
+			}
+			if strings.Join(pd.Queries(), ";") != strings.Join(tc.queries, ";") {
+				t.Errorf("unexpected queries %v", pd.Queries())
+			}
+		})
+	}
+}
+
+func Test_CheckHealth_Timeout(t *testing.T) {
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.CheckHealthRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings}}
+	pd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		<-ctx.Done()
+		return fakeResult{}, ctx.Err()
+	}}
+	ds := &sqldatasource{driverSettings: DriverSettings{HealthCheckQuery: "SELECT 1", Timeout: 10 * time.Millisecond}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{pd.DB(), *settings})
+
+	res, err := ds.CheckHealth(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != backend.HealthStatusError {
+		t.Errorf("expecting the health query to time out, got %v: %s", res.Status, res.Message)
+	}
+}
+
+var errTransient = errors.New("transient")
+
+// flakyDriver fails to connect the first failures times
+type flakyDriver struct {
+	failures int
+	attempts int
+
+	fakeDriver
+}
+
+func (d *flakyDriver) Connect(settings backend.DataSourceInstanceSettings, args json.RawMessage) (*sql.DB, error) {
+	d.attempts++
+	if d.attempts <= d.failures {
+		return nil, errTransient
+	}
+	return d.fakeDriver.Connect(settings, args)
+}
+
+func Test_retry(t *testing.T) {
+	isTransient := func(err error) bool {
+		return errors.Is(err, errTransient)
+	}
+
+	t.Run("it should retry transient connection errors", func(t *testing.T) {
+		db := &sql.DB{}
+		d := &flakyDriver{failures: 2, fakeDriver: fakeDriver{db: db}}
+		ds := &sqldatasource{c: d, driverSettings: DriverSettings{RetryOn: isTransient, RetryAttempts: 3, RetryBackoff: time.Millisecond}}
+		res, err := ds.connect(backend.DataSourceInstanceSettings{}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if res != db {
+			t.Errorf("unexpected result %v", res)
+		}
+		if d.attempts != 3 {
+			t.Errorf("expecting 3 attempts, got %d", d.attempts)
+		}
+	})
+
+	t.Run("it should give up after the max attempts", func(t *testing.T) {
+		d := &flakyDriver{failures: 5}
+		ds := &sqldatasource{c: d, driverSettings: DriverSettings{RetryOn: isTransient, RetryAttempts: 3, RetryBackoff: time.Millisecond}}
+		if _, err := ds.connect(backend.DataSourceInstanceSettings{}, nil); !errors.Is(err, errTransient) {
+			t.Errorf("expecting error %v, got %v", errTransient, err)
+		}
+		if d.attempts != 3 {
+			t.Errorf("expecting 3 attempts, got %d", d.attempts)
+		}
+	})
+
+	t.Run("it should not retry other errors", func(t *testing.T) {
+		attempts := 0
+		err := retry(context.Background(), DriverSettings{RetryOn: isTransient, RetryAttempts: 3}, func() error {
+			attempts++
+			return errors.New("permanent")
+		})
+		if err == nil || attempts != 1 {
+			t.Errorf("expecting a single attempt, got %d", attempts)
+		}
+	})
+
+	t.Run("it should not retry without a matcher", func(t *testing.T) {
+		attempts := 0
+		_ = retry(context.Background(), DriverSettings{RetryAttempts: 3}, func() error {
+			attempts++
+			return errTransient
+		})
+		if attempts != 1 {
+			t.Errorf("expecting a single attempt, got %d", attempts)
+		}
+	})
+}
+
+func Test_Dispose(t *testing.T) {
+	isClosed := func(db *sql.DB) bool {
+		return db.Ping() != nil && strings.Contains(db.Ping().Error(), "database is closed")
+	}
+	openConnections := func(ds *sqldatasource) int {
 		count := 0
 		ds.dbConnections.Range(func(key, value interface{}) bool {
-			count++
+			if value.(dbConnection).db != nil {
+				count++
+			}
 			return true
 		})
-		if count != 2 {
-			t.Errorf("missing connections")
+		return count
+	}
+	settings1 := backend.DataSourceInstanceSettings{UID: "uid1"}
+	settings2 := backend.DataSourceInstanceSettings{UID: "uid2"}
+
+	t.Run("it should close all the connections and cancel the running queries", func(t *testing.T) {
+		db1, db2, db3 := (&fakeSQLDriver{}).DB(), (&fakeSQLDriver{}).DB(), (&fakeSQLDriver{}).DB()
+		ds := &sqldatasource{}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db1, settings1})
+		ds.storeDBConnection(keyWithConnectionArgs("uid1", []byte(`{"db":"a"}`)), dbConnection{db2, settings1})
+		ds.storeDBConnection(defaultKey("uid2"), dbConnection{db3, settings2})
+		ds.storeDBConnection(defaultKey("uid3"), dbConnection{nil, backend.DataSourceInstanceSettings{UID: "uid3"}})
+		ctx, done := ds.trackQuery(context.Background(), "uid2", &Query{RefID: "A"}, settings2)
+		defer done()
+
+		ds.Dispose()
+		if count := openConnections(ds); count != 0 {
+			t.Errorf("expecting no open connections, got %d", count)
+		}
+		for _, uid := range []string{"uid1", "uid2", "uid3"} {
+			if _, ok := ds.getDBConnection(defaultKey(uid)); !ok {
+				t.Errorf("expecting the settings of the default connection of %s to be kept", uid)
+			}
+		}
+		if _, ok := ds.getDBConnection(keyWithConnectionArgs("uid1", []byte(`{"db":"a"}`))); ok {
+			t.Errorf("expecting the connection with arguments to be removed")
+		}
+		for i, db := range []*sql.DB{db1, db2, db3} {
+			if !isClosed(db) {
+				t.Errorf("expecting connection %d to be closed", i+1)
+			}
+		}
+		if ctx.Err() != context.Canceled {
+			t.Errorf("expecting the query to be cancelled, got %v", ctx.Err())
+		}
+	})
+
+	t.Run("it should only close the connections of the datasource created again", func(t *testing.T) {
+		fd1, fd2, fd3 := &fakeSQLDriver{}, &fakeSQLDriver{}, &fakeSQLDriver{}
+		db1, db2, db3 := fd1.DB(), fd2.DB(), fd3.DB()
+		d := &warmupDriver{fakeDriver: fakeDriver{db: db1}}
+		ds := NewDatasource(d)
+		inst, err := ds.NewDatasource(settings1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst != ds {
+			t.Errorf("expecting the instance to be the datasource")
+		}
+		ds.storeDBConnection(defaultKey("uid2"), dbConnection{db2, settings2})
+		ctx1, done1 := ds.trackQuery(context.Background(), "uid1", &Query{RefID: "A"}, settings1)
+		defer done1()
+		ctx2, done2 := ds.trackQuery(context.Background(), "uid2", &Query{RefID: "A"}, settings2)
+		defer done2()
+
+		d.db = db3
+		if _, err := ds.NewDatasource(settings1); err != nil {
+			t.Fatal(err)
+		}
+		if conn, ok := ds.getDBConnection(defaultKey("uid1")); !ok || conn.db != db3 || !isClosed(db1) {
+			t.Errorf("expecting the connection of uid1 to be closed and replaced")
+		}
+		if _, ok := ds.getDBConnection(defaultKey("uid2")); !ok || isClosed(db2) {
+			t.Errorf("expecting the connection of uid2 to be kept")
+		}
+		if ctx1.Err() != context.Canceled || ctx2.Err() != nil {
+			t.Errorf("expecting only the query of uid1 to be cancelled, got %v and %v", ctx1.Err(), ctx2.Err())
+		}
+	})
+
+	t.Run("it should probe the database again after the settings are saved", func(t *testing.T) {
+		fd := &fakeSQLDriver{}
+		d := &warmupDriver{fakeDriver: fakeDriver{db: fd.DB()}, settings: DriverSettings{HealthCheckTTL: time.Minute, ResultCacheTTL: time.Minute, CompletionCacheTTL: time.Minute, MaxConcurrentQueries: 1}}
+		ds := NewDatasource(d)
+		if _, err := ds.NewDatasource(settings1); err != nil {
+			t.Fatal(err)
+		}
+		req := &backend.CheckHealthRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: &settings1}}
+		if res, err := ds.CheckHealth(context.Background(), req); err != nil || res.Status != backend.HealthStatusOk {
+			t.Fatalf("unexpected result %v %v", res, err)
+		}
+		// The rest of the state of both datasources
+		for _, uid := range []string{"uid1", "uid2"} {
+			ds.completionCache.Store(uid+"-tables", completionCacheEntry{uid, []string{"t"}, time.Now().Add(time.Minute)})
+			ds.streams.Store(uid+"-stream", pendingStream{datasourceUID: uid})
+			ds.querySlots.Store(uid, querySlotPool{1, make(chan struct{}, 1)})
+			if err := ds.getResultCache().set(uid+"-result", uid, data.Frames{data.NewFrame("A")}, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The new settings point to a database that is down
+		fd2 := &fakeSQLDriver{}
+		fd2.SetPingError(errors.New("connection refused"))
+		d.db = fd2.DB()
+		if _, err := ds.NewDatasource(backend.DataSourceInstanceSettings{UID: "uid1", JSONData: []byte(`{"host":"new"}`)}); err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := ds.CheckHealth(context.Background(), req)
+		if err != nil || res.Status != backend.HealthStatusError {
+			t.Errorf("expecting the new database to be probed, got %v %v", res, err)
+		}
+		if _, ok := ds.completionCache.Load("uid1-tables"); ok {
+			t.Errorf("expecting the completions of uid1 to be dropped")
+		}
+		if _, ok := ds.streams.Load("uid1-stream"); ok {
+			t.Errorf("expecting the streams of uid1 to be dropped")
+		}
+		if _, ok := ds.querySlots.Load("uid1"); ok {
+			t.Errorf("expecting the query slots of uid1 to be dropped")
+		}
+		if _, ok := ds.getResultCache().get("uid1-result"); ok {
+			t.Errorf("expecting the results of uid1 to be dropped")
+		}
+		_, completion := ds.completionCache.Load("uid2-tables")
+		_, stream := ds.streams.Load("uid2-stream")
+		_, slots := ds.querySlots.Load("uid2")
+		_, result := ds.getResultCache().get("uid2-result")
+		if !completion || !stream || !slots || !result {
+			t.Errorf("expecting the state of uid2 to be kept")
+		}
+	})
+}
+
+// capabilitiesDriver declares the features it supports
+type capabilitiesDriver struct {
+	fakeDriver
+	caps  Capabilities
+	calls int
+}
+
+func (d *capabilitiesDriver) Capabilities() Capabilities {
+	d.calls++
+	return d.caps
+}
+
+func Test_QueryData_Capabilities(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, nil
+	}}
+	db := fd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+		Queries: []backend.DataQuery{
+			{RefID: "A", JSON: []byte(`{"rawSql": "set x = 1; select a from t", "format": 1}`)},
+		},
+	}
+	d := &capabilitiesDriver{fakeDriver: fakeDriver{db: db}}
+	ds := &sqldatasource{c: d, driverSettings: DriverSettings{AllowMultipleStatements: true, StreamRows: true}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+
+	for i := 0; i < 2; i++ {
+		res, err := ds.QueryData(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := res.Responses["A"]
+		if r.Error != nil || len(r.Frames) != 1 {
+			t.Fatalf("unexpected response %v", r)
+		}
+		if r.Frames[0].Meta.Channel != "" {
+			t.Errorf("expecting the rows to not be streamed, got channel %s", r.Frames[0].Meta.Channel)
+		}
+	}
+	if queries := fd.Queries(); len(queries) != 2 || queries[0] != "set x = 1; select a from t" {
+		t.Errorf("expecting the statements to not be split, got %v", queries)
+	}
+	if d.calls != 1 {
+		t.Errorf("expecting the capabilities to be read once, got %d calls", d.calls)
+	}
+	if res := callCancel(t, ds, "uid1", `{"refId": "A"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("expecting cancellation to not be implemented, got code %v", res.Code)
+	}
+}
+
+func Test_RunQuery_ReadOnly(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, nil
+	}}
+	db := fd.DB()
+	ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{ReadOnly: true}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	t.Run("it should run the select queries", func(t *testing.T) {
+		_, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "/* comment */ select a from t", "format": 1}`)}, "uid1")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("it should reject the queries modifying the database", func(t *testing.T) {
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "delete from $__table", "table": "t"}`)}, "uid1")
+		if !errors.Is(err, ErrorReadOnly) {
+			t.Fatalf("expecting error %v, got %v", ErrorReadOnly, err)
+		}
+		if len(frames) != 1 || frames[0].Meta.ExecutedQueryString != "delete from t" {
+			t.Errorf("expecting an error frame, got %v", frames)
+		}
+	})
+
+	if queries := fd.Queries(); len(queries) != 1 {
+		t.Errorf("expecting only the select query to run, got %v", queries)
+	}
+}
+
+// loggerDriver records the query lifecycle events
+type loggerDriver struct {
+	fakeDriver
+
+	mu     sync.Mutex
+	events []string
+	ends   []queryEnd
+}
+
+type queryEnd struct {
+	err      error
+	rows     int
+	duration time.Duration
+}
+
+func (d *loggerDriver) OnQueryStart(ctx context.Context, q *Query) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, "start: "+q.RawSQL)
+}
+
+func (d *loggerDriver) OnQueryEnd(ctx context.Context, q *Query, err error, rows int, duration time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, "end: "+q.RawSQL)
+	d.ends = append(d.ends, queryEnd{err, rows, duration})
+}
+
+func Test_RunQuery_QueryLogger(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		time.Sleep(20 * time.Millisecond)
+		if strings.Contains(query, "missing") {
+			return fakeResult{}, errors.New("no such table")
+		}
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}, {"b"}, {"c"}}}, nil
+	}}
+	db := fd.DB()
+
+	t.Run("it should log successful queries", func(t *testing.T) {
+		d := &loggerDriver{fakeDriver: fakeDriver{db: db}}
+		ds := &sqldatasource{c: d}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+		_, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select a from $__table", "table": "t", "format": 1}`)}, "uid1")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(d.events) != 2 || d.events[0] != "start: select a from t" || d.events[1] != "end: select a from t" {
+			t.Fatalf("unexpected events %v", d.events)
+		}
+		if end := d.ends[0]; end.err != nil || end.rows != 3 || end.duration < 20*time.Millisecond {
+			t.Errorf("unexpected end event %+v", end)
+		}
+	})
+
+	t.Run("it should log failed queries", func(t *testing.T) {
+		d := &loggerDriver{fakeDriver: fakeDriver{db: db}}
+		ds := &sqldatasource{c: d}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+		_, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select a from missing", "format": 1}`)}, "uid1")
+		if err == nil {
+			t.Fatal("expecting an error")
+		}
+		if len(d.ends) != 1 {
+			t.Fatalf("unexpected events %v", d.events)
+		}
+		if end := d.ends[0]; !errors.Is(end.err, ErrorQuery) || end.rows != 0 || end.duration < 20*time.Millisecond {
+			t.Errorf("unexpected end event %+v", end)
+		}
+	})
+}
+
+// healthDetailsDriver adds details to the health checks
+type healthDetailsDriver struct {
+	fakeDriver
+	details map[string]interface{}
+	err     error
+}
+
+func (d *healthDetailsDriver) HealthDetails(ctx context.Context, db Connection) (map[string]interface{}, error) {
+	return d.details, d.err
+}
+
+func Test_CheckHealth_HealthDetails(t *testing.T) {
+	pd := &fakeSQLDriver{}
+	db := pd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.CheckHealthRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings}}
+
+	tests := []struct {
+		desc    string
+		details map[string]interface{}
+		err     error
+		json    string
+	}{
+		{desc: "it should add the details", details: map[string]interface{}{"version": "14.2", "region": "eu", "latencyMs": 3}, json: `{"latencyMs":3,"region":"eu","version":"14.2"}`},
+		{desc: "it should succeed without details if they can't be read", err: errors.New("permission denied")},
+		{desc: "it should not add empty details", details: map[string]interface{}{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			ds := &sqldatasource{c: &healthDetailsDriver{fakeDriver{db: db}, tc.details, tc.err}}
+			ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+
+			res, err := ds.CheckHealth(context.Background(), req)
+			if err != nil || res.Status != backend.HealthStatusOk {
+				t.Fatalf("unexpected result %v %v", res, err)
+			}
+			if string(res.JSONDetails) != tc.json {
+				t.Errorf("expecting details %s, got %s", tc.json, string(res.JSONDetails))
+			}
+		})
+	}
+}
+
+// warmupDriver counts the connections
+type warmupDriver struct {
+	fakeDriver
+	settings   DriverSettings
+	connectErr error
+	connects   int
+}
+
+func (d *warmupDriver) Settings(backend.DataSourceInstanceSettings) DriverSettings {
+	return d.settings
+}
+
+func (d *warmupDriver) Connect(settings backend.DataSourceInstanceSettings, args json.RawMessage) (*sql.DB, error) {
+	d.connects++
+	if d.connectErr != nil {
+		return nil, d.connectErr
+	}
+	return d.db, nil
+}
+
+func Test_NewDatasource_WarmupOnStart(t *testing.T) {
+	settings := backend.DataSourceInstanceSettings{UID: "uid1"}
+
+	t.Run("it should connect and ping the database", func(t *testing.T) {
+		fd := &fakeSQLDriver{}
+		d := &warmupDriver{fakeDriver: fakeDriver{db: fd.DB()}, settings: DriverSettings{WarmupOnStart: true}}
+		if _, err := NewDatasource(d).NewDatasource(settings); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if d.connects != 1 || fd.Pings() != 1 {
+			t.Errorf("expecting 1 connection and 1 ping, got %d and %d", d.connects, fd.Pings())
+		}
+	})
+
+	t.Run("it should not ping the database by default", func(t *testing.T) {
+		fd := &fakeSQLDriver{}
+		d := &warmupDriver{fakeDriver: fakeDriver{db: fd.DB()}}
+		if _, err := NewDatasource(d).NewDatasource(settings); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if d.connects != 1 || fd.Pings() != 0 {
+			t.Errorf("expecting 1 connection and no pings, got %d and %d", d.connects, fd.Pings())
+		}
+	})
+
+	t.Run("it should not fail if the ping fails", func(t *testing.T) {
+		fd := &fakeSQLDriver{}
+		fd.SetPingError(errors.New("unavailable"))
+		d := &warmupDriver{fakeDriver: fakeDriver{db: fd.DB()}, settings: DriverSettings{WarmupOnStart: true}}
+		if _, err := NewDatasource(d).NewDatasource(settings); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+
+	t.Run("it should connect again on the first query if the connection failed", func(t *testing.T) {
+		fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+			return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, nil
+		}}
+		d := &warmupDriver{fakeDriver: fakeDriver{db: fd.DB()}, settings: DriverSettings{WarmupOnStart: true}, connectErr: errors.New("unavailable")}
+		ds := NewDatasource(d)
+		if _, err := ds.NewDatasource(settings); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		d.connectErr = nil
+		if _, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select 1", "format": 1}`)}, "uid1"); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if d.connects != 2 {
+			t.Errorf("expecting 2 connections, got %d", d.connects)
+		}
+	})
+
+	t.Run("it should report an unhealthy datasource if the connection fails again", func(t *testing.T) {
+		d := &warmupDriver{settings: DriverSettings{WarmupOnStart: true}, connectErr: errors.New("unavailable")}
+		ds := NewDatasource(d)
+		if _, err := ds.NewDatasource(settings); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		req := &backend.CheckHealthRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: &settings}}
+		res, err := ds.CheckHealth(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if res.Status != backend.HealthStatusError || !strings.Contains(res.Message, "unavailable") {
+			t.Errorf("expecting an unhealthy datasource, got %v: %s", res.Status, res.Message)
+		}
+	})
+
+	t.Run("it should fail if the connection fails without warmup", func(t *testing.T) {
+		d := &warmupDriver{connectErr: errors.New("unavailable")}
+		if _, err := NewDatasource(d).NewDatasource(settings); err == nil {
+			t.Error("expecting an error")
 		}
 	})
 }
@@ -14,6 +14,142 @@ import (
 type DriverSettings struct {
 	Timeout  time.Duration
 	FillMode *data.FillMissing
+	// IdentifierQuote is the quoting style used by the $__quoteIdentifier macro
+	IdentifierQuote IdentifierQuote
+	// DefaultSchema is the schema returned by the $__schema macro if the query doesn't define one
+	DefaultSchema string
+	// QuoteIdentifiers makes the $__table and $__column macros quote their result using IdentifierQuote
+	QuoteIdentifiers bool
+	// AllowMultipleStatements splits the query in statements separated by semicolons and runs all of them.
+	// Only the results of the last statement are returned.
+	AllowMultipleStatements bool
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime configure the connection pool. Zero values keep the database/sql defaults.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// WarmupOnStart pings the database when the datasource instance is created, so that the first query doesn't have to
+	// open the connection. Connection errors are then logged instead of failing the creation of the instance.
+	WarmupOnStart bool
+	// HealthCheckTTL caches successful health checks for the given duration. Failures are never cached.
+	HealthCheckTTL time.Duration
+	// HealthCheckQuery is run by CheckHealth after pinging the database, to check that data can be read.
+	// The check fails if it doesn't return any rows. Only the ping is done if empty.
+	HealthCheckQuery string
+	// RetryOn reports whether an error returned when connecting or querying is transient, so the operation can be retried.
+	// Retries are disabled if nil.
+	RetryOn func(error) bool
+	// FatalOn reports whether an error returned by a query means that the connection can't be used anymore
+	// (e.g. because the credentials were rotated). The connection is then closed, and a new one is created for the next query.
+	FatalOn func(error) bool
+	// RetryAttempts is the maximum number of attempts, including the first one
+	RetryAttempts int
+	// RetryBackoff is the time to wait before the first retry (100ms if not set). It is doubled after each attempt.
+	RetryBackoff time.Duration
+	// CompletionCacheTTL caches the results of the Completable interface (schemas, tables and columns) for the given duration
+	CompletionCacheTTL time.Duration
+	// ResultCacheTTL caches the frames of successful queries for the given duration, by datasource, interpolated SQL and time range.
+	// Up to ResultCacheMaxEntries results are kept (100 by default), evicting the least recently used ones.
+	ResultCacheTTL        time.Duration
+	ResultCacheMaxEntries int
+	// ResultCacheFreshness skips the cache for the queries whose time range ends less than the given duration ago,
+	// since their results may still change (e.g. the ones ending "now")
+	ResultCacheFreshness time.Duration
+	// TypeRewrite replaces the database type name of a column before choosing its converter, e.g. to convert the BIT
+	// columns reported by some drivers with the BOOLEAN converter. It receives the column name and its type name.
+	TypeRewrite func(colName, dbType string) string
+	// CoerceNumericToFloat converts the integer and decimal columns without a converter to nullable float64 fields, so that
+	// the schema of the frames doesn't change depending on the values (e.g. when an integer column becomes a DECIMAL).
+	CoerceNumericToFloat bool
+	// DecimalSeparator is the decimal separator of the numbers returned as strings (e.g. "," for "1,5"), used when they
+	// are parsed by CoerceNumericToFloat and UseNullableFields. It's a dot if empty.
+	DecimalSeparator string
+	// NonFiniteAsNull makes CoerceNumericToFloat return null for the NaN and Inf values, instead of math.NaN() and math.Inf()
+	NonFiniteAsNull bool
+	// RegexConverters are matched by the database type name of the columns without a converter of the same type name,
+	// e.g. to convert all the DECIMAL(p,s) variants. The first matching converter is used.
+	RegexConverters []RegexConverter
+	// QuoteString quotes the string literals of the macros, e.g. LiteralQuoteBackslash.Quote. Single quotes are doubled
+	// by default (LiteralQuoteStandard).
+	QuoteString func(string) string
+	// AllValue is the value of the template variables when "All" is selected, used by the $__conditionalAll macro ("$__all" by default)
+	AllValue string
+	// IgnoreCommentedMacros leaves the macros within SQL comments (-- and /* */) as they are, instead of applying them
+	IgnoreCommentedMacros bool
+	// QueryFragments are the SQL fragments inlined by the $__fragment macro, by name
+	QueryFragments map[string]string
+	// StrictMacros makes the interpolation fail with an *UnknownMacroError (matching ErrUnknownMacro) listing the macros
+	// that are not defined, instead of sending them to the database. The macros within literals and comments are ignored.
+	StrictMacros bool
+	// StreamRows sends the query results through a Grafana Live stream, in frames of StreamChunkSize rows (1000 by default),
+	// instead of buffering all the rows in the query response. The query is dropped if nobody subscribes to the stream within a minute.
+	// As in the other queries, the rows are limited by MaxRows and each frame is passed to the ResponseMutator.
+	StreamRows      bool
+	StreamChunkSize int
+	// AnnotateQueries prepends a comment with the user and the dashboard running the query, e.g. "/* user=admin dashboard=abc */"
+	AnnotateQueries bool
+	// CommentQueries prepends a comment with the RefID of the query and the panel running it, e.g. "/* grafana: refId=A panelId=2 */",
+	// so that the database administrators can trace the queries back to the panels
+	CommentQueries bool
+	// StatementTimeoutSQL is the format string of a statement run before each query to limit its execution in the database,
+	// e.g. "SET statement_timeout = %d". It receives the timeout of the query in milliseconds, and is not run if the
+	// query has no timeout. Both statements are run on the same connection.
+	StatementTimeoutSQL string
+	// StatementTimeoutResetSQL is the statement run after the query to reset the statement timeout before the
+	// connection goes back to the pool, e.g. "RESET statement_timeout". It's not needed if StatementTimeoutSQL only
+	// applies to the current transaction or statement.
+	StatementTimeoutResetSQL string
+	// IntervalExpression is the format string used by the $__timeInterval macro to group times by the query interval.
+	// It receives the column (%[1]s), the unit of the interval (%[2]s, e.g. "minute") and the interval in seconds (%[3]s),
+	// e.g. "date_trunc('%[2]s', %[1]s)". The $__timeGroup macro is used if empty.
+	IntervalExpression string
+	// TimeSpineExpression is the format string used by the $__timeSpine macro to generate a row for each interval of the
+	// query time range. It receives the start (%[1]s) and the end (%[2]s) of the time range as quoted strings, and the
+	// interval in seconds (%[3]s), e.g. "generate_series(%[1]s::timestamptz, %[2]s::timestamptz, '%[3]s seconds'::interval)".
+	// The macro fails with ErrorUnsupportedMacro if empty.
+	TimeSpineExpression string
+	// MaxLimit is the maximum value returned by the $__limit macro. There is no maximum if zero.
+	MaxLimit int
+	// PaginationSQL is the format string appended to the queries with a page size, receiving the page size (%[1]d) and
+	// the offset (%[2]d), e.g. "OFFSET %[2]d ROWS FETCH NEXT %[1]d ROWS ONLY". It's "LIMIT %[1]d OFFSET %[2]d" if empty.
+	PaginationSQL string
+	// TrueLiteral and FalseLiteral are the boolean literals written by the $__bool macro, e.g. "1" and "0" for databases
+	// without a boolean type. They are TRUE and FALSE if empty.
+	TrueLiteral  string
+	FalseLiteral string
+	// ReadOnly rejects the queries that don't start with SELECT, WITH or SHOW (after applying the macros and ignoring
+	// comments), the queries with multiple statements and the queries modifying the database within a WITH clause or with
+	// SELECT ... INTO
+	ReadOnly bool
+	// FieldNameTransform renames the frame fields, given the name of their column (e.g. to lowercase the names).
+	// The names are unchanged if nil.
+	FieldNameTransform func(string) string
+	// EmptyFramesWithSchema returns a frame with the columns of the query but no rows when a time series query has no results,
+	// so that panels can show empty axes. Otherwise, no data is returned.
+	EmptyFramesWithSchema bool
+	// MaxRows truncates the results of the queries to the given number of rows, adding a notice that the results were
+	// limited. The rows past the limit are not read, unless CountDroppedRows is set. There is no limit if zero.
+	MaxRows int64
+	// CountDroppedRows reads the rows past MaxRows to tell how many were dropped in the notice, instead of only telling
+	// that there were more rows than the limit
+	CountDroppedRows bool
+	// MaxConcurrentQueries limits the number of queries run at the same time for each datasource, by QueryData or RunQuery.
+	// Further queries wait until a running one finishes. There is no limit if zero.
+	MaxConcurrentQueries int
+	// MultipleResultSets returns a frame for each result set of the query (e.g. of a stored procedure), instead of only the first one.
+	// The frames after the first one are named after the RefID and the index of the result set (e.g. "A_1").
+	MultipleResultSets bool
+	// UseNullableFields makes the columns without a driver converter use nullable field types (e.g. *int64 instead of int64),
+	// so that NULL values are not confused with zero values
+	UseNullableFields bool
+	// SkipBrokenRows skips the rows that can't be read (e.g. because of a malformed value) instead of failing the query.
+	// The number of skipped rows is reported in a notice.
+	SkipBrokenRows bool
+	// PlaceholderStyle defines how the bind parameters created by the $__arg macro are written (question marks by default)
+	PlaceholderStyle PlaceholderStyle
+	// RewritePlaceholders is an opt-in rewrite of each statement just before running it, once the $__arg placeholders
+	// are written with PlaceholderStyle, e.g. sqlds.PlaceholderDollar.Rewrite to convert the question marks of queries
+	// written for another database. It receives the statement and its number of bind parameters.
+	RewritePlaceholders func(sql string, n int) string
 }
 
 // Driver is a simple interface that defines how to connect to a backend SQL datasource
@@ -27,6 +163,90 @@ type Driver interface {
 	Converters() []sqlutil.Converter
 }
 
+// QueryTimeouter can be implemented by a Driver to compute the timeout of each query (e.g. based on its Interval or MaxDataPoints).
+// If it returns 0, DriverSettings.Timeout is used.
+type QueryTimeouter interface {
+	QueryTimeout(q *Query) time.Duration
+}
+
+// ColumnConverterProvider can be implemented by a Driver to choose the converter of a column by its name.
+// These converters take precedence over the ones returned by Converters, which are matched by the column type.
+type ColumnConverterProvider interface {
+	ColumnConverters() map[string]sqlutil.Converter
+}
+
+// QueryMutator can be implemented by a Driver to rewrite the queries before the macros are applied
+// (e.g. to add a tenant filter to every query)
+type QueryMutator interface {
+	MutateQuery(ctx context.Context, q *Query) (*Query, error)
+}
+
+// ResponseMutator can be implemented by a Driver to post-process the frames returned by each query
+// (e.g. to add metadata, redact columns or attach notices)
+type ResponseMutator interface {
+	MutateResponse(ctx context.Context, frames data.Frames) (data.Frames, error)
+}
+
+// ConnectionKeyer can be implemented by a Driver to choose the connection of each query (e.g. to route it to a shard).
+// A connection is created for each different key, calling Connect with the connection arguments of the first query using it,
+// and reused by the following queries with the same key. The default connection is used if the key is empty.
+type ConnectionKeyer interface {
+	ConnectionKey(settings backend.DataSourceInstanceSettings, q *Query) string
+}
+
+// ErrorMapper can be implemented by a Driver to rewrite the query errors before they are returned
+// (e.g. to translate vendor error codes into user-friendly messages). Returning nil keeps the original error.
+type ErrorMapper interface {
+	MapError(err error) error
+}
+
+// HealthDetailer can be implemented by a Driver to add details to successful health checks (e.g. the database version),
+// given the connection that has been checked. The details are sent to Grafana as a JSON object.
+type HealthDetailer interface {
+	HealthDetails(ctx context.Context, db Connection) (map[string]interface{}, error)
+}
+
+// QueryLogger can be implemented by a Driver to log or measure the queries (e.g. to export metrics).
+// OnQueryStart is called before running each query, once the macros have been applied, and OnQueryEnd once it finishes,
+// with its error, the number of rows returned and the time it took, including retries.
+type QueryLogger interface {
+	OnQueryStart(ctx context.Context, q *Query)
+	OnQueryEnd(ctx context.Context, q *Query, err error, rows int, duration time.Duration)
+}
+
+// QueryCanceler can be implemented by a Driver to cancel a query in the database when it's cancelled through the /cancel
+// resource (e.g. with pg_cancel_backend), for databases that don't stop the query when its context is cancelled.
+type QueryCanceler interface {
+	CancelQuery(ctx context.Context, settings backend.DataSourceInstanceSettings, q *Query) error
+}
+
+// Capabilities are the features supported by a Driver. The features that are not supported are disabled, even if they
+// are enabled in the DriverSettings.
+type Capabilities struct {
+	// Cancellation allows cancelling running queries through the /cancel resource
+	Cancellation bool
+	// MultipleStatements allows running several statements in a query, as enabled by DriverSettings.AllowMultipleStatements
+	MultipleStatements bool
+	// MultipleResultSets allows returning a frame for each result set, as enabled by DriverSettings.MultipleResultSets
+	MultipleResultSets bool
+	// Streaming allows sending the results through a stream, as enabled by DriverSettings.StreamRows
+	Streaming bool
+}
+
+// defaultCapabilities are used for the drivers that don't implement CapabilitiesProvider
+var defaultCapabilities = Capabilities{
+	Cancellation:       true,
+	MultipleStatements: true,
+	MultipleResultSets: true,
+	Streaming:          true,
+}
+
+// CapabilitiesProvider can be implemented by a Driver to declare the features it supports.
+// It's called once, and all the features are supported if it's not implemented.
+type CapabilitiesProvider interface {
+	Capabilities() Capabilities
+}
+
 // Connection represents a SQL connection and is satisfied by the *sql.DB type
 // For now, we only add the functions that we need / actively use. Some other candidates for future use could include the ExecContext and BeginTxContext functions
 type Connection interface {
@@ -13,4 +13,10 @@ var (
 	ErrorTimeout = errors.New("query timeout exceeded")
 	// ErrorNoResults is returned if there were no results returned
 	ErrorNoResults = errors.New("no results returned from query")
+	// ErrorTimeColumn is returned if the time column of the query is missing or doesn't contain times
+	ErrorTimeColumn = errors.New("invalid time column")
+	// ErrorReadOnly is returned when DriverSettings.ReadOnly is set and the query could modify the database
+	ErrorReadOnly = errors.New("only read queries are allowed")
+	// ErrorQueryNotRunning is returned when cancelling a query that is not running
+	ErrorQueryNotRunning = errors.New("query not running")
 )
@@ -0,0 +1,206 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// fakeResult are the rows returned by the fakeSQLDriver
+type fakeResult struct {
+	columns []string
+	// types are the database type names of the columns (optional)
+	types []string
+	rows  [][]driver.Value
+	// next are the following result sets (optional)
+	next []fakeResult
+}
+
+// fakeSQLDriver is a database/sql driver that records the pings and the queries it receives.
+// Queries return the result of the handler, or no rows if the handler is nil.
+type fakeSQLDriver struct {
+	mtx     sync.Mutex
+	pings   int
+	pingErr error
+	queries []string
+	args    [][]interface{}
+	// rowsRead is the number of rows read from the results
+	rowsRead int
+	handler  func(ctx context.Context, query string) (fakeResult, error)
+}
+
+// DB returns a *sql.DB using the fake driver
+func (d *fakeSQLDriver) DB() *sql.DB {
+	return sql.OpenDB(&fakeConnector{d})
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{d, map[string]string{}}, nil
+}
+
+func (d *fakeSQLDriver) Pings() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.pings
+}
+
+func (d *fakeSQLDriver) SetPingError(err error) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.pingErr = err
+}
+
+func (d *fakeSQLDriver) Queries() []string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return append([]string{}, d.queries...)
+}
+
+// RowsRead returns the number of rows read from the results of the queries
+func (d *fakeSQLDriver) RowsRead() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.rowsRead
+}
+
+// Args returns the bind parameters of each query
+func (d *fakeSQLDriver) Args() [][]interface{} {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return append([][]interface{}{}, d.args...)
+}
+
+type fakeConnector struct {
+	d *fakeSQLDriver
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.d.Open("")
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+	return c.d
+}
+
+type fakeConn struct {
+	d *fakeSQLDriver
+	// session is the state of the connection, shared by its queries
+	session map[string]string
+}
+
+type fakeSessionKey struct{}
+
+// fakeSession returns the session of the connection running the query, for the handlers to keep state across the
+// queries of the same connection
+func fakeSession(ctx context.Context) map[string]string {
+	session, _ := ctx.Value(fakeSessionKey{}).(map[string]string)
+	return session
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.d.mtx.Lock()
+	defer c.d.mtx.Unlock()
+	c.d.pings++
+	if c.d.pingErr != nil {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.mtx.Lock()
+	c.d.queries = append(c.d.queries, query)
+	values := []interface{}{}
+	for _, arg := range args {
+		values = append(values, arg.Value)
+	}
+	c.d.args = append(c.d.args, values)
+	handler := c.d.handler
+	c.d.mtx.Unlock()
+
+	if handler == nil {
+		return &fakeRows{d: c.d}, nil
+	}
+	res, err := handler(context.WithValue(ctx, fakeSessionKey{}, c.session), query)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{result: res, d: c.d}, nil
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not implemented")
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+	d      *fakeSQLDriver
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.result.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) HasNextResultSet() bool {
+	return len(r.result.next) > 0
+}
+
+func (r *fakeRows) NextResultSet() error {
+	if len(r.result.next) == 0 {
+		return io.EOF
+	}
+	next := r.result.next[0]
+	next.next = r.result.next[1:]
+	r.result, r.next = next, 0
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	if r.d != nil {
+		r.d.mtx.Lock()
+		r.d.rowsRead++
+		r.d.mtx.Unlock()
+	}
+	return nil
+}
+
+// ColumnTypeScanType returns the type of the first value of the column
+func (r *fakeRows) ColumnTypeScanType(index int) reflect.Type {
+	if len(r.result.rows) == 0 {
+		return reflect.TypeOf("")
+	}
+	return reflect.TypeOf(r.result.rows[0][index])
+}
+
+func (r *fakeRows) ColumnTypeDatabaseTypeName(index int) string {
+	if index < len(r.result.types) {
+		return r.result.types[index]
+	}
+	return ""
+}
+
+func (r *fakeRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	return false, true
+}
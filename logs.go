@@ -0,0 +1,93 @@
+package sqlds
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// ErrorLogsBody is returned when the logs format is used but there is no column for the log line
+var ErrorLogsBody = errors.New("logs format requires a string column for the log line (e.g. body or line)")
+
+var (
+	logsTimeColumns = []string{"time", "timestamp", "ts"}
+	logsBodyColumns = []string{"body", "line", "message"}
+)
+
+// findField returns the index of the first field with one of the given names (case insensitive) and types,
+// falling back to the first field with one of the types. It returns -1 if there is no such field.
+func findField(fields []*data.Field, names []string, types ...data.FieldType) int {
+	for _, name := range names {
+		if i := fieldIndex(fields, name); i >= 0 && hasFieldType(fields[i], types) {
+			return i
+		}
+	}
+	for i, f := range fields {
+		if hasFieldType(f, types) {
+			return i
+		}
+	}
+	return -1
+}
+
+// fieldIndex returns the index of the field with the given name (case insensitive), or -1 if there is no such field
+func fieldIndex(fields []*data.Field, name string) int {
+	for i, f := range fields {
+		if strings.EqualFold(f.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasFieldType reports whether the field has one of the types
+func hasFieldType(field *data.Field, types []data.FieldType) bool {
+	for _, t := range types {
+		if field.Type() == t {
+			return true
+		}
+	}
+	return false
+}
+
+// removeField returns a copy of the fields without the field at index i
+func removeField(fields []*data.Field, i int) []*data.Field {
+	return append(append([]*data.Field{}, fields[:i]...), fields[i+1:]...)
+}
+
+// reorderedFrame returns a frame with the fields in the given order, keeping the name and the metadata of the frame,
+// to be displayed with the visualization
+func reorderedFrame(frame *data.Frame, fields []*data.Field, vis data.VisType) *data.Frame {
+	reordered := data.NewFrame(frame.Name, fields...)
+	reordered.Meta = frame.Meta
+	if reordered.Meta == nil {
+		reordered.Meta = &data.FrameMeta{}
+	}
+	reordered.Meta.PreferredVisualization = vis
+	return reordered
+}
+
+// toLogsFrame reorders the frame fields so it can be displayed by the logs visualization:
+// the time field (if any) comes first, followed by the log line and the rest of the columns,
+// which are shown as the labels of each line.
+func toLogsFrame(frame *data.Frame) (*data.Frame, error) {
+	var (
+		fields = []*data.Field{}
+		rest   = frame.Fields
+	)
+
+	if i := findField(rest, logsTimeColumns, data.FieldTypeTime, data.FieldTypeNullableTime); i >= 0 {
+		fields = append(fields, rest[i])
+		rest = removeField(rest, i)
+	}
+
+	i := findField(rest, logsBodyColumns, data.FieldTypeString, data.FieldTypeNullableString)
+	if i < 0 {
+		return nil, ErrorLogsBody
+	}
+	fields = append(fields, rest[i])
+	rest = removeField(rest, i)
+
+	return reorderedFrame(frame, append(fields, rest...), data.VisTypeLogs), nil
+}
@@ -0,0 +1,79 @@
+package sqlds
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fieldNames(frame *data.Frame) []string {
+	names := make([]string, len(frame.Fields))
+	for i, f := range frame.Fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+func Test_toLogsFrame(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		desc     string
+		frame    *data.Frame
+		expected []string
+	}{
+		{
+			desc: "it should return the time and the body first, followed by the labels",
+			frame: data.NewFrame("A",
+				data.NewField("host", nil, []string{"a", "b"}),
+				data.NewField("body", nil, []string{"hello", "world"}),
+				data.NewField("level", nil, []string{"info", "error"}),
+				data.NewField("time", nil, []time.Time{now, now}),
+			),
+			expected: []string{"time", "body", "host", "level"},
+		},
+		{
+			desc: "it should use the line column as body",
+			frame: data.NewFrame("A",
+				data.NewField("ts", nil, []*time.Time{&now}),
+				data.NewField("host", nil, []string{"a"}),
+				data.NewField("line", nil, []*string{nil}),
+			),
+			expected: []string{"ts", "line", "host"},
+		},
+		{
+			desc: "it should use the first string column as body",
+			frame: data.NewFrame("A",
+				data.NewField("count", nil, []int64{1}),
+				data.NewField("text", nil, []string{"hello"}),
+				data.NewField("created", nil, []time.Time{now}),
+			),
+			expected: []string{"created", "text", "count"},
+		},
+		{
+			desc: "it should support results without a time column",
+			frame: data.NewFrame("A",
+				data.NewField("host", nil, []string{"a"}),
+				data.NewField("line", nil, []string{"hello"}),
+			),
+			expected: []string{"line", "host"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			frame, err := toLogsFrame(tt.frame)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, fieldNames(frame))
+			assert.Equal(t, "A", frame.Name)
+			require.NotNil(t, frame.Meta)
+			assert.Equal(t, data.VisType(data.VisTypeLogs), frame.Meta.PreferredVisualization)
+		})
+	}
+
+	t.Run("it should return an error if there is no string column", func(t *testing.T) {
+		_, err := toLogsFrame(data.NewFrame("A", data.NewField("time", nil, []time.Time{now})))
+		assert.ErrorIs(t, err, ErrorLogsBody)
+	})
+}
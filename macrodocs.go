@@ -0,0 +1,54 @@
+package sqlds
+
+// MacroDoc documents a macro for the query editors, e.g. to show it in a tooltip
+type MacroDoc struct {
+	// Summary is a one line description of the macro
+	Summary string `json:"summary,omitempty"`
+	// Args are the names of the arguments, with the optional ones in brackets (e.g. "[alias]")
+	Args []string `json:"args,omitempty"`
+}
+
+// MacroDocumenter can be implemented by a Driver to document its macros in the /macros resource.
+// The documentation of the default macros can be overridden, e.g. when the driver redefines them.
+type MacroDocumenter interface {
+	MacroDocs() map[string]MacroDoc
+}
+
+// DefaultMacroDocs documents the default macros, including the ones that depend on the driver settings
+var DefaultMacroDocs = map[string]MacroDoc{
+	"timeFilter":      {Summary: "Filters the column by the query period", Args: []string{"column", "[cast]"}},
+	"timeFilterMs":    {Summary: "Filters a column of Unix epoch milliseconds by the query period", Args: []string{"column"}},
+	"timeShift":       {Summary: "Filters the column by the query period shifted by the offset (e.g. -7d)", Args: []string{"column", "offset"}},
+	"timeFrom":        {Summary: "Filters the column by the start of the query period", Args: []string{"column"}},
+	"timeTo":          {Summary: "Filters the column by the end of the query period", Args: []string{"column"}},
+	"timeGroup":       {Summary: "Groups the times of the column by the interval", Args: []string{"column", "interval"}},
+	"timeGroupAlias":  {Summary: "Groups the times of the column by the interval, with an alias", Args: []string{"column", "interval", "[alias]"}},
+	"timeGroupAgg":    {Summary: "Groups the times of the column by the interval, followed by the aliased aggregation", Args: []string{"column", "interval", "aggregation", "alias"}},
+	"timeInterval":    {Summary: "Groups the times of the column by the interval of the query", Args: []string{"column"}},
+	"timeRoundFrom":   {Summary: "Returns the start of the query period rounded down to the query interval"},
+	"timeRoundTo":     {Summary: "Returns the end of the query period rounded up to the query interval"},
+	"timeSpine":       {Summary: "Generates a row for each interval of the query period"},
+	"now":             {Summary: "Returns the end of the query period"},
+	"nowEpoch":        {Summary: "Returns the end of the query period as Unix epoch seconds"},
+	"unixEpochFilter": {Summary: "Filters a column of Unix epoch seconds by the query period", Args: []string{"column"}},
+	"unixEpochFrom":   {Summary: "Returns the start of the query period as Unix epoch seconds"},
+	"unixEpochTo":     {Summary: "Returns the end of the query period as Unix epoch seconds"},
+	"interval_s":      {Summary: "Returns the query interval in seconds"},
+	"interval_ms":     {Summary: "Returns the query interval in milliseconds"},
+	"maxDataPoints":   {Summary: "Returns the maximum number of data points of the panel"},
+	"bucketCount":     {Summary: "Returns how many intervals fit in the query period"},
+	"table":           {Summary: "Returns the table of the query"},
+	"column":          {Summary: "Returns the column of the query"},
+	"columns":         {Summary: "Lists the quoted columns of the table", Args: []string{"table"}},
+	"schema":          {Summary: "Returns the quoted schema of the query, qualifying the table if given", Args: []string{"[table]"}},
+	"searchFilter":    {Summary: "Filters the column by the search term of the query", Args: []string{"column"}},
+	"arg":             {Summary: "Passes an argument of the query as a bind parameter", Args: []string{"name"}},
+	"quoteIdentifier": {Summary: "Quotes the identifier", Args: []string{"name"}},
+	"quoteList":       {Summary: "Quotes a list of values as string literals", Args: []string{"values..."}},
+	"conditionalAll":  {Summary: "Returns the condition, or 1=1 if the variable has the All value", Args: []string{"condition", "$variable"}},
+	"varsJson":        {Summary: "Returns the variables of the query as a JSON string literal"},
+	"refId":           {Summary: "Returns the RefID of the query as a string literal"},
+	"limit":           {Summary: "Returns the row limit of the query, or the default", Args: []string{"default"}},
+	"bool":            {Summary: "Writes a boolean variable as a boolean literal", Args: []string{"value"}},
+	"fragment":        {Summary: "Inlines the SQL of the named query fragment", Args: []string{"name"}},
+}
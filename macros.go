@@ -1,18 +1,53 @@
 package sqlds
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
 var (
 	// ErrorBadArgumentCount is returned from macros when the wrong number of arguments were provided
 	ErrorBadArgumentCount = errors.New("unexpected number of arguments")
+	// ErrorTimeZone is returned when the query time zone is not a valid IANA time zone name
+	ErrorTimeZone = errors.New("invalid time zone")
+	// ErrorParsingMacroArgs is returned when the arguments of a macro can't be parsed (e.g. unbalanced quotes or parentheses)
+	ErrorParsingMacroArgs = errors.New("error parsing macro arguments")
+	// ErrUnknownMacro is returned when DriverSettings.StrictMacros is set and the query contains macros that are not defined.
+	// The error is an *UnknownMacroError listing them.
+	ErrUnknownMacro = errors.New("unknown macro")
+	// ErrorMacroPanic is returned when a macro panics (e.g. when accessing a missing argument)
+	ErrorMacroPanic = errors.New("macro panicked")
+	// ErrorMacroDepth is returned when nested macros exceed the maximum expansion depth (e.g. a macro that expands to itself)
+	ErrorMacroDepth = errors.New("maximum macro expansion depth exceeded")
+	// ErrorInvalidMacroName is returned by ValidateMacros when a macro name is empty or contains invalid characters
+	ErrorInvalidMacroName = errors.New("invalid macro name")
+	// ErrorMixedMacroArgs is returned when a macro is called with both positional and named arguments
+	ErrorMixedMacroArgs = errors.New("macro arguments must be either all positional or all named")
+	// ErrorUnsupportedMacro is returned by the macros that require a driver setting that is not configured
+	ErrorUnsupportedMacro = errors.New("macro not supported by the driver")
+	// ErrorInvalidMacroArg is returned by the MacroArg helpers when an argument can't be converted to the expected type
+	ErrorInvalidMacroArg = errors.New("invalid macro argument")
 )
 
+// errKeepMacro is returned by the macros that leave their call in the query as it is
+var errKeepMacro = errors.New("keep macro")
+
+// defaultMacroPrefix is used when the driver doesn't define its own prefix
+const defaultMacroPrefix = "$__"
+
+// maxMacroDepth limits how deep macros can be nested inside other macros' arguments or results
+const maxMacroDepth = 10
+
 // MacroFunc defines a signature for applying a query macro
 // Query macro implementations are defined by users / consumers of this package
 type MacroFunc func(*Query, []string) (string, error)
@@ -21,47 +56,478 @@ type MacroFunc func(*Query, []string) (string, error)
 // The "string" key is the name of the macro function. This name has to be regex friendly.
 type Macros map[string]MacroFunc
 
+// IdentifierQuote defines how identifiers are quoted by the $__quoteIdentifier macro
+type IdentifierQuote string
+
+const (
+	// IdentifierQuoteDouble quotes identifiers with double quotes, as defined by ANSI SQL. This is the default.
+	IdentifierQuoteDouble IdentifierQuote = `"`
+	// IdentifierQuoteBacktick quotes identifiers with backticks, as used by MySQL
+	IdentifierQuoteBacktick IdentifierQuote = "`"
+	// IdentifierQuoteBracket quotes identifiers with square brackets, as used by SQL Server
+	IdentifierQuoteBracket IdentifierQuote = "[]"
+)
+
+// Quote returns the quoted identifier, escaping the quote characters it contains
+func (q IdentifierQuote) Quote(name string) string {
+	switch q {
+	case IdentifierQuoteBracket:
+		return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+	case IdentifierQuoteBacktick:
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	default:
+		return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+	}
+}
+
+// LiteralQuote defines how string literals are escaped by the macros. Its Quote method can be set as DriverSettings.QuoteString.
+type LiteralQuote string
+
+const (
+	// LiteralQuoteStandard doubles the single quotes of the literals, as defined by ANSI SQL. This is the default.
+	LiteralQuoteStandard LiteralQuote = ""
+	// LiteralQuoteBackslash also escapes the backslashes of the literals, as needed by MySQL
+	LiteralQuoteBackslash LiteralQuote = "backslash"
+)
+
+// Quote returns the value as a string literal quoted with single quotes, escaping the characters it contains
+func (q LiteralQuote) Quote(value string) string {
+	if q == LiteralQuoteBackslash {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+	}
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// QuoteLiteral returns the value as a string literal, using DriverSettings.QuoteString or LiteralQuoteStandard.
+// Drivers can use it in their macros to escape the values the same way as the default macros.
+func (s DriverSettings) QuoteLiteral(value string) string {
+	if s.QuoteString != nil {
+		return s.QuoteString(value)
+	}
+	return LiteralQuoteStandard.Quote(value)
+}
+
+// QuoteLiteralTime returns t as a RFC3339 string literal in the time zone of the query, or in UTC if the query doesn't
+// define one, quoted like QuoteLiteral. It returns ErrorTimeZone if the time zone of the query is not valid.
+func (s DriverSettings) QuoteLiteralTime(query *Query, t time.Time) (string, error) {
+	formatted, err := formatTime(query, t)
+	if err != nil {
+		return "", err
+	}
+	return s.QuoteLiteral(formatted), nil
+}
+
+// MacroCall describes the invocation of a macro. It's available to the macros through query.MacroCall().
+type MacroCall struct {
+	// Name is the name of the macro, without the prefix
+	Name string
+	// Match is the text replaced by the macro, e.g. "$__foo(a, b)"
+	Match string
+	// HasParens is true if the macro was called with parentheses, even without arguments (e.g. "$__foo()")
+	HasParens bool
+	// NumArgs is the number of arguments received. It's 0 for both "$__foo" and "$__foo()".
+	NumArgs int
+}
+
+var namedArgRegex = regexp.MustCompile(`(?s)^(\w+)\s*=\s*(.*)$`)
+
+// WithNamedArgs allows calling the macro with named arguments (e.g. "$__timeFilter(column=ts)"), given the names of its
+// positional arguments. Named arguments are passed to the macro in the position of their name, leaving empty the ones
+// not given. Arguments whose name is not in params are considered positional, and mixing both kinds is an error.
+func WithNamedArgs(macro MacroFunc, params ...string) MacroFunc {
+	positions := make(map[string]int, len(params))
+	for i, param := range params {
+		positions[param] = i
+	}
+	return func(query *Query, args []string) (string, error) {
+		var named []string
+		for _, arg := range args {
+			m := namedArgRegex.FindStringSubmatch(arg)
+			if m == nil {
+				continue
+			}
+			if _, ok := positions[m[1]]; ok {
+				named = append(named, m[1])
+			}
+		}
+		if len(named) == 0 {
+			return macro(query, args)
+		}
+		if len(named) != len(args) {
+			return "", fmt.Errorf("%w: %s", ErrorMixedMacroArgs, strings.Join(args, ", "))
+		}
+
+		positional := []string{}
+		for _, arg := range args {
+			m := namedArgRegex.FindStringSubmatch(arg)
+			i := positions[m[1]]
+			for len(positional) <= i {
+				positional = append(positional, "")
+			}
+			positional[i] = m[2]
+		}
+		return macro(query, positional)
+	}
+}
+
+// MacroPrefixer can be implemented by a Driver to use a custom macro prefix (e.g. "@@") instead of "$__".
+// Returning an empty string falls back to the default prefix.
+type MacroPrefixer interface {
+	MacroPrefix() string
+}
+
+// MacroDisabler can be implemented by a Driver to remove some of the default macros (e.g. "timeGroup").
+// Disabled macros are handled like unknown macros, unless the driver defines them in Macros.
+type MacroDisabler interface {
+	DisabledMacros() []string
+}
+
+// DefaultMacroHandler can be implemented by a Driver to handle the macros that are not defined (e.g. to implement
+// dynamic macros). DefaultMacro is called with the name and the arguments of the macro; returning false leaves the
+// macro unhandled, as if the driver didn't implement this interface.
+type DefaultMacroHandler interface {
+	DefaultMacro(name string, query *Query, args []string) (string, bool, error)
+}
+
+// withDefaultMacro returns the macros extended with a macro calling the DefaultMacroHandler for every unknown macro in
+// the texts, and whether any macro was added
+func withDefaultMacro(handler DefaultMacroHandler, macros Macros, prefix string, texts ...string) (Macros, bool) {
+	var extended Macros
+	for _, text := range texts {
+		for _, name := range getMacroNames(prefix, text) {
+			if _, ok := macros[name]; ok {
+				continue
+			}
+			if _, ok := extended[name]; ok {
+				continue
+			}
+			if extended == nil {
+				extended = RegisterMacros(macros, nil)
+			}
+			name := name
+			extended[name] = func(query *Query, args []string) (string, error) {
+				res, ok, err := handler.DefaultMacro(name, query, args)
+				if err == nil && !ok {
+					return "", errKeepMacro
+				}
+				return res, err
+			}
+		}
+	}
+	if extended == nil {
+		return macros, false
+	}
+	return extended, true
+}
+
+// defaultMacros returns the default macros, without the ones disabled by the driver
+func defaultMacros(driver Driver, settings DriverSettings) Macros {
+	return disableMacros(driver, RegisterMacros(DefaultMacros, settingsMacros(settings)))
+}
+
+// disableMacros removes the macros disabled by the driver
+func disableMacros(driver Driver, macros Macros) Macros {
+	if d, ok := driver.(MacroDisabler); ok {
+		for _, name := range d.DisabledMacros() {
+			delete(macros, name)
+		}
+	}
+	return macros
+}
+
+func getMacroPrefix(driver Driver) string {
+	if p, ok := driver.(MacroPrefixer); ok && p.MacroPrefix() != "" {
+		return p.MacroPrefix()
+	}
+	return defaultMacroPrefix
+}
+
+// timeQuoter quotes a time as a string literal, e.g. DriverSettings.QuoteLiteralTime
+type timeQuoter func(query *Query, t time.Time) (string, error)
+
+// formatTime formats t as RFC3339 in the query time zone, or in UTC if the query doesn't define one
+func formatTime(query *Query, t time.Time) (string, error) {
+	if query.TimeZone == "" {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	loc, err := time.LoadLocation(query.TimeZone)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrorTimeZone, query.TimeZone)
+	}
+	return t.In(loc).Format(time.RFC3339), nil
+}
+
 // Default time filter for SQL based on the query time range.
+// It requires one argument, the time column to filter. The optional second argument is a type that the column and the
+// time literals are cast to before comparing them.
+// Example:
+//   $__timeFilter(time) => "time >= '2006-01-02T15:04:05Z07:00' AND time <= '2006-01-02T15:04:05Z07:00'"
+//   $__timeFilter(time, timestamptz) => "CAST(time AS timestamptz) >= CAST('2006-01-02T15:04:05Z07:00' AS timestamptz) AND ..."
+func macroTimeFilter(quote timeQuoter) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) < 1 || len(args) > 2 || args[0] == "" {
+			return "", fmt.Errorf("%w: expected 1 or 2 arguments, received %d", ErrorBadArgumentCount, len(args))
+		}
+
+		from, err := quote(query, query.TimeRange.From)
+		if err != nil {
+			return "", err
+		}
+		to, err := quote(query, query.TimeRange.To)
+		if err != nil {
+			return "", err
+		}
+
+		column := args[0]
+		if cast := MacroArgString(args, 1, ""); cast != "" {
+			column = fmt.Sprintf("CAST(%s AS %s)", column, cast)
+			from = fmt.Sprintf("CAST(%s AS %s)", from, cast)
+			to = fmt.Sprintf("CAST(%s AS %s)", to, cast)
+		}
+		return fmt.Sprintf("%s >= %s AND %s <= %s", column, from, column, to), nil
+	}
+}
+
+// daysOffsetRegex matches the offsets in days or weeks, which are not supported by time.ParseDuration
+var daysOffsetRegex = regexp.MustCompile(`^([+-]?)(\d+)([dw])$`)
+
+// parseOffset parses a duration as accepted by time.ParseDuration, also allowing days and weeks (e.g. "-7d" or "1w")
+func parseOffset(offset string) (time.Duration, error) {
+	if m := daysOffsetRegex.FindStringSubmatch(offset); m != nil {
+		n, err := strconv.Atoi(m[2])
+		if err != nil {
+			return 0, err
+		}
+		d := time.Duration(n) * 24 * time.Hour
+		if m[3] == "w" {
+			d *= 7
+		}
+		if m[1] == "-" {
+			d = -d
+		}
+		return d, nil
+	}
+	return time.ParseDuration(offset)
+}
+
+// Default time filter for SQL based on the query time range shifted by an offset, e.g. to compare with the previous week.
+// It requires two arguments, the time column to filter and the offset, as a Go duration that can also use days or weeks.
+// Example:
+//   $__timeShift(time, -7d) => "time >= '2005-12-26T15:04:05Z07:00' AND time <= '2005-12-26T15:04:05Z07:00'"
+func macroTimeShift(quote timeQuoter) MacroFunc {
+	timeFilter := macroTimeFilter(quote)
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 2 || args[0] == "" || args[1] == "" {
+			return "", fmt.Errorf("%w: expected 2 arguments, received %d", ErrorBadArgumentCount, len(args))
+		}
+		offset, err := parseOffset(strings.Trim(args[1], `'"`))
+		if err != nil {
+			return "", fmt.Errorf("%w: invalid offset %s: %v", ErrorInvalidMacroArg, args[1], err)
+		}
+
+		shifted := *query
+		shifted.TimeRange = backend.TimeRange{From: query.TimeRange.From.Add(offset), To: query.TimeRange.To.Add(offset)}
+		return timeFilter(&shifted, args[:1])
+	}
+}
+
+// Default time filter for SQL based on the starting query time range.
+// It requires one argument, the time column to filter.
+// Example:
+//   $__timeFrom(time) => "time > '2006-01-02T15:04:05Z07:00'"
+func macroTimeFrom(quote timeQuoter) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+		}
+
+		from, err := quote(query, query.TimeRange.From)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s >= %s", args[0], from), nil
+	}
+}
+
+// Default time filter for SQL based on the ending query time range.
 // It requires one argument, the time column to filter.
 // Example:
-//   $__timeFilter(time) => "time BETWEEN '2006-01-02T15:04:05Z07:00' AND '2006-01-02T15:04:05Z07:00'"
-func macroTimeFilter(query *Query, args []string) (string, error) {
+//   $__timeTo(time) => "time < '2006-01-02T15:04:05Z07:00'"
+func macroTimeTo(quote timeQuoter) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+		}
+
+		to, err := quote(query, query.TimeRange.To)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%s <= %s", args[0], to), nil
+	}
+}
+
+// Default macro to return the starting query time range rounded down to the query interval.
+// The time range is not rounded if the interval is zero.
+// Example:
+//   $__timeRoundFrom() => "'2006-01-02T15:00:00Z'"
+func macroTimeRoundFrom(quote timeQuoter) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		from := query.TimeRange.From
+		if query.Interval > 0 {
+			from = from.Truncate(query.Interval)
+		}
+
+		return quote(query, from)
+	}
+}
+
+// Default macro to return the ending query time range rounded up to the query interval.
+// The time range is not rounded if the interval is zero.
+// Example:
+//   $__timeRoundTo() => "'2006-01-02T16:00:00Z'"
+func macroTimeRoundTo(quote timeQuoter) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		to := query.TimeRange.To
+		if query.Interval > 0 {
+			if rounded := to.Truncate(query.Interval); !rounded.Equal(to) {
+				to = rounded.Add(query.Interval)
+			}
+		}
+
+		return quote(query, to)
+	}
+}
+
+// Default macro to return the end of the query time range, the "now" of the dashboard, so that the queries don't depend
+// on the clock of the database.
+// Example:
+//   $__now() => "'2006-01-02T15:04:05Z'"
+func macroNow(quote timeQuoter) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		return quote(query, query.TimeRange.To)
+	}
+}
+
+// Default time filter for SQL based on the query time range, for columns storing Unix epoch seconds.
+// It requires one argument, the time column to filter.
+// Example:
+//   $__unixEpochFilter(time) => "time >= 1136214245 AND time <= 1136214245"
+func macroUnixEpochFilter(query *Query, args []string) (string, error) {
 	if len(args) != 1 {
 		return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
 	}
 
 	var (
 		column = args[0]
-		from   = query.TimeRange.From.UTC().Format(time.RFC3339)
-		to     = query.TimeRange.To.UTC().Format(time.RFC3339)
+		from   = query.TimeRange.From.UTC().Unix()
+		to     = query.TimeRange.To.UTC().Unix()
 	)
 
-	return fmt.Sprintf("%s >= '%s' AND %s <= '%s'", column, from, column, to), nil
+	return fmt.Sprintf("%s >= %d AND %s <= %d", column, from, column, to), nil
 }
 
-// Default time filter for SQL based on the starting query time range.
+// unixMilli returns t as Unix epoch milliseconds
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Default time filter for SQL based on the query time range, for columns storing Unix epoch milliseconds.
 // It requires one argument, the time column to filter.
 // Example:
-//   $__timeFrom(time) => "time > '2006-01-02T15:04:05Z07:00'"
-func macroTimeFrom(query *Query, args []string) (string, error) {
-	if len(args) != 1 {
+//   $__timeFilterMs(time) => "time >= 1136214245000 AND time <= 1136214245000"
+func macroTimeFilterMs(query *Query, args []string) (string, error) {
+	if len(args) != 1 || args[0] == "" {
 		return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
 	}
 
-	return fmt.Sprintf("%s >= '%s'", args[0], query.TimeRange.From.UTC().Format(time.RFC3339)), nil
+	var (
+		column = args[0]
+		from   = unixMilli(query.TimeRange.From)
+		to     = unixMilli(query.TimeRange.To)
+	)
 
+	return fmt.Sprintf("%s >= %d AND %s <= %d", column, from, column, to), nil
 }
 
-// Default time filter for SQL based on the ending query time range.
-// It requires one argument, the time column to filter.
+// Default macro to return the starting query time range as Unix epoch seconds.
 // Example:
-//   $__timeTo(time) => "time < '2006-01-02T15:04:05Z07:00'"
-func macroTimeTo(query *Query, args []string) (string, error) {
-	if len(args) != 1 {
-		return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+//   $__unixEpochFrom() => "1136214245"
+func macroUnixEpochFrom(query *Query, args []string) (string, error) {
+	return fmt.Sprintf("%d", query.TimeRange.From.UTC().Unix()), nil
+}
+
+// Default macro to return the ending query time range as Unix epoch seconds.
+// Example:
+//   $__unixEpochTo() => "1136214245"
+func macroUnixEpochTo(query *Query, args []string) (string, error) {
+	return fmt.Sprintf("%d", query.TimeRange.To.UTC().Unix()), nil
+}
+
+// Default macro to return the end of the query time range, the "now" of the dashboard, as Unix epoch seconds.
+// Example:
+//   $__nowEpoch() => "1136214245"
+func macroNowEpoch(query *Query, args []string) (string, error) {
+	return strconv.FormatInt(query.TimeRange.To.Unix(), 10), nil
+}
+
+// Default macro to return the query interval as integer seconds, or 1 if the interval is zero.
+// Example:
+//   $__interval_s() => "30"
+func macroIntervalSeconds(query *Query, args []string) (string, error) {
+	seconds := int64(math.Round(query.Interval.Seconds()))
+	if seconds <= 0 {
+		return "1", nil
+	}
+	return strconv.FormatInt(seconds, 10), nil
+}
+
+// Default macro to return the query interval as integer milliseconds, or 1 if the interval is zero.
+// Example:
+//   $__interval_ms() => "30000"
+func macroIntervalMilliseconds(query *Query, args []string) (string, error) {
+	ms := query.Interval.Milliseconds()
+	if ms <= 0 {
+		return "1", nil
+	}
+	return strconv.FormatInt(ms, 10), nil
+}
+
+// defaultMaxDataPoints is returned by the $__maxDataPoints macro when the query doesn't define MaxDataPoints
+const defaultMaxDataPoints = 100
+
+// Default macro to return the maximum number of data points of the panel, or 100 if it is not set.
+// Example:
+//   $__maxDataPoints() => "1000"
+func macroMaxDataPoints(query *Query, args []string) (string, error) {
+	if query.MaxDataPoints <= 0 {
+		return strconv.Itoa(defaultMaxDataPoints), nil
+	}
+	return strconv.FormatInt(query.MaxDataPoints, 10), nil
+}
+
+// Default macro to return the number of intervals that fit in the query time range, e.g. for a LIMIT clause.
+// It's at least 1, and at most MaxDataPoints if set. If the interval is zero, it returns MaxDataPoints, or 1 if not set.
+// Example:
+//   $__bucketCount() => "12"
+func macroBucketCount(query *Query, args []string) (string, error) {
+	count := int64(1)
+	if query.Interval > 0 {
+		duration := query.TimeRange.To.Sub(query.TimeRange.From)
+		count = int64(math.Ceil(float64(duration) / float64(query.Interval)))
+	} else if query.MaxDataPoints > 0 {
+		count = query.MaxDataPoints
 	}
 
-	return fmt.Sprintf("%s <= '%s'", args[0], query.TimeRange.To.UTC().Format(time.RFC3339)), nil
+	if query.MaxDataPoints > 0 && count > query.MaxDataPoints {
+		count = query.MaxDataPoints
+	}
+	if count < 1 {
+		count = 1
+	}
+	return strconv.FormatInt(count, 10), nil
 }
 
 // Default time group for SQL based the given period.
@@ -95,6 +561,133 @@ func macroTimeGroup(query *Query, args []string) (string, error) {
 	return res, nil
 }
 
+// Default time group for SQL based on the given period, aliased so that it can be used as the time column.
+// It requires two arguments, the column to filter and the period. An optional third argument overrides the alias.
+// Example:
+//   $__timeGroupAlias(time, month) => "datepart(month, time),datepart(year, time) AS "time""
+//   $__timeGroupAlias(time, month, ts) => "datepart(month, time),datepart(year, time) AS "ts""
+func macroTimeGroupAlias(query *Query, args []string) (string, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return "", fmt.Errorf("%w: timeGroupAlias expected 2 or 3 arguments, received %d", ErrorBadArgumentCount, len(args))
+	}
+	if args[1] == "" {
+		return "", fmt.Errorf("%w: timeGroupAlias requires a non-empty interval", ErrorBadArgumentCount)
+	}
+
+	res, err := macroTimeGroup(query, args[:2])
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`%s AS "%s"`, res, MacroArgString(args, 2, "time")), nil
+}
+
+// Default time group for SQL based on the given period, aliased as the time column, followed by an aggregation of the
+// group, so that both can be selected in one step. It requires four arguments, the column to filter, the period, the
+// aggregation and its alias.
+// Example:
+//   $__timeGroupAgg(time, month, avg(value), value) => "datepart(month, time),datepart(year, time) AS "time", avg(value) AS "value""
+func macroTimeGroupAgg(query *Query, args []string) (string, error) {
+	if len(args) != 4 {
+		return "", fmt.Errorf("%w: timeGroupAgg expected 4 arguments, received %d", ErrorBadArgumentCount, len(args))
+	}
+	for i, name := range []string{"column", "interval", "aggregation", "alias"} {
+		if args[i] == "" {
+			return "", fmt.Errorf("%w: timeGroupAgg requires a non-empty %s", ErrorBadArgumentCount, name)
+		}
+	}
+
+	res, err := macroTimeGroupAlias(query, args[:2])
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`%s, %s AS "%s"`, res, args[2], args[3]), nil
+}
+
+// intervalUnit is a unit of time that can be used to truncate times
+type intervalUnit struct {
+	name     string
+	duration time.Duration
+}
+
+// intervalUnits are the units used by $__timeInterval, from the longest to the shortest
+var intervalUnits = []intervalUnit{
+	{"year", 365 * 24 * time.Hour},
+	{"month", 30 * 24 * time.Hour},
+	{"week", 7 * 24 * time.Hour},
+	{"day", 24 * time.Hour},
+	{"hour", time.Hour},
+	{"minute", time.Minute},
+	{"second", time.Second},
+}
+
+// getIntervalUnit returns the longest unit that is not longer than the interval, limited to the units supported by timeGroup
+// if timeGroup is set
+func getIntervalUnit(interval time.Duration, timeGroup bool) string {
+	unit := "second"
+	if timeGroup {
+		unit = "minute"
+	}
+	for _, u := range intervalUnits {
+		if timeGroup && (u.name == "week" || u.name == "second") {
+			continue
+		}
+		if interval >= u.duration {
+			return u.name
+		}
+	}
+	return unit
+}
+
+// Macro to group times by the query interval, using the DriverSettings.IntervalExpression format string.
+// The format string receives the column (%[1]s), the unit of the interval (%[2]s, e.g. "minute") and the
+// interval in seconds (%[3]s). If it's not set, it uses $__timeGroup with the unit of the interval.
+// Example (for "date_trunc('%[2]s', %[1]s)"):
+//   $__timeInterval(time) => "date_trunc('minute', time)"
+func macroTimeInterval(expression string) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 1 || args[0] == "" {
+			return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+		}
+		if expression == "" {
+			return macroTimeGroup(query, []string{args[0], getIntervalUnit(query.Interval, true)})
+		}
+		seconds, err := macroIntervalSeconds(query, nil)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(expression, args[0], getIntervalUnit(query.Interval, false), seconds), nil
+	}
+}
+
+// Macro to generate a row for each interval of the query time range, e.g. to fill the gaps of a time series with a join.
+// It uses the DriverSettings.TimeSpineExpression format string, which receives the start (%[1]s) and the end (%[2]s)
+// of the time range, rounded to the interval and quoted, and the interval in seconds (%[3]s).
+// Example (for "generate_series(%[1]s::timestamptz, %[2]s::timestamptz, '%[3]s seconds'::interval)"):
+//   $__timeSpine() => "generate_series('2006-01-02T15:00:00Z'::timestamptz, '2006-01-02T16:00:00Z'::timestamptz, '60 seconds'::interval)"
+func macroTimeSpine(expression string, quote timeQuoter) MacroFunc {
+	roundFrom, roundTo := macroTimeRoundFrom(quote), macroTimeRoundTo(quote)
+	return func(query *Query, args []string) (string, error) {
+		if expression == "" {
+			return "", fmt.Errorf("%w: timeSpine requires DriverSettings.TimeSpineExpression", ErrorUnsupportedMacro)
+		}
+		from, err := roundFrom(query, nil)
+		if err != nil {
+			return "", err
+		}
+		to, err := roundTo(query, nil)
+		if err != nil {
+			return "", err
+		}
+		seconds, err := macroIntervalSeconds(query, nil)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(expression, from, to, seconds), nil
+	}
+}
+
 // Default macro to return the query table name.
 // Example:
 //   $__table => "my_table"
@@ -109,13 +702,335 @@ func macroColumn(query *Query, args []string) (string, error) {
 	return query.Column, nil
 }
 
+// Macro to quote an identifier using the quoting style defined by the driver settings (double quotes by default).
+// Example:
+//   $__quoteIdentifier(my table) => "\"my table\""
+func macroQuoteIdentifier(quote IdentifierQuote) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 1 || args[0] == "" {
+			return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+		}
+		return quote.Quote(args[0]), nil
+	}
+}
+
+// defaultAllValue is the value of the template variables when "All" is selected, if DriverSettings.AllValue is not set
+const defaultAllValue = "$__all"
+
+// Macro to skip a condition when a template variable has the "All" value.
+// It requires the condition and the variable, which may be quoted. The values of a multi-value variable are the rest
+// of the arguments.
+// Example:
+//   $__conditionalAll(col IN ('a', 'b'), 'a') => "col IN ('a', 'b')"
+//   $__conditionalAll(col IN ('a', 'b'), 'a', 'b') => "col IN ('a', 'b')"
+//   $__conditionalAll(col IN ($__all), $__all) => "1=1"
+func macroConditionalAll(allValue string) MacroFunc {
+	if allValue == "" {
+		allValue = defaultAllValue
+	}
+	return func(query *Query, args []string) (string, error) {
+		if len(args) < 2 {
+			return "", fmt.Errorf("%w: expected at least 2 arguments, received %d", ErrorBadArgumentCount, len(args))
+		}
+		if strings.Trim(strings.Join(args[1:], ","), `'"`) == allValue {
+			return "1=1", nil
+		}
+		return args[0], nil
+	}
+}
+
+// Macro to quote a list of values, e.g. for an IN clause. Values already quoted with single quotes are not quoted twice.
+// An empty list results in NULL.
+// Example:
+//   $__quoteList(a, b, 'c') => "'a','b','c'"
+//   $__quoteList() => "NULL"
+func macroQuoteList(quote func(string) string) MacroFunc {
+	if quote == nil {
+		quote = LiteralQuoteStandard.Quote
+	}
+	return func(query *Query, args []string) (string, error) {
+		if len(args) == 0 || (len(args) == 1 && args[0] == "") {
+			return "NULL", nil
+		}
+		values := make([]string, len(args))
+		for i, arg := range args {
+			if len(arg) > 1 && strings.HasPrefix(arg, "'") && strings.HasSuffix(arg, "'") {
+				arg = strings.ReplaceAll(arg[1:len(arg)-1], "''", "'")
+			}
+			values[i] = quote(arg)
+		}
+		return strings.Join(values, ","), nil
+	}
+}
+
+// likeEscaper escapes the backslashes and the LIKE wildcards of a search term, so that they match literally with ESCAPE '\'
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Default macro to filter a column by the query search term, matching any value that contains it.
+// The backslashes and wildcards in the search term are escaped with a backslash, declared with an ESCAPE clause, and the
+// pattern is quoted like the other string literals. It results in 1=1 if the search term is empty.
+// Example:
+//   $__searchFilter(name) => "name LIKE '%term%' ESCAPE '\'"
+func macroSearchFilter(quote func(string) string) MacroFunc {
+	if quote == nil {
+		quote = LiteralQuoteStandard.Quote
+	}
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 1 || args[0] == "" {
+			return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+		}
+		if query.SearchFilter == "" {
+			return "1=1", nil
+		}
+		pattern := "%" + likeEscaper.Replace(query.SearchFilter) + "%"
+		return fmt.Sprintf("%s LIKE %s ESCAPE %s", args[0], quote(pattern), quote(`\`)), nil
+	}
+}
+
+// Macro to return the schema of the query, or DriverSettings.DefaultSchema if the query doesn't define one, quoted using
+// the identifier quoting style. With an argument, it qualifies the table with the schema, omitting it if it's empty.
+// Example:
+//   $__schema() => "\"public\""
+//   $__schema(my_table) => "\"public\".my_table"
+func macroSchema(settings DriverSettings) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) > 1 {
+			return "", fmt.Errorf("%w: expected 0 or 1 arguments, received %d", ErrorBadArgumentCount, len(args))
+		}
+		schema := query.Schema
+		if schema == "" {
+			schema = settings.DefaultSchema
+		}
+		table := ""
+		if len(args) == 1 {
+			table = args[0]
+		}
+
+		switch {
+		case schema == "":
+			return table, nil
+		case table == "":
+			return settings.IdentifierQuote.Quote(schema), nil
+		default:
+			return settings.IdentifierQuote.Quote(schema) + "." + table, nil
+		}
+	}
+}
+
+// Macro to list the columns of a table, as returned by Completable.Columns, quoted using the identifier quoting style.
+// The schema of the query, or DriverSettings.DefaultSchema, is passed in the options of Columns if it's set.
+// Example:
+//   $__columns(my_table) => "\"time\", \"host\", \"value\""
+func macroColumns(completable Completable, settings DriverSettings) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 1 || args[0] == "" {
+			return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+		}
+		options := Options{"table": args[0]}
+		if schema := query.Schema; schema != "" {
+			options["schema"] = schema
+		} else if settings.DefaultSchema != "" {
+			options["schema"] = settings.DefaultSchema
+		}
+		columns, err := completable.Columns(query.Context(), options)
+		if err != nil {
+			return "", err
+		}
+		if len(columns) == 0 {
+			return "", fmt.Errorf("%w: table %s has no columns", ErrorInvalidMacroArg, args[0])
+		}
+		quoted := make([]string, len(columns))
+		for i, column := range columns {
+			quoted[i] = settings.IdentifierQuote.Quote(column)
+		}
+		return strings.Join(quoted, ", "), nil
+	}
+}
+
+// Macro to pass the variables of the query as a JSON object, quoted as a string literal. It results in '{}' if there are no variables.
+// Example:
+//   $__varsJson() => "'{"host":"a","region":"eu"}'"
+func macroVarsJSON(quote func(string) string) MacroFunc {
+	if quote == nil {
+		quote = LiteralQuoteStandard.Quote
+	}
+	return func(query *Query, args []string) (string, error) {
+		if len(args) > 1 || (len(args) == 1 && args[0] != "") {
+			return "", fmt.Errorf("%w: expected 0 arguments, received %d", ErrorBadArgumentCount, len(args))
+		}
+		variables := query.Variables
+		if variables == nil {
+			variables = map[string]string{}
+		}
+		var b strings.Builder
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(variables); err != nil {
+			return "", err
+		}
+		return quote(strings.TrimSuffix(b.String(), "\n")), nil
+	}
+}
+
+// Macro to inline the SQL of a named fragment of DriverSettings.QueryFragments, e.g. to share a CTE between panels.
+// The macros of the fragment are applied too. Unknown fragments are left as they are, or fail with ErrUnknownMacro if
+// DriverSettings.StrictMacros is set.
+// Example:
+//   $__fragment(hosts) => "select name from hosts where $__timeFilter(time)"
+func macroFragment(fragments map[string]string, strict bool) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 1 || args[0] == "" {
+			return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+		}
+		fragment, ok := fragments[args[0]]
+		if !ok {
+			if strict {
+				return "", fmt.Errorf("%w: fragment %s", ErrUnknownMacro, args[0])
+			}
+			return "", errKeepMacro
+		}
+		return fragment, nil
+	}
+}
+
+// Macro to return the RefID of the query, quoted as a string literal, e.g. to tell the queries apart in the database logs.
+// Example:
+//   $__refId() => "'A'"
+func macroRefID(quote func(string) string) MacroFunc {
+	if quote == nil {
+		quote = LiteralQuoteStandard.Quote
+	}
+	return func(query *Query, args []string) (string, error) {
+		return quote(query.RefID), nil
+	}
+}
+
+// Macro to return the row limit of the query, or the default given as argument if the query doesn't set it.
+// The limit is clamped to DriverSettings.MaxLimit if set.
+// Example:
+//   $__limit(100) => "100"
+func macroLimit(maxLimit int) MacroFunc {
+	return func(query *Query, args []string) (string, error) {
+		if len(args) > 1 {
+			return "", fmt.Errorf("%w: expected 0 or 1 arguments, received %d", ErrorBadArgumentCount, len(args))
+		}
+		limit := query.Limit
+		if MacroArgString(args, 0, "") != "" || limit <= 0 {
+			def, err := MacroArgInt(args, 0)
+			if err != nil {
+				return "", err
+			}
+			if def < 0 {
+				return "", fmt.Errorf("%w: the default limit can't be negative, received %d", ErrorInvalidMacroArg, def)
+			}
+			if limit <= 0 {
+				limit = def
+			}
+		}
+		if maxLimit > 0 && limit > maxLimit {
+			limit = maxLimit
+		}
+		return strconv.Itoa(limit), nil
+	}
+}
+
+// Macro to write a boolean variable as a boolean literal. true, 1 and yes (in any case, optionally quoted) are the
+// DriverSettings.TrueLiteral, and false, 0 and no are the DriverSettings.FalseLiteral (TRUE and FALSE by default).
+// Example:
+//   $__bool(yes) => "TRUE"
+//   $__bool('0') => "FALSE"
+func macroBool(trueLiteral, falseLiteral string) MacroFunc {
+	if trueLiteral == "" {
+		trueLiteral = "TRUE"
+	}
+	if falseLiteral == "" {
+		falseLiteral = "FALSE"
+	}
+	return func(query *Query, args []string) (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("%w: expected 1 argument, received %d", ErrorBadArgumentCount, len(args))
+		}
+		switch strings.ToLower(strings.Trim(args[0], `'"`)) {
+		case "true", "1", "yes":
+			return trueLiteral, nil
+		case "false", "0", "no":
+			return falseLiteral, nil
+		}
+		return "", fmt.Errorf("%w: %q is not a boolean", ErrorInvalidMacroArg, args[0])
+	}
+}
+
+// settingsMacros returns the default macros that depend on the driver settings
+func settingsMacros(settings DriverSettings) Macros {
+	macros := Macros{
+		"quoteIdentifier": macroQuoteIdentifier(settings.IdentifierQuote),
+		"conditionalAll":  macroConditionalAll(settings.AllValue),
+		"quoteList":       macroQuoteList(settings.QuoteLiteral),
+		"schema":          macroSchema(settings),
+		"varsJson":        macroVarsJSON(settings.QuoteLiteral),
+		"refId":           macroRefID(settings.QuoteLiteral),
+		"limit":           macroLimit(settings.MaxLimit),
+		"bool":            macroBool(settings.TrueLiteral, settings.FalseLiteral),
+		"searchFilter":    WithNamedArgs(macroSearchFilter(settings.QuoteLiteral), "column"),
+		"timeFilter":      WithNamedArgs(macroTimeFilter(settings.QuoteLiteralTime), "column", "cast"),
+		"timeShift":       WithNamedArgs(macroTimeShift(settings.QuoteLiteralTime), "column", "offset"),
+		"timeFrom":        WithNamedArgs(macroTimeFrom(settings.QuoteLiteralTime), "column"),
+		"timeTo":          WithNamedArgs(macroTimeTo(settings.QuoteLiteralTime), "column"),
+		"timeRoundFrom":   macroTimeRoundFrom(settings.QuoteLiteralTime),
+		"timeRoundTo":     macroTimeRoundTo(settings.QuoteLiteralTime),
+		"now":             macroNow(settings.QuoteLiteralTime),
+		"timeSpine":       macroTimeSpine(settings.TimeSpineExpression, settings.QuoteLiteralTime),
+		"fragment":        macroFragment(settings.QueryFragments, settings.StrictMacros),
+		"timeInterval":    WithNamedArgs(macroTimeInterval(settings.IntervalExpression), "column"),
+	}
+	if settings.QuoteIdentifiers {
+		macros["table"] = func(query *Query, args []string) (string, error) {
+			return settings.IdentifierQuote.Quote(query.Table), nil
+		}
+		macros["column"] = func(query *Query, args []string) (string, error) {
+			return settings.IdentifierQuote.Quote(query.Column), nil
+		}
+	}
+	return macros
+}
+
 var DefaultMacros Macros = Macros{
-	"timeFilter": macroTimeFilter,
-	"timeFrom":   macroTimeFrom,
-	"timeGroup":  macroTimeGroup,
-	"timeTo":     macroTimeTo,
-	"table":      macroTable,
-	"column":     macroColumn,
+	"timeFilterMs":    WithNamedArgs(macroTimeFilterMs, "column"),
+	"timeGroup":       WithNamedArgs(macroTimeGroup, "column", "interval"),
+	"timeGroupAlias":  WithNamedArgs(macroTimeGroupAlias, "column", "interval", "alias"),
+	"timeGroupAgg":    WithNamedArgs(macroTimeGroupAgg, "column", "interval", "aggregation", "alias"),
+	"nowEpoch":        macroNowEpoch,
+	"table":           macroTable,
+	"column":          macroColumn,
+	"unixEpochFilter": WithNamedArgs(macroUnixEpochFilter, "column"),
+	"unixEpochFrom":   macroUnixEpochFrom,
+	"unixEpochTo":     macroUnixEpochTo,
+	"interval_s":      macroIntervalSeconds,
+	"interval_ms":     macroIntervalMilliseconds,
+	"maxDataPoints":   macroMaxDataPoints,
+	"bucketCount":     macroBucketCount,
+	"arg":             macroArg,
+}
+
+// MacroArgInt returns the argument at index idx of a macro as an integer.
+// It returns ErrorBadArgumentCount if the argument is missing or empty, and ErrorInvalidMacroArg if it's not an integer.
+func MacroArgInt(args []string, idx int) (int, error) {
+	if idx < 0 || idx >= len(args) || args[idx] == "" {
+		return 0, fmt.Errorf("%w: missing argument at index %d", ErrorBadArgumentCount, idx)
+	}
+	v, err := strconv.Atoi(args[idx])
+	if err != nil {
+		return 0, fmt.Errorf("%w: argument at index %d must be an integer, received %q", ErrorInvalidMacroArg, idx, args[idx])
+	}
+	return v, nil
+}
+
+// MacroArgString returns the argument at index idx of a macro, or def if the argument is missing or empty
+func MacroArgString(args []string, idx int, def string) string {
+	if idx < 0 || idx >= len(args) || args[idx] == "" {
+		return def
+	}
+	return args[idx]
 }
 
 func trimAll(s []string) []string {
@@ -127,22 +1042,337 @@ func trimAll(s []string) []string {
 	return r
 }
 
-func getMacroRegex(name string) string {
-	return fmt.Sprintf("\\$__%s\\b(?:\\((.*?\\)?)\\))?", name)
+func getMacroRegex(prefix, name string) string {
+	return fmt.Sprintf("%s%s\\b", regexp.QuoteMeta(prefix), name)
+}
+
+// findArgsEnd returns the index of the parenthesis closing the one at rawSQL[start].
+// Parentheses within single or double quotes are ignored.
+func findArgsEnd(rawSQL string, start int) (int, error) {
+	var (
+		quote rune
+		depth int
+	)
+	for i, c := range rawSQL[start:] {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return start + i, nil
+			}
+		}
+	}
+	if quote != 0 {
+		return 0, fmt.Errorf("unterminated quote %q", quote)
+	}
+	return 0, errors.New("missing closing parenthesis")
+}
+
+// splitArgs splits the macro arguments by commas, except for the ones within quotes or parentheses.
+// The arguments are returned as written, including the quotes.
+func splitArgs(rawArgs string) []string {
+	var (
+		args  []string
+		quote rune
+		depth int
+		start int
+	)
+	for i, c := range rawArgs {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, rawArgs[start:i])
+			start = i + 1
+		}
+	}
+	return append(args, rawArgs[start:])
+}
+
+var macroNameRegex = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// ValidateMacros checks that the macro names are not empty, don't include the prefix and only contain letters, digits and underscores
+func ValidateMacros(macros Macros) error {
+	for _, name := range sortedMacroNames(macros) {
+		if strings.HasPrefix(name, defaultMacroPrefix) {
+			return fmt.Errorf("%w: %q must not include the %s prefix", ErrorInvalidMacroName, name, defaultMacroPrefix)
+		}
+		if !macroNameRegex.MatchString(name) {
+			return fmt.Errorf("%w: %q must only contain letters, digits and underscores", ErrorInvalidMacroName, name)
+		}
+	}
+	return nil
+}
+
+// RegisterMacros returns a new Macros containing the base and the extra macros.
+// If both define a macro with the same name, the one in extra is used.
+func RegisterMacros(base Macros, extra Macros) Macros {
+	macros := make(Macros, len(base)+len(extra))
+	for key, macro := range base {
+		macros[key] = macro
+	}
+	for key, macro := range extra {
+		macros[key] = macro
+	}
+	return macros
+}
+
+// UnknownMacroError is the error returned when DriverSettings.StrictMacros is set and the query contains macros that are
+// not defined. It matches ErrUnknownMacro with errors.Is.
+type UnknownMacroError struct {
+	// Names are the sorted names of the unknown macros, without the prefix
+	Names []string
+}
+
+func (e *UnknownMacroError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrUnknownMacro, strings.Join(e.Names, ", "))
+}
+
+func (e *UnknownMacroError) Unwrap() error {
+	return ErrUnknownMacro
 }
 
 // Interpolate returns an interpolated query string given a backend.DataQuery
 func Interpolate(driver Driver, query *Query) (string, error) {
-	macros := driver.Macros()
-	for key, defaultMacro := range DefaultMacros {
-		if _, ok := macros[key]; !ok {
-			// If the driver doesn't define some macro, use the default one
-			macros[key] = defaultMacro
+	return InterpolateContext(context.Background(), driver, query)
+}
+
+// InterpolateContext is like Interpolate, but the interpolation stops if the context is done.
+// Macros can access the context through query.Context().
+// It uses the default DriverSettings, so the returned SQL has question marks for the $__arg macros, without their values.
+// Use InterpolateStatement to interpolate with the settings of a datasource instance and get the values.
+func InterpolateContext(ctx context.Context, driver Driver, query *Query) (string, error) {
+	rawSQL, _, err := InterpolateStatement(ctx, driver, DriverSettings{}, query)
+	return rawSQL, err
+}
+
+// InterpolateStatement interpolates the query with the given settings, e.g. the ones returned by Driver.Settings for the
+// datasource instance. It returns the SQL with the placeholders of the $__arg macros written as defined by
+// DriverSettings.PlaceholderStyle, and the values of the bind parameters in the order of the placeholders.
+func InterpolateStatement(ctx context.Context, driver Driver, settings DriverSettings, query *Query) (string, []interface{}, error) {
+	rawSQL, err := interpolateMacros(driver, settings, driver.Macros(), query.WithContext(ctx))
+	rawSQL, args := bindStatement(settings, rawSQL, query.Args)
+	return rawSQL, args, err
+}
+
+// interpolateMacros applies the given macros, falling back to the DefaultMacros for the ones not defined
+func interpolateMacros(driver Driver, settings DriverSettings, macros Macros, query *Query) (string, error) {
+	if query.SkipInterpolation {
+		return query.RawSQL, nil
+	}
+
+	// If the driver doesn't define some macro, use the default one
+	macros = RegisterMacros(defaultMacros(driver, settings), macros)
+	prefix := getMacroPrefix(driver)
+	handler, hasHandler := driver.(DefaultMacroHandler)
+	if hasHandler {
+		macros, _ = withDefaultMacro(handler, macros, prefix, query.RawSQL, query.Table, query.Column)
+	}
+
+	query, err := interpolateFields(macros, prefix, query)
+	if err != nil {
+		return query.RawSQL, err
+	}
+
+	rawSQL := query.RawSQL
+	var comments []string
+	if settings.IgnoreCommentedMacros {
+		rawSQL, comments = maskComments(rawSQL)
+	}
+
+	rawSQL, err = interpolate(macros, prefix, query, rawSQL, 0)
+	// The results of the macros can call other unknown macros
+	for depth := 0; hasHandler && err == nil && depth < maxMacroDepth; depth++ {
+		var added bool
+		if macros, added = withDefaultMacro(handler, macros, prefix, rawSQL); !added {
+			break
+		}
+		rawSQL, err = interpolate(macros, prefix, query, rawSQL, 0)
+	}
+	if err == nil && settings.StrictMacros {
+		if unknown := getUnknownMacros(prefix, rawSQL); len(unknown) > 0 {
+			err = &UnknownMacroError{Names: unknown}
 		}
 	}
+	return unmaskComments(rawSQL, comments), err
+}
+
+// MacroError is an error found when validating the macros of a query
+type MacroError struct {
+	// Macro is the name of the macro, without the prefix
+	Macro string `json:"macro"`
+	// Offset is the byte offset of the macro in the query
+	Offset  int    `json:"offset"`
+	Message string `json:"message"`
+}
+
+// validateMacros checks that every macro in the query is defined and that its arguments can be parsed, without
+// interpolating the query. The checked macros, which must not run SQL or look up the database, are also called with
+// their parsed arguments to check their number and values, except if the arguments contain other macros, which are only
+// known once those are applied. The macros within comments are ignored if ignoreComments is set. Unknown macros are not
+// reported if allowUnknown is set (e.g. if the driver handles them with DefaultMacroHandler).
+func validateMacros(macros Macros, checked Macros, prefix string, query *Query, ignoreComments, allowUnknown bool) []MacroError {
 	rawSQL := query.RawSQL
-	for key, macro := range macros {
-		matches, err := getMatches(key, rawSQL)
+	var comments [][]int
+	if ignoreComments {
+		comments = findComments(rawSQL)
+	}
+	inComment := func(offset int) bool {
+		for _, loc := range comments {
+			if offset >= loc[0] && offset < loc[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	errs := []MacroError{}
+	rgx := regexp.MustCompile(regexp.QuoteMeta(prefix) + `(\w+)`)
+	for _, loc := range rgx.FindAllStringSubmatchIndex(rawSQL, -1) {
+		if inComment(loc[0]) {
+			continue
+		}
+		name := rawSQL[loc[2]:loc[3]]
+		if _, ok := macros[name]; !ok && !allowUnknown {
+			errs = append(errs, MacroError{Macro: name, Offset: loc[0], Message: ErrUnknownMacro.Error()})
+			continue
+		}
+		call := &MacroCall{Name: name, Match: rawSQL[loc[0]:loc[1]]}
+		args := []string{}
+		if loc[1] < len(rawSQL) && rawSQL[loc[1]] == '(' {
+			end, err := findArgsEnd(rawSQL, loc[1])
+			if err != nil {
+				errs = append(errs, MacroError{Macro: name, Offset: loc[0], Message: fmt.Sprintf("%s: %s", ErrorParsingMacroArgs, err)})
+				continue
+			}
+			rawArgs := rawSQL[loc[1]+1 : end]
+			args = trimAll(splitArgs(rawArgs))
+			call.Match = rawSQL[loc[0] : end+1]
+			call.HasParens = true
+			if strings.TrimSpace(rawArgs) != "" {
+				call.NumArgs = len(args)
+			}
+		}
+		macro, ok := checked[name]
+		if !ok || strings.Contains(strings.Join(args, ","), prefix) {
+			continue
+		}
+
+		macroQuery := query.WithSQL(rawSQL)
+		macroQuery.macroCall = call
+		if _, err := applyMacro(macro, macroQuery, args); err != nil && !errors.Is(err, errKeepMacro) {
+			errs = append(errs, MacroError{Macro: name, Offset: loc[0], Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+// interpolateFields returns a copy of the query with the macros applied to its Table and Column, which can be built from
+// templates, so that the macros reading them get the final values. Fields referring to themselves (e.g. a Table
+// containing $__table) fail with ErrorMacroDepth.
+func interpolateFields(macros Macros, prefix string, query *Query) (*Query, error) {
+	if !strings.Contains(query.Table, prefix) && !strings.Contains(query.Column, prefix) {
+		return query, nil
+	}
+	interpolated := *query
+	for _, field := range []*string{&interpolated.Table, &interpolated.Column} {
+		if !strings.Contains(*field, prefix) {
+			continue
+		}
+		res, err := interpolate(macros, prefix, query, *field, 1)
+		if err != nil {
+			return query, err
+		}
+		*field = res
+	}
+	return &interpolated, nil
+}
+
+var commentMarkerRegex = regexp.MustCompile("\x00comment:([0-9]+)\x00")
+
+// maskComments replaces the comments in rawSQL with markers, so that the macros within them are not applied
+func maskComments(rawSQL string) (string, []string) {
+	var (
+		comments []string
+		masked   strings.Builder
+		start    int
+	)
+	for _, loc := range findComments(rawSQL) {
+		masked.WriteString(rawSQL[start:loc[0]])
+		masked.WriteString(fmt.Sprintf("\x00comment:%d\x00", len(comments)))
+		comments = append(comments, rawSQL[loc[0]:loc[1]])
+		start = loc[1]
+	}
+	masked.WriteString(rawSQL[start:])
+	return masked.String(), comments
+}
+
+// unmaskComments restores the comments replaced by maskComments
+func unmaskComments(rawSQL string, comments []string) string {
+	if len(comments) == 0 {
+		return rawSQL
+	}
+	return commentMarkerRegex.ReplaceAllStringFunc(rawSQL, func(marker string) string {
+		i, err := strconv.Atoi(commentMarkerRegex.FindStringSubmatch(marker)[1])
+		if err != nil || i >= len(comments) {
+			return marker
+		}
+		return comments[i]
+	})
+}
+
+// getMacroNames returns the sorted names of the macros called in rawSQL
+func getMacroNames(prefix, rawSQL string) []string {
+	rgx := regexp.MustCompile(regexp.QuoteMeta(prefix) + `(\w+)`)
+	seen := map[string]bool{}
+	names := []string{}
+	for _, match := range rgx.FindAllStringSubmatch(rawSQL, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			names = append(names, match[1])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getUnknownMacros returns the sorted names of the macros left in the interpolated rawSQL, ignoring the ones within
+// string literals, quoted identifiers and comments, which are not sent to the database as macros
+func getUnknownMacros(prefix, rawSQL string) []string {
+	var code strings.Builder
+	for i := 0; i < len(rawSQL); i++ {
+		if end, _ := skipToken(rawSQL, i); end > i {
+			code.WriteString(" ")
+			i = end - 1
+			continue
+		}
+		code.WriteByte(rawSQL[i])
+	}
+	return getMacroNames(prefix, code.String())
+}
+
+// interpolate applies the macros to rawSQL. Macros found in the arguments of another macro, or in
+// the result of a macro, are expanded recursively up to maxMacroDepth.
+func interpolate(macros Macros, prefix string, query *Query, rawSQL string, depth int) (string, error) {
+	for _, key := range sortedMacroNames(macros) {
+		macro := macros[key]
+		matches, err := getMatches(prefix, key, rawSQL)
 		if err != nil {
 			return rawSQL, err
 		}
@@ -151,14 +1381,43 @@ func Interpolate(driver Driver, query *Query) (string, error) {
 				// There were no matches for this macro
 				continue
 			}
+			if err := query.Context().Err(); err != nil {
+				return rawSQL, err
+			}
+			if depth >= maxMacroDepth {
+				return rawSQL, fmt.Errorf("%w: %s", ErrorMacroDepth, key)
+			}
 
 			args := []string{}
 			if len(match) > 1 {
 				// This macro has arguments
-				args = trimAll(strings.Split(match[1], ","))
+				args = trimAll(splitArgs(match[1]))
+			}
+			for i, arg := range args {
+				args[i], err = interpolate(macros, prefix, query, arg, depth+1)
+				if err != nil {
+					return rawSQL, err
+				}
+			}
+
+			macroQuery := query.WithSQL(rawSQL)
+			macroQuery.macroCall = &MacroCall{
+				Name:      key,
+				Match:     match[0],
+				HasParens: len(match[0]) > len(prefix)+len(key),
+			}
+			if macroQuery.macroCall.HasParens && strings.TrimSpace(match[1]) != "" {
+				macroQuery.macroCall.NumArgs = len(args)
 			}
 
-			res, err := macro(query.WithSQL(rawSQL), args)
+			res, err := applyMacro(macro, macroQuery, args)
+			if errors.Is(err, errKeepMacro) {
+				continue
+			}
+			if err != nil {
+				return rawSQL, macroError(query, key, match[0], rawSQL, err)
+			}
+			res, err = interpolate(macros, prefix, query, res, depth+1)
 			if err != nil {
 				return rawSQL, err
 			}
@@ -171,10 +1430,66 @@ func Interpolate(driver Driver, query *Query) (string, error) {
 	return rawSQL, nil
 }
 
-func getMatches(macroName, rawSQL string) ([][]string, error) {
-	rgx, err := regexp.Compile(getMacroRegex(macroName))
+// sortedMacroNames returns the macro names, longest first, so that the result doesn't depend on the map order
+// and macros whose name starts with the name of another macro are applied first (e.g. timeFilterMs before timeFilter)
+func sortedMacroNames(macros Macros) []string {
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) > len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// applyMacro calls the macro, recovering from any panic so a faulty macro doesn't crash the plugin
+func applyMacro(macro MacroFunc, query *Query, args []string) (res string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrorMacroPanic, r)
+		}
+	}()
+	return macro(query, args)
+}
+
+// macroError adds the macro name and the byte offset where it appears in the query to err.
+// If the macro is the result of another macro, the offset refers to the partially interpolated rawSQL.
+func macroError(query *Query, name, match, rawSQL string, err error) error {
+	offset := strings.Index(query.RawSQL, match)
+	if offset < 0 {
+		offset = strings.Index(rawSQL, match)
+	}
+	return fmt.Errorf("macro %s at offset %d: %w", name, offset, err)
+}
+
+// getMatches returns, for every occurrence of the macro, the full matched string and its raw arguments
+func getMatches(prefix, macroName, rawSQL string) ([][]string, error) {
+	rgx, err := regexp.Compile(getMacroRegex(prefix, macroName))
 	if err != nil {
 		return nil, err
 	}
-	return rgx.FindAllStringSubmatch(rawSQL, -1), nil
+	var matches [][]string
+	end := 0
+	for _, loc := range rgx.FindAllStringIndex(rawSQL, -1) {
+		if loc[0] < end {
+			// This occurrence is within the arguments of the previous one
+			continue
+		}
+		end = loc[1]
+		if end >= len(rawSQL) || rawSQL[end] != '(' {
+			matches = append(matches, []string{rawSQL[loc[0]:end], ""})
+			continue
+		}
+		argsEnd, err := findArgsEnd(rawSQL, end)
+		if err != nil {
+			return nil, fmt.Errorf("%w: macro %s at offset %d: %s", ErrorParsingMacroArgs, macroName, loc[0], err.Error())
+		}
+		matches = append(matches, []string{rawSQL[loc[0] : argsEnd+1], rawSQL[end+1 : argsEnd]})
+		end = argsEnd + 1
+	}
+	return matches, nil
 }
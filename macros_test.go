@@ -1,7 +1,10 @@
 package sqlds
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,6 +31,36 @@ func (h *MockDB) Macros() (macros Macros) {
 			}
 			return "bar", nil
 		},
+		"args": func(query *Query, args []string) (out string, err error) {
+			return strings.Join(args, "|"), nil
+		},
+		"required": func(query *Query, args []string) (out string, err error) {
+			if args[0] == "" {
+				return "", fmt.Errorf("%w: expected 1 argument", ErrorBadArgumentCount)
+			}
+			return args[0], nil
+		},
+		"index": func(query *Query, args []string) (out string, err error) {
+			return args[5], nil
+		},
+		"slow": func(query *Query, args []string) (out string, err error) {
+			select {
+			case <-query.Context().Done():
+				return "", query.Context().Err()
+			case <-time.After(5 * time.Second):
+				return "slow", nil
+			}
+		},
+		"parens": func(query *Query, args []string) (out string, err error) {
+			call := query.MacroCall()
+			if !call.HasParens {
+				return "no_parens", nil
+			}
+			return fmt.Sprintf("parens_%d", call.NumArgs), nil
+		},
+		"self": func(query *Query, args []string) (out string, err error) {
+			return "$__self", nil
+		},
 		// overwrite a default macro
 		"timeGroup": func(query *Query, args []string) (out string, err error) {
 			return "grouped!", nil
@@ -39,13 +72,22 @@ func (h *MockDB) Timeout(backend.DataSourceInstanceSettings) time.Duration {
 	return time.Minute
 }
 
+func (h *MockDB) Settings(backend.DataSourceInstanceSettings) DriverSettings {
+	return DriverSettings{}
+}
+
 func TestInterpolate(t *testing.T) {
 	tableName := "my_table"
 	tableColumn := "my_col"
+	hourRange := backend.TimeRange{From: time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC), To: time.Date(2021, 7, 1, 11, 0, 0, 0, time.UTC)}
 	type test struct {
-		name   string
-		input  string
-		output string
+		name      string
+		input     string
+		output    string
+		interval  time.Duration
+		maxData   int64
+		timeRange backend.TimeRange
+		refID     string
 	}
 	tests := []test{
 		{input: "select * from foo", output: "select * from foo", name: "macro with incorrect syntax"},
@@ -66,14 +108,57 @@ func TestInterpolate(t *testing.T) {
 		{input: "select * from foo where $__timeFrom(cast(sth as timestamp))", output: "select * from foo where cast(sth as timestamp) >= '0001-01-01T00:00:00Z'", name: "default timeFrom macro"},
 		{input: "select * from foo where $__timeGroup(time,minute)", output: "select * from foo where grouped!", name: "overriden timeGroup macro"},
 		{input: "select $__column from $__table", output: "select my_col from my_table", name: "table and column macros"},
+		{input: "select * from $__table where $__timeFilter($__column)", output: "select * from my_table where my_col >= '0001-01-01T00:00:00Z' AND my_col <= '0001-01-01T00:00:00Z'", name: "nested column macro as argument"},
+		{input: "select * from foo where $__params($__table)", output: "select * from foo where bar_my_table", name: "nested table macro as argument"},
+		{input: "select $__args('a,b', c)", output: "select 'a,b'|c", name: "comma within single quotes"},
+		{input: `select $__args("a,b", c)`, output: `select "a,b"|c`, name: "comma within double quotes"},
+		{input: "select $__args(func(x,y))", output: "select func(x,y)", name: "comma within parentheses"},
+		{input: "select $__args(a, cast(x as int), 'b)')", output: "select a|cast(x as int)|'b)'", name: "parentheses within quotes"},
+		{input: "select $__parens", output: "select no_parens", name: "macro called without parentheses"},
+		{input: "select $__parens()", output: "select parens_0", name: "macro called with empty parentheses"},
+		{input: "select $__parens(a, b)", output: "select parens_2", name: "macro called with arguments"},
+		{input: "select $__timeGroupAlias(time,day)", output: `select datepart(day, time),datepart(month, time),datepart(year, time) AS "time"`, name: "default timeGroupAlias"},
+		{input: "select $__timeGroupAlias(time,hour,ts)", output: `select datepart(hour, time),datepart(day, time),datepart(month, time),datepart(year, time) AS "ts"`, name: "timeGroupAlias with custom alias"},
+		{input: "select $__timeGroupAgg(time, day, avg(value), value) from t", output: `select datepart(day, time),datepart(month, time),datepart(year, time) AS "time", avg(value) AS "value" from t`, name: "timeGroupAgg"},
+		{input: "select $__timeGroupAgg(time, hour, coalesce(sum(a), 0), total)", output: `select datepart(hour, time),datepart(day, time),datepart(month, time),datepart(year, time) AS "time", coalesce(sum(a), 0) AS "total"`, name: "timeGroupAgg with nested aggregation"},
+		{input: "select $__interval_s()", output: "select 30", interval: 30 * time.Second, name: "interval in seconds"},
+		{input: "select $__interval_s()", output: "select 1", name: "zero interval in seconds"},
+		{input: "select $__interval_ms()", output: "select 30000", interval: 30 * time.Second, name: "interval in milliseconds"},
+		{input: "select $__interval_ms()", output: "select 1", name: "zero interval in milliseconds"},
+		{input: "select 1 limit $__maxDataPoints()", output: "select 1 limit 1500", maxData: 1500, name: "max data points"},
+		{input: "select 1 limit $__maxDataPoints()", output: "select 1 limit 100", name: "default max data points"},
+		{input: "limit $__bucketCount()", output: "limit 12", interval: 5 * time.Minute, timeRange: hourRange, name: "bucket count"},
+		{input: "limit $__bucketCount()", output: "limit 13", interval: 299 * time.Second, timeRange: hourRange, name: "bucket count rounded up"},
+		{input: "limit $__bucketCount()", output: "limit 10", interval: 5 * time.Minute, maxData: 10, timeRange: hourRange, name: "bucket count limited by max data points"},
+		{input: "limit $__bucketCount()", output: "limit 1", timeRange: hourRange, name: "bucket count without interval"},
+		{input: "limit $__bucketCount()", output: "limit 50", maxData: 50, timeRange: hourRange, name: "bucket count without interval with max data points"},
+		{input: "limit $__bucketCount()", output: "limit 1", interval: 5 * time.Minute, name: "bucket count with empty time range"},
+		{input: "where $__timeFilterMs(ts)", output: "where ts >= 1625133600000 AND ts <= 1625137200000", timeRange: hourRange, name: "time filter in milliseconds"},
+		{input: "where $__timeFilter(time) and $__timeFilterMs(ts)", output: "where time >= '2021-07-01T10:00:00Z' AND time <= '2021-07-01T11:00:00Z' and ts >= 1625133600000 AND ts <= 1625137200000", timeRange: hourRange, name: "time filter in milliseconds with time filter"},
+		{input: "select $__refId() as ref", output: "select 'A' as ref", refID: "A", name: "query RefID"},
+		{input: "select 1 /* $__refId() */", output: "select 1 /* 'it''s' */", refID: "it's", name: "query RefID with quotes"},
+		{input: "select $__refId() as ref", output: "select '' as ref", name: "empty query RefID"},
+		{input: "where $__timeShift(time, -7d)", output: "where time >= '2021-06-24T10:00:00Z' AND time <= '2021-06-24T11:00:00Z'", timeRange: hourRange, name: "time shift in days"},
+		{input: "where $__timeShift(time, -168h)", output: "where time >= '2021-06-24T10:00:00Z' AND time <= '2021-06-24T11:00:00Z'", timeRange: hourRange, name: "time shift in hours"},
+		{input: "where $__timeShift(time, '1w')", output: "where time >= '2021-07-08T10:00:00Z' AND time <= '2021-07-08T11:00:00Z'", timeRange: hourRange, name: "quoted time shift in weeks"},
+		{input: "where $__timeShift(time, 1h30m)", output: "where time >= '2021-07-01T11:30:00Z' AND time <= '2021-07-01T12:30:00Z'", timeRange: hourRange, name: "time shift in hours and minutes"},
+		{input: "where $__timeFilter(time, timestamptz)", output: "where CAST(time AS timestamptz) >= CAST('2021-07-01T10:00:00Z' AS timestamptz) AND CAST(time AS timestamptz) <= CAST('2021-07-01T11:00:00Z' AS timestamptz)", timeRange: hourRange, name: "time filter with cast"},
+		{input: "where $__timeFilter(column=time, cast=timestamp(3))", output: "where CAST(time AS timestamp(3)) >= CAST('2021-07-01T10:00:00Z' AS timestamp(3)) AND CAST(time AS timestamp(3)) <= CAST('2021-07-01T11:00:00Z' AS timestamp(3))", timeRange: hourRange, name: "time filter with named cast"},
+		{input: "where ts <= $__now()", output: "where ts <= '2021-07-01T11:00:00Z'", timeRange: hourRange, name: "now"},
+		{input: "where ts <= $__nowEpoch()", output: "where ts <= 1625137200", timeRange: hourRange, name: "now as epoch seconds"},
+		{input: "select $__now() as a, $__now as b", output: "select '2021-07-01T11:00:00Z' as a, '2021-07-01T11:00:00Z' as b", timeRange: hourRange, name: "now without parentheses"},
 	}
 	for i, tc := range tests {
 		driver := MockDB{}
 		t.Run(fmt.Sprintf("[%d/%d] %s", i+1, len(tests), tc.name), func(t *testing.T) {
 			query := &Query{
-				RawSQL: tc.input,
-				Table:  tableName,
-				Column: tableColumn,
+				RawSQL:        tc.input,
+				Table:         tableName,
+				Column:        tableColumn,
+				Interval:      tc.interval,
+				MaxDataPoints: tc.maxData,
+				TimeRange:     tc.timeRange,
+				RefID:         tc.refID,
 			}
 			interpolatedQuery, err := Interpolate(&driver, query)
 			require.Nil(t, err)
@@ -82,23 +167,998 @@ func TestInterpolate(t *testing.T) {
 	}
 }
 
+func TestInterpolate_skipInterpolation(t *testing.T) {
+	driver := MockDB{}
+	query := &Query{RawSQL: "select $__foo, $__unknown() from t where $__timeFilter(t)", SkipInterpolation: true}
+	interpolatedQuery, err := Interpolate(&driver, query)
+	require.NoError(t, err)
+	assert.Equal(t, query.RawSQL, interpolatedQuery)
+}
+
+func TestInterpolate_timeShiftErrors(t *testing.T) {
+	driver := MockDB{}
+	for _, tc := range []struct {
+		input string
+		err   error
+	}{
+		{"$__timeShift(time, -7days)", ErrorInvalidMacroArg},
+		{"$__timeShift(time, yesterday)", ErrorInvalidMacroArg},
+		{"$__timeShift(time)", ErrorBadArgumentCount},
+		{"$__timeShift(time, )", ErrorBadArgumentCount},
+	} {
+		_, err := Interpolate(&driver, &Query{RawSQL: tc.input})
+		assert.ErrorIs(t, err, tc.err, tc.input)
+	}
+}
+
+func TestInterpolate_timeGroupAliasErrors(t *testing.T) {
+	driver := MockDB{}
+	for _, input := range []string{"$__timeGroupAlias(time)", "$__timeGroupAlias(time, )"} {
+		_, err := Interpolate(&driver, &Query{RawSQL: input})
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorBadArgumentCount)
+		assert.Contains(t, err.Error(), "timeGroupAlias")
+	}
+}
+
+func TestInterpolate_timeGroupAggErrors(t *testing.T) {
+	driver := MockDB{}
+	for _, input := range []string{"$__timeGroupAgg(time, day)", "$__timeGroupAgg(time, day, avg(value))", "$__timeGroupAgg(time, day, , value)", "$__timeGroupAgg(time, , avg(value), value)"} {
+		_, err := Interpolate(&driver, &Query{RawSQL: input})
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorBadArgumentCount)
+		assert.Contains(t, err.Error(), "timeGroupAgg")
+	}
+}
+
+func TestInterpolate_namedArgs(t *testing.T) {
+	driver := MockDB{}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{name: "named timeFilter", input: "$__timeFilter(column=ts)", output: "ts >= '0001-01-01T00:00:00Z' AND ts <= '0001-01-01T00:00:00Z'"},
+		{name: "named timeGroupAlias", input: "$__timeGroupAlias(alias = t, column = time, interval = day)", output: `datepart(day, time),datepart(month, time),datepart(year, time) AS "t"`},
+		{name: "named timeGroupAlias without optional argument", input: "$__timeGroupAlias(column=time, interval=year)", output: `datepart(year, time) AS "time"`},
+		{name: "positional timeGroupAlias", input: "$__timeGroupAlias(time, year, t)", output: `datepart(year, time) AS "t"`},
+		{name: "positional argument containing an equals sign", input: "$__timeFrom(a=b)", output: "a=b >= '0001-01-01T00:00:00Z'"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := Interpolate(&driver, &Query{RawSQL: tc.input})
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+
+	t.Run("mixed arguments", func(t *testing.T) {
+		_, err := Interpolate(&driver, &Query{RawSQL: "$__timeGroupAlias(time, interval=day)"})
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorMixedMacroArgs)
+		assert.Contains(t, err.Error(), "timeGroupAlias")
+	})
+}
+
+func TestInterpolate_selfReferencingMacro(t *testing.T) {
+	driver := MockDB{}
+	_, err := Interpolate(&driver, &Query{RawSQL: "select * from $__self"})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrorMacroDepth)
+	assert.Contains(t, err.Error(), "self")
+}
+
+func TestInterpolate_errorContext(t *testing.T) {
+	driver := MockDB{}
+	_, err := Interpolate(&driver, &Query{RawSQL: "select * from foo where $__required()"})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrorBadArgumentCount)
+	assert.Contains(t, err.Error(), "macro required at offset 24")
+}
+
+func TestInterpolate_macroPanic(t *testing.T) {
+	driver := MockDB{}
+	_, err := Interpolate(&driver, &Query{RawSQL: "select $__index(a, b)"})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrorMacroPanic)
+	assert.Contains(t, err.Error(), "macro index at offset 7")
+}
+
+func TestInterpolate_mismatchedQuotes(t *testing.T) {
+	driver := MockDB{}
+	for _, input := range []string{"select $__args('a, b)", `select $__args(a", b)`, "select $__args((a, b)"} {
+		_, err := Interpolate(&driver, &Query{RawSQL: input})
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorParsingMacroArgs)
+	}
+}
+
+func TestInterpolate_unixEpoch(t *testing.T) {
+	timeRange := backend.TimeRange{
+		From: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2021, 7, 1, 1, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{input: "select * from foo where $__unixEpochFilter(time)", output: "select * from foo where time >= 1625097600 AND time <= 1625101200", name: "unixEpochFilter"},
+		{input: "select * from foo where time > $__unixEpochFrom()", output: "select * from foo where time > 1625097600", name: "unixEpochFrom"},
+		{input: "select * from foo where time < $__unixEpochTo()", output: "select * from foo where time < 1625101200", name: "unixEpochTo"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := Interpolate(&driver, &Query{RawSQL: tc.input, TimeRange: timeRange})
+			require.Nil(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestInterpolate_macroCall(t *testing.T) {
+	var calls []MacroCall
+	macros := Macros{
+		"foo": func(query *Query, args []string) (string, error) {
+			calls = append(calls, query.MacroCall())
+			return "bar", nil
+		},
+	}
+	_, err := interpolateMacros(&MockDB{}, DriverSettings{}, macros, &Query{RawSQL: "select $__foo(a, 'b,c') from t"})
+	require.NoError(t, err)
+	assert.Equal(t, []MacroCall{{Name: "foo", Match: "$__foo(a, 'b,c')", HasParens: true, NumArgs: 2}}, calls)
+	assert.Equal(t, MacroCall{}, (&Query{}).MacroCall())
+}
+
+func TestRegisterMacros(t *testing.T) {
+	macro := func(res string) MacroFunc {
+		return func(*Query, []string) (string, error) { return res, nil }
+	}
+	macros := RegisterMacros(Macros{"foo": macro("base"), "qux": macro("base")}, Macros{"foo": macro("extra"), "baz": macro("extra")})
+	require.Len(t, macros, 3)
+	for name, expected := range map[string]string{"foo": "extra", "baz": "extra", "qux": "base"} {
+		res, err := macros[name](&Query{}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, expected, res, name)
+	}
+}
+
+func TestDatasource_RegisterMacros(t *testing.T) {
+	ds := NewDatasource(&MockDB{})
+	ds.RegisterMacros(Macros{
+		"foo": func(*Query, []string) (string, error) { return "registered", nil },
+		"baz": func(*Query, []string) (string, error) { return "registered", nil },
+	})
+	res, err := ds.interpolate(context.Background(), &Query{RawSQL: "select $__foo, $__baz"})
+	require.NoError(t, err)
+	assert.Equal(t, "select bar, registered", res)
+}
+
+func TestInterpolate_timeZone(t *testing.T) {
+	timeRange := backend.TimeRange{
+		From: time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2021, 7, 1, 1, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name     string
+		timeZone string
+		input    string
+		output   string
+	}{
+		{input: "$__timeFilter(time)", output: "time >= '2021-07-01T00:00:00Z' AND time <= '2021-07-01T01:00:00Z'", name: "timeFilter without time zone"},
+		{input: "$__timeFilter(time)", timeZone: "America/New_York", output: "time >= '2021-06-30T20:00:00-04:00' AND time <= '2021-06-30T21:00:00-04:00'", name: "timeFilter with time zone"},
+		{input: "$__timeFrom(time)", timeZone: "America/New_York", output: "time >= '2021-06-30T20:00:00-04:00'", name: "timeFrom with time zone"},
+		{input: "$__timeTo(time)", timeZone: "America/New_York", output: "time <= '2021-06-30T21:00:00-04:00'", name: "timeTo with time zone"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := Interpolate(&driver, &Query{RawSQL: tc.input, TimeRange: timeRange, TimeZone: tc.timeZone})
+			require.Nil(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+
+	t.Run("invalid time zone", func(t *testing.T) {
+		driver := MockDB{}
+		_, err := Interpolate(&driver, &Query{RawSQL: "$__timeFilter(time)", TimeRange: timeRange, TimeZone: "Mars/Olympus_Mons"})
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorTimeZone)
+	})
+}
+
+func TestInterpolate_timeRound(t *testing.T) {
+	timeRange := backend.TimeRange{
+		From: time.Date(2021, 7, 1, 10, 37, 0, 0, time.UTC),
+		To:   time.Date(2021, 7, 1, 12, 5, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name     string
+		interval time.Duration
+		input    string
+		output   string
+	}{
+		{input: "$__timeRoundFrom()", interval: time.Hour, output: "'2021-07-01T10:00:00Z'", name: "timeRoundFrom with 1h interval"},
+		{input: "$__timeRoundTo()", interval: time.Hour, output: "'2021-07-01T13:00:00Z'", name: "timeRoundTo with 1h interval"},
+		{input: "$__timeRoundFrom()", output: "'2021-07-01T10:37:00Z'", name: "timeRoundFrom without interval"},
+		{input: "$__timeRoundTo()", output: "'2021-07-01T12:05:00Z'", name: "timeRoundTo without interval"},
+		{input: "$__timeRoundTo()", interval: 5 * time.Minute, output: "'2021-07-01T12:05:00Z'", name: "timeRoundTo already aligned"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := Interpolate(&driver, &Query{RawSQL: tc.input, TimeRange: timeRange, Interval: tc.interval})
+			require.Nil(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestInterpolate_schema(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings DriverSettings
+		schema   string
+		input    string
+		output   string
+	}{
+		{name: "default schema", settings: DriverSettings{DefaultSchema: "public"}, input: "select * from $__schema().t", output: `select * from "public".t`},
+		{name: "default schema with table", settings: DriverSettings{DefaultSchema: "public"}, input: "select * from $__schema(t)", output: `select * from "public".t`},
+		{name: "quoting style", settings: DriverSettings{DefaultSchema: "dbo", IdentifierQuote: IdentifierQuoteBracket}, input: "select * from $__schema(t)", output: "select * from [dbo].t"},
+		{name: "query schema", settings: DriverSettings{DefaultSchema: "public"}, schema: "sales", input: "select * from $__schema(t)", output: `select * from "sales".t`},
+		{name: "empty schema", input: "select * from $__schema().t", output: "select * from .t"},
+		{name: "empty schema with table", input: "select * from $__schema(t)", output: "select * from t"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := interpolateMacros(&driver, tc.settings, driver.Macros(), &Query{RawSQL: tc.input, Schema: tc.schema})
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestInterpolate_searchFilter(t *testing.T) {
+	tests := []struct {
+		name         string
+		searchFilter string
+		settings     DriverSettings
+		output       string
+	}{
+		{name: "search term", searchFilter: "foo", output: `name LIKE '%foo%' ESCAPE '\'`},
+		{name: "search term with wildcards", searchFilter: "50%_off", output: `name LIKE '%50\%\_off%' ESCAPE '\'`},
+		{name: "search term with quotes", searchFilter: "it's", output: `name LIKE '%it''s%' ESCAPE '\'`},
+		{name: "search term with backslashes", searchFilter: `a\b`, output: `name LIKE '%a\\b%' ESCAPE '\'`},
+		{name: "trailing backslash", searchFilter: `a\`, output: `name LIKE '%a\\%' ESCAPE '\'`},
+		{
+			name:         "quote payload with backslash escapes",
+			searchFilter: `\' OR 1=1 -- `,
+			settings:     DriverSettings{QuoteString: LiteralQuoteBackslash.Quote},
+			output:       `name LIKE '%\\\\'' OR 1=1 -- %' ESCAPE '\\'`,
+		},
+		{
+			name:         "trailing backslash with backslash escapes",
+			searchFilter: `a\`,
+			settings:     DriverSettings{QuoteString: LiteralQuoteBackslash.Quote},
+			output:       `name LIKE '%a\\\\%' ESCAPE '\\'`,
+		},
+		{name: "empty search term", output: "1=1"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := interpolateMacros(&driver, tc.settings, driver.Macros(), &Query{RawSQL: "$__searchFilter(name)", SearchFilter: tc.searchFilter})
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestMacroArgInt(t *testing.T) {
+	args := []string{"10", "", "ten", "-3"}
+	tests := []struct {
+		name   string
+		idx    int
+		output int
+		err    error
+	}{
+		{name: "integer", idx: 0, output: 10},
+		{name: "negative integer", idx: 3, output: -3},
+		{name: "empty argument", idx: 1, err: ErrorBadArgumentCount},
+		{name: "not an integer", idx: 2, err: ErrorInvalidMacroArg},
+		{name: "out of range", idx: 4, err: ErrorBadArgumentCount},
+		{name: "negative index", idx: -1, err: ErrorBadArgumentCount},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := MacroArgInt(args, tc.idx)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				assert.Contains(t, err.Error(), fmt.Sprintf("index %d", tc.idx))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, v)
+		})
+	}
+}
+
+func TestMacroArgString(t *testing.T) {
+	args := []string{"a", ""}
+	assert.Equal(t, "a", MacroArgString(args, 0, "d"))
+	assert.Equal(t, "d", MacroArgString(args, 1, "d"))
+	assert.Equal(t, "d", MacroArgString(args, 2, "d"))
+	assert.Equal(t, "d", MacroArgString(args, -1, "d"))
+	assert.Equal(t, "", MacroArgString(nil, 0, ""))
+}
+
+func TestInterpolate_timeInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		interval   time.Duration
+		output     string
+	}{
+		{name: "date_trunc", expression: "date_trunc('%[2]s', %[1]s)", interval: 5 * time.Minute, output: "date_trunc('minute', time)"},
+		{name: "date_trunc by hour", expression: "date_trunc('%[2]s', %[1]s)", interval: 2 * time.Hour, output: "date_trunc('hour', time)"},
+		{name: "date_trunc by week", expression: "date_trunc('%[2]s', %[1]s)", interval: 10 * 24 * time.Hour, output: "date_trunc('week', time)"},
+		{name: "date_trunc by second", expression: "date_trunc('%[2]s', %[1]s)", interval: 100 * time.Millisecond, output: "date_trunc('second', time)"},
+		{name: "floor", expression: "FLOOR(%[1]s / %[3]s) * %[3]s", interval: 30 * time.Second, output: "FLOOR(time / 30) * 30"},
+		{name: "fallback", interval: 2 * time.Hour, output: "datepart(hour, time),datepart(day, time),datepart(month, time),datepart(year, time)"},
+		{name: "fallback by week", interval: 10 * 24 * time.Hour, output: "datepart(day, time),datepart(month, time),datepart(year, time)"},
+		{name: "fallback by second", interval: time.Second, output: "datepart(minute, time),datepart(hour, time),datepart(day, time),datepart(month, time),datepart(year, time)"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			settings := DriverSettings{IntervalExpression: tc.expression}
+			interpolatedQuery, err := interpolateMacros(&driver, settings, driver.Macros(), &Query{RawSQL: "$__timeInterval(time)", Interval: tc.interval})
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+
+	t.Run("it should fail without a column", func(t *testing.T) {
+		driver := MockDB{}
+		_, err := Interpolate(&driver, &Query{RawSQL: "$__timeInterval()"})
+		assert.ErrorIs(t, err, ErrorBadArgumentCount)
+	})
+}
+
+func TestInterpolate_fieldMacros(t *testing.T) {
+	driver := MockDB{}
+	settings := DriverSettings{DefaultSchema: "public"}
+	tests := []struct {
+		name   string
+		query  Query
+		output string
+	}{
+		{name: "table", query: Query{RawSQL: "select * from $__table", Table: "$__schema().t"}, output: `select * from "public".t`},
+		{name: "table with the schema of the query", query: Query{RawSQL: "select * from $__schema($__table)", Table: "t_$__interval_s()", Interval: time.Minute}, output: `select * from "public".t_60`},
+		{name: "column", query: Query{RawSQL: "select $__column from t", Column: "$__quoteIdentifier(my col)"}, output: `select "my col" from t`},
+		{name: "column referring to the table", query: Query{RawSQL: "select $__column from $__table", Table: "t", Column: "$__table.c"}, output: "select t.c from t"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := tc.query
+			interpolatedQuery, err := interpolateMacros(&driver, settings, driver.Macros(), &q)
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+			assert.Equal(t, tc.query.Table, q.Table, "the query should not be modified")
+		})
+	}
+
+	t.Run("it should apply the macros to the fields before quoting them", func(t *testing.T) {
+		settings := DriverSettings{QuoteIdentifiers: true}
+		interpolatedQuery, err := interpolateMacros(&driver, settings, driver.Macros(), &Query{RawSQL: "select * from $__table", Table: "t_$__interval_s()", Interval: time.Minute})
+		require.NoError(t, err)
+		assert.Equal(t, `select * from "t_60"`, interpolatedQuery)
+	})
+
+	t.Run("it should fail if a field refers to itself", func(t *testing.T) {
+		_, err := interpolateMacros(&driver, settings, driver.Macros(), &Query{RawSQL: "select * from $__table", Table: "$__table"})
+		assert.ErrorIs(t, err, ErrorMacroDepth)
+	})
+}
+
+func TestInterpolate_limit(t *testing.T) {
+	driver := MockDB{}
+	tests := []struct {
+		name     string
+		input    string
+		limit    int
+		maxLimit int
+		output   string
+		err      error
+	}{
+		{name: "query limit", input: "$__limit(100)", limit: 20, output: "20"},
+		{name: "query limit without default", input: "$__limit()", limit: 20, output: "20"},
+		{name: "default limit", input: "$__limit(100)", output: "100"},
+		{name: "query limit clamped", input: "$__limit(100)", limit: 5000, maxLimit: 1000, output: "1000"},
+		{name: "default limit clamped", input: "$__limit(5000)", maxLimit: 1000, output: "1000"},
+		{name: "limit below the maximum", input: "$__limit(100)", maxLimit: 1000, output: "100"},
+		{name: "non-numeric default", input: "$__limit(all)", err: ErrorInvalidMacroArg},
+		{name: "non-numeric default with a query limit", input: "$__limit(all)", limit: 20, err: ErrorInvalidMacroArg},
+		{name: "negative default", input: "$__limit(-1)", err: ErrorInvalidMacroArg},
+		{name: "missing default", input: "$__limit()", err: ErrorBadArgumentCount},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := DriverSettings{MaxLimit: tc.maxLimit}
+			interpolatedQuery, err := interpolateMacros(&driver, settings, driver.Macros(), &Query{RawSQL: tc.input, Limit: tc.limit})
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestInterpolate_bool(t *testing.T) {
+	driver := MockDB{}
+	numeric := DriverSettings{TrueLiteral: "1", FalseLiteral: "0"}
+	tests := []struct {
+		name     string
+		input    string
+		settings DriverSettings
+		output   string
+		err      error
+	}{
+		{name: "true", input: "active = $__bool(true)", output: "active = TRUE"},
+		{name: "one", input: "active = $__bool(1)", output: "active = TRUE"},
+		{name: "quoted yes", input: "active = $__bool('Yes')", output: "active = TRUE"},
+		{name: "false", input: "active = $__bool(FALSE)", output: "active = FALSE"},
+		{name: "zero", input: "active = $__bool(0)", output: "active = FALSE"},
+		{name: "no", input: `active = $__bool("no")`, output: "active = FALSE"},
+		{name: "numeric true literal", input: "active = $__bool(yes)", settings: numeric, output: "active = 1"},
+		{name: "numeric false literal", input: "active = $__bool(false)", settings: numeric, output: "active = 0"},
+		{name: "invalid value", input: "active = $__bool(maybe)", err: ErrorInvalidMacroArg},
+		{name: "empty value", input: "active = $__bool()", err: ErrorInvalidMacroArg},
+		{name: "too many arguments", input: "active = $__bool(true, false)", err: ErrorBadArgumentCount},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := interpolateMacros(&driver, tc.settings, driver.Macros(), &Query{RawSQL: tc.input})
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestInterpolate_timeSpine(t *testing.T) {
+	driver := MockDB{}
+	timeRange := backend.TimeRange{From: time.Date(2021, 7, 1, 10, 0, 30, 0, time.UTC), To: time.Date(2021, 7, 1, 11, 0, 30, 0, time.UTC)}
+	input := "select s.time, t.value from $__timeSpine() AS s(time) left join t on t.time = s.time"
+
+	t.Run("it should use the expression of the driver", func(t *testing.T) {
+		settings := DriverSettings{TimeSpineExpression: "generate_series(%[1]s::timestamptz, %[2]s::timestamptz, '%[3]s seconds'::interval)"}
+		interpolatedQuery, err := interpolateMacros(&driver, settings, driver.Macros(), &Query{RawSQL: input, TimeRange: timeRange, Interval: time.Minute})
+		require.NoError(t, err)
+		assert.Equal(t, "select s.time, t.value from generate_series('2021-07-01T10:00:00Z'::timestamptz, '2021-07-01T11:01:00Z'::timestamptz, '60 seconds'::interval) AS s(time) left join t on t.time = s.time", interpolatedQuery)
+	})
+
+	t.Run("it should fail without an expression", func(t *testing.T) {
+		_, err := Interpolate(&driver, &Query{RawSQL: input, TimeRange: timeRange, Interval: time.Minute})
+		assert.ErrorIs(t, err, ErrorUnsupportedMacro)
+	})
+}
+
+func TestInterpolate_varsJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		variables map[string]string
+		output    string
+	}{
+		{name: "variables", variables: map[string]string{"region": "eu", "host": "a"}, output: `call p('{"host":"a","region":"eu"}')`},
+		{name: "quotes", variables: map[string]string{"name": `it's "quoted"`}, output: `call p('{"name":"it''s \"quoted\""}')`},
+		{name: "special characters", variables: map[string]string{"q": "a\nb\\c<d>"}, output: `call p('{"q":"a\nb\\c<d>"}')`},
+		{name: "no variables", output: "call p('{}')"},
+		{name: "empty variables", variables: map[string]string{}, output: "call p('{}')"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := Interpolate(&driver, &Query{RawSQL: "call p($__varsJson())", Variables: tc.variables})
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+
+	t.Run("it should use the quoting function of the driver", func(t *testing.T) {
+		driver := MockDB{}
+		settings := DriverSettings{QuoteString: func(s string) string { return "E'" + strings.ReplaceAll(s, "'", `\'`) + "'" }}
+		interpolatedQuery, err := interpolateMacros(&driver, settings, driver.Macros(), &Query{RawSQL: "$__varsJson()", Variables: map[string]string{"a": "'"}})
+		require.NoError(t, err)
+		assert.Equal(t, `E'{"a":"\'"}'`, interpolatedQuery)
+	})
+}
+
+func TestInterpolate_quoteIdentifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings DriverSettings
+		input    string
+		output   string
+	}{
+		{input: "select * from $__quoteIdentifier(my table)", output: `select * from "my table"`, name: "default quoting"},
+		{input: "select * from $__quoteIdentifier(my table)", settings: DriverSettings{IdentifierQuote: IdentifierQuoteBacktick}, output: "select * from `my table`", name: "backticks"},
+		{input: "select * from $__quoteIdentifier(my]table)", settings: DriverSettings{IdentifierQuote: IdentifierQuoteBracket}, output: "select * from [my]]table]", name: "brackets"},
+		{input: "select $__column from $__table", settings: DriverSettings{IdentifierQuote: IdentifierQuoteBacktick}, output: "select my col from my table", name: "table and column not quoted"},
+		{input: "select $__column from $__table", settings: DriverSettings{IdentifierQuote: IdentifierQuoteBacktick, QuoteIdentifiers: true}, output: "select `my col` from `my table`", name: "table and column with backticks"},
+		{input: "select $__column from $__table", settings: DriverSettings{IdentifierQuote: IdentifierQuoteBracket, QuoteIdentifiers: true}, output: "select [my col] from [my table]", name: "table and column with brackets"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			query := &Query{RawSQL: tc.input, Table: "my table", Column: "my col"}
+			interpolatedQuery, err := interpolateMacros(&driver, tc.settings, driver.Macros(), query)
+			require.Nil(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestInterpolateContext(t *testing.T) {
+	t.Run("it should stop a running macro when the context is canceled", func(t *testing.T) {
+		driver := MockDB{}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			cancel()
+		}()
+		_, err := InterpolateContext(ctx, &driver, &Query{RawSQL: "select $__slow()"})
+		require.Error(t, err)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("it should not apply macros if the context is already canceled", func(t *testing.T) {
+		driver := MockDB{}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := InterpolateContext(ctx, &driver, &Query{RawSQL: "select $__foo()"})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestInterpolate_conditionalAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings DriverSettings
+		input    string
+		output   string
+	}{
+		{input: "select * from foo where $__conditionalAll(col IN ($__all), $__all)", output: "select * from foo where 1=1", name: "all value"},
+		{input: "select * from foo where $__conditionalAll(col IN ('$__all'), '$__all')", output: "select * from foo where 1=1", name: "quoted all value"},
+		{input: "select * from foo where $__conditionalAll(col IN ('a', 'b'), 'a')", output: "select * from foo where col IN ('a', 'b')", name: "concrete value"},
+		{input: "select * from foo where $__conditionalAll(col IN ('a','b'), 'a','b')", output: "select * from foo where col IN ('a','b')", name: "multi-value variable"},
+		{input: "select * from foo where $__conditionalAll(col IN (a,b), a,b)", output: "select * from foo where col IN (a,b)", name: "unquoted multi-value variable"},
+		{input: "select * from foo where $__conditionalAll(col IN (*), *)", settings: DriverSettings{AllValue: "*"}, output: "select * from foo where 1=1", name: "custom all value"},
+		{input: "select * from foo where $__conditionalAll(col IN ($__all), $__all)", settings: DriverSettings{AllValue: "*"}, output: "select * from foo where col IN ($__all)", name: "default all value with custom setting"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := interpolateMacros(&driver, tc.settings, driver.Macros(), &Query{RawSQL: tc.input})
+			require.Nil(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+	t.Run("it should require the variable", func(t *testing.T) {
+		driver := MockDB{}
+		_, err := interpolateMacros(&driver, DriverSettings{}, driver.Macros(), &Query{RawSQL: "select * from foo where $__conditionalAll(col IN (a))"})
+		assert.ErrorIs(t, err, ErrorBadArgumentCount)
+	})
+}
+
+func TestInterpolate_quoteList(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings DriverSettings
+		input    string
+		output   string
+	}{
+		{input: "select * from foo where col IN ($__quoteList(a, b, c))", output: "select * from foo where col IN ('a','b','c')", name: "three values"},
+		{input: "select * from foo where col IN ($__quoteList('a','b','c'))", output: "select * from foo where col IN ('a','b','c')", name: "quoted values"},
+		{input: "select * from foo where col IN ($__quoteList(a))", output: "select * from foo where col IN ('a')", name: "single value"},
+		{input: "select * from foo where col IN ($__quoteList('it''s'))", output: "select * from foo where col IN ('it''s')", name: "escaped quote"},
+		{input: "select * from foo where col IN ($__quoteList())", output: "select * from foo where col IN (NULL)", name: "empty list"},
+		{input: "select * from foo where col IN ($__quoteList(a, b))", settings: DriverSettings{QuoteString: func(s string) string { return `"` + s + `"` }}, output: `select * from foo where col IN ("a","b")`, name: "custom quoting"},
+		{input: `select * from foo where col IN ($__quoteList(a\b))`, settings: DriverSettings{QuoteString: LiteralQuoteBackslash.Quote}, output: `select * from foo where col IN ('a\\b')`, name: "backslash quoting"},
+	}
+	for _, tc := range tests {
+		driver := MockDB{}
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := interpolateMacros(&driver, tc.settings, driver.Macros(), &Query{RawSQL: tc.input})
+			require.Nil(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestInterpolate_fragment(t *testing.T) {
+	driver := MockDB{}
+	hourRange := backend.TimeRange{From: time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC), To: time.Date(2021, 7, 1, 11, 0, 0, 0, time.UTC)}
+	fragments := map[string]string{
+		"hosts":  "select name from $__table where $__timeFilter(time)",
+		"active": "select * from ($__fragment(hosts)) h where h.active",
+	}
+	tests := []struct {
+		name   string
+		strict bool
+		input  string
+		output string
+		err    error
+	}{
+		{name: "registered fragment", input: "with h as ($__fragment(hosts)) select * from h", output: "with h as (select name from my_table where time >= '2021-07-01T10:00:00Z' AND time <= '2021-07-01T11:00:00Z') select * from h"},
+		{name: "nested fragment", input: "$__fragment(active)", output: "select * from (select name from my_table where time >= '2021-07-01T10:00:00Z' AND time <= '2021-07-01T11:00:00Z') h where h.active"},
+		{name: "unknown fragment", input: "select * from ($__fragment(missing)) t where $__timeFilter(time)", output: "select * from ($__fragment(missing)) t where time >= '2021-07-01T10:00:00Z' AND time <= '2021-07-01T11:00:00Z'"},
+		{name: "unknown fragment with strict macros", strict: true, input: "select * from ($__fragment(missing)) t", err: ErrUnknownMacro},
+		{name: "missing name", input: "select * from ($__fragment()) t", err: ErrorBadArgumentCount},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			settings := DriverSettings{QueryFragments: fragments, StrictMacros: tc.strict}
+			interpolatedQuery, err := interpolateMacros(&driver, settings, driver.Macros(), &Query{RawSQL: tc.input, Table: "my_table", TimeRange: hourRange})
+			if tc.err != nil {
+				require.Error(t, err)
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+}
+
+func TestDriverSettings_QuoteLiteral(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings DriverSettings
+		input    string
+		output   string
+	}{
+		{name: "plain value", input: "foo", output: "'foo'"},
+		{name: "single quotes", input: "it's 'quoted'", output: "'it''s ''quoted'''"},
+		{name: "backslashes", input: `C:\dir\`, output: `'C:\dir\'`},
+		{name: "backslashes and quotes with backslash quoting", settings: DriverSettings{QuoteString: LiteralQuoteBackslash.Quote}, input: `it\'s`, output: `'it\\''s'`},
+		{name: "custom quoting", settings: DriverSettings{QuoteString: func(s string) string { return "E'" + s + "'" }}, input: `a\b`, output: `E'a\b'`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.output, tc.settings.QuoteLiteral(tc.input))
+		})
+	}
+
+	t.Run("QuoteLiteralTime should quote the time in the time zone of the query", func(t *testing.T) {
+		ts := time.Date(2021, 7, 1, 10, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+		quoted, err := DriverSettings{}.QuoteLiteralTime(&Query{}, ts)
+		require.NoError(t, err)
+		assert.Equal(t, "'2021-07-01T08:30:00Z'", quoted)
+		quoted, err = DriverSettings{}.QuoteLiteralTime(&Query{TimeZone: "America/New_York"}, ts)
+		require.NoError(t, err)
+		assert.Equal(t, "'2021-07-01T04:30:00-04:00'", quoted)
+		_, err = DriverSettings{}.QuoteLiteralTime(&Query{TimeZone: "Mars/Olympus"}, ts)
+		assert.ErrorIs(t, err, ErrorTimeZone)
+	})
+
+	t.Run("the time macros should use the quoting of the settings", func(t *testing.T) {
+		driver := MockDB{}
+		settings := DriverSettings{QuoteString: func(s string) string { return "TIMESTAMP '" + s + "'" }}
+		query := &Query{RawSQL: "select * from foo where $__timeFilter(time) and $__now() > $__timeRoundFrom()", TimeRange: backend.TimeRange{
+			From: time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC),
+			To:   time.Date(2021, 7, 1, 11, 0, 0, 0, time.UTC),
+		}}
+		interpolatedQuery, err := interpolateMacros(&driver, settings, driver.Macros(), query)
+		require.NoError(t, err)
+		assert.Equal(t, "select * from foo where time >= TIMESTAMP '2021-07-01T10:00:00Z' AND time <= TIMESTAMP '2021-07-01T11:00:00Z' and TIMESTAMP '2021-07-01T11:00:00Z' > TIMESTAMP '2021-07-01T10:00:00Z'", interpolatedQuery)
+	})
+}
+
+func TestInterpolate_strictMacros(t *testing.T) {
+	driver := MockDB{}
+	query := &Query{RawSQL: "select $__foo() from t where $__somethingCustom(a) and $__other and $__somethingCustom(b)"}
+
+	t.Run("it should keep unknown macros by default", func(t *testing.T) {
+		interpolatedQuery, err := interpolateMacros(&driver, DriverSettings{}, driver.Macros(), query)
+		require.NoError(t, err)
+		assert.Equal(t, "select bar from t where $__somethingCustom(a) and $__other and $__somethingCustom(b)", interpolatedQuery)
+	})
+
+	t.Run("it should return an error listing the unknown macros", func(t *testing.T) {
+		_, err := interpolateMacros(&driver, DriverSettings{StrictMacros: true}, driver.Macros(), query)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrUnknownMacro)
+		assert.Equal(t, "unknown macro: other, somethingCustom", err.Error())
+	})
+
+	t.Run("it should not return an error if all the macros are known", func(t *testing.T) {
+		interpolatedQuery, err := interpolateMacros(&driver, DriverSettings{StrictMacros: true}, driver.Macros(), &Query{RawSQL: "select $__foo()"})
+		require.NoError(t, err)
+		assert.Equal(t, "select bar", interpolatedQuery)
+	})
+
+	t.Run("it should return the names of the unknown macros", func(t *testing.T) {
+		_, err := interpolateMacros(&driver, DriverSettings{StrictMacros: true}, driver.Macros(), query)
+		var unknown *UnknownMacroError
+		require.True(t, errors.As(err, &unknown))
+		assert.Equal(t, []string{"other", "somethingCustom"}, unknown.Names)
+	})
+
+	t.Run("it should ignore the unknown macros within literals and comments", func(t *testing.T) {
+		input := "select '$__price', \"$__col\" from t -- $__note\nwhere a = 1 /* $__other() */"
+		interpolatedQuery, err := interpolateMacros(&driver, DriverSettings{StrictMacros: true}, driver.Macros(), &Query{RawSQL: input})
+		require.NoError(t, err)
+		assert.Equal(t, input, interpolatedQuery)
+	})
+
+	t.Run("InterpolateStatement should use the given settings", func(t *testing.T) {
+		settings := DriverSettings{StrictMacros: true, PlaceholderStyle: PlaceholderDollar}
+		_, _, err := InterpolateStatement(context.Background(), &driver, settings, query)
+		assert.ErrorIs(t, err, ErrUnknownMacro)
+
+		rawSQL, args, err := InterpolateStatement(context.Background(), &driver, settings, &Query{RawSQL: "select * from t where a = $__arg(a)", Args: map[string]interface{}{"a": 1}})
+		require.NoError(t, err)
+		assert.Equal(t, "select * from t where a = $1", rawSQL)
+		assert.Equal(t, []interface{}{1}, args)
+	})
+
+	t.Run("Interpolate should not read the settings of the driver", func(t *testing.T) {
+		rawSQL, err := Interpolate(&panicSettingsDB{}, &Query{RawSQL: "select * from t where a = $__arg(a)", Args: map[string]interface{}{"a": 1}})
+		require.NoError(t, err)
+		assert.Equal(t, "select * from t where a = ?", rawSQL)
+	})
+}
+
+// panicSettingsDB fails to read the settings without a datasource instance
+type panicSettingsDB struct {
+	MockDB
+}
+
+func (h *panicSettingsDB) Settings(backend.DataSourceInstanceSettings) DriverSettings {
+	panic("missing datasource settings")
+}
+
+func TestInterpolate_ignoreCommentedMacros(t *testing.T) {
+	driver := MockDB{}
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{name: "line comment", input: "select $__foo() -- $__foo()\nfrom t", output: "select bar -- $__foo()\nfrom t"},
+		{name: "block comment", input: "select /* $__timeFilter(t) */ $__foo()", output: "select /* $__timeFilter(t) */ bar"},
+		{name: "comment markers within a string", input: "select '-- $__foo()', '/* $__foo() */' from t", output: "select '-- bar', '/* bar */' from t"},
+		{name: "comment within a macro argument", input: "select $__args(a /* b */, c)", output: "select a /* b */|c"},
+		{name: "unknown macros within comments", input: "select 1 -- $__unknown()", output: "select 1 -- $__unknown()"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			interpolatedQuery, err := interpolateMacros(&driver, DriverSettings{IgnoreCommentedMacros: true, StrictMacros: true}, driver.Macros(), &Query{RawSQL: tc.input})
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, interpolatedQuery)
+		})
+	}
+
+	t.Run("it should apply the macros within comments by default", func(t *testing.T) {
+		interpolatedQuery, err := interpolateMacros(&driver, DriverSettings{}, driver.Macros(), &Query{RawSQL: "select 1 -- $__foo()"})
+		require.NoError(t, err)
+		assert.Equal(t, "select 1 -- bar", interpolatedQuery)
+	})
+}
+
+type disabledMacrosDB struct {
+	Driver
+}
+
+func (h *disabledMacrosDB) Macros() Macros {
+	return Macros{}
+}
+
+func (h *disabledMacrosDB) Settings(backend.DataSourceInstanceSettings) DriverSettings {
+	return DriverSettings{}
+}
+
+func (h *disabledMacrosDB) DisabledMacros() []string {
+	return []string{"timeGroup"}
+}
+
+func TestInterpolate_disabledMacros(t *testing.T) {
+	driver := disabledMacrosDB{}
+	query := &Query{RawSQL: "select $__timeGroup(t,m) from foo where $__timeFrom(t)"}
+
+	t.Run("it should keep disabled macros", func(t *testing.T) {
+		interpolatedQuery, err := Interpolate(&driver, query)
+		require.NoError(t, err)
+		assert.Equal(t, "select $__timeGroup(t,m) from foo where t >= '0001-01-01T00:00:00Z'", interpolatedQuery)
+	})
+
+	t.Run("it should return an error in strict mode", func(t *testing.T) {
+		_, err := interpolateMacros(&driver, DriverSettings{StrictMacros: true}, driver.Macros(), query)
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrUnknownMacro)
+		assert.Equal(t, "unknown macro: timeGroup", err.Error())
+	})
+
+	t.Run("it should not disable macros defined by the driver", func(t *testing.T) {
+		macros := Macros{"timeGroup": func(query *Query, args []string) (string, error) {
+			return "grouped!", nil
+		}}
+		interpolatedQuery, err := interpolateMacros(&driver, DriverSettings{}, macros, query)
+		require.NoError(t, err)
+		assert.Equal(t, "select grouped! from foo where t >= '0001-01-01T00:00:00Z'", interpolatedQuery)
+	})
+}
+
+type defaultMacroDB struct {
+	MockDB
+}
+
+func (h *defaultMacroDB) DefaultMacro(name string, query *Query, args []string) (string, bool, error) {
+	switch name {
+	case "fail":
+		return "", true, errors.New("failed")
+	case "nested":
+		return "$__anything($__timeFrom(t))", true, nil
+	}
+	if strings.HasPrefix(name, "any") {
+		return name + "(" + strings.Join(args, ";") + ")", true, nil
+	}
+	return "", false, nil
+}
+
+func TestInterpolate_defaultMacro(t *testing.T) {
+	driver := defaultMacroDB{}
+
+	t.Run("it should call the fallback for unknown macros", func(t *testing.T) {
+		interpolatedQuery, err := Interpolate(&driver, &Query{RawSQL: "select $__anything(), $__anyone(a, b) from foo where $__timeFrom(t)"})
+		require.NoError(t, err)
+		assert.Equal(t, "select anything(), anyone(a;b) from foo where t >= '0001-01-01T00:00:00Z'", interpolatedQuery)
+	})
+
+	t.Run("it should apply the macros in the arguments and the results of the fallback", func(t *testing.T) {
+		interpolatedQuery, err := Interpolate(&driver, &Query{RawSQL: "select $__nested, $__timeFrom($__anything(t))"})
+		require.NoError(t, err)
+		assert.Equal(t, "select anything(t >= '0001-01-01T00:00:00Z'), anything(t) >= '0001-01-01T00:00:00Z'", interpolatedQuery)
+	})
+
+	t.Run("it should keep the macros declined by the fallback", func(t *testing.T) {
+		query := &Query{RawSQL: "select $__other(a) from foo"}
+		interpolatedQuery, err := Interpolate(&driver, query)
+		require.NoError(t, err)
+		assert.Equal(t, "select $__other(a) from foo", interpolatedQuery)
+
+		_, err = interpolateMacros(&driver, DriverSettings{StrictMacros: true}, driver.Macros(), query)
+		assert.ErrorIs(t, err, ErrUnknownMacro)
+	})
+
+	t.Run("it should return the errors of the fallback", func(t *testing.T) {
+		_, err := Interpolate(&driver, &Query{RawSQL: "select $__fail()"})
+		require.Error(t, err)
+		assert.Equal(t, "macro fail at offset 7: failed", err.Error())
+	})
+
+	t.Run("it should not call the fallback for registered macros", func(t *testing.T) {
+		macros := Macros{"anything": func(query *Query, args []string) (string, error) {
+			return "registered", nil
+		}}
+		interpolatedQuery, err := interpolateMacros(&driver, DriverSettings{}, macros, &Query{RawSQL: "select $__anything()"})
+		require.NoError(t, err)
+		assert.Equal(t, "select registered", interpolatedQuery)
+	})
+}
+
+type prefixDB struct {
+	MockDB
+}
+
+func (h *prefixDB) MacroPrefix() string {
+	return "@@"
+}
+
+func TestInterpolate_customPrefix(t *testing.T) {
+	driver := prefixDB{}
+	query := &Query{RawSQL: "select * from foo where @@timeFilter(t) AND $__timeFilter(t)"}
+	interpolatedQuery, err := Interpolate(&driver, query)
+	require.Nil(t, err)
+	assert.Equal(t, "select * from foo where t >= '0001-01-01T00:00:00Z' AND t <= '0001-01-01T00:00:00Z' AND $__timeFilter(t)", interpolatedQuery)
+}
+
+func TestInterpolate_sharedPrefix(t *testing.T) {
+	macros := Macros{
+		"timeFilter": func(query *Query, args []string) (string, error) {
+			return "seconds(" + args[0] + ")", nil
+		},
+		"timeFilterMs": func(query *Query, args []string) (string, error) {
+			return "ms(" + args[0] + ")", nil
+		},
+	}
+	for i := 0; i < 20; i++ {
+		interpolatedQuery, err := interpolateMacros(&MockDB{}, DriverSettings{}, macros, &Query{RawSQL: "$__timeFilterMs(t) AND $__timeFilter(t)"})
+		require.NoError(t, err)
+		assert.Equal(t, "ms(t) AND seconds(t)", interpolatedQuery)
+	}
+	assert.Equal(t, []string{"timeFilterMs", "timeFilter"}, sortedMacroNames(macros))
+}
+
+func TestValidateMacros(t *testing.T) {
+	macro := func(query *Query, args []string) (string, error) {
+		return "", nil
+	}
+	t.Run("valid macros", func(t *testing.T) {
+		assert.NoError(t, ValidateMacros(Macros{"foo": macro, "timeFilter_2": macro}))
+		assert.NoError(t, ValidateMacros((&MockDB{}).Macros()))
+		assert.NoError(t, ValidateMacros(DefaultMacros))
+	})
+
+	for _, name := range []string{"", "$__foo", "foo bar", "foo(", "foo.bar", "fóo"} {
+		t.Run(fmt.Sprintf("invalid name %q", name), func(t *testing.T) {
+			err := ValidateMacros(Macros{"foo": macro, name: macro})
+			require.Error(t, err)
+			assert.ErrorIs(t, err, ErrorInvalidMacroName)
+		})
+	}
+}
+
+type invalidMacrosDB struct {
+	fakeDriver
+}
+
+func (h *invalidMacrosDB) Macros() Macros {
+	return Macros{"$__foo": func(query *Query, args []string) (string, error) {
+		return "", nil
+	}}
+}
+
+func (h *invalidMacrosDB) Settings(backend.DataSourceInstanceSettings) DriverSettings {
+	return DriverSettings{}
+}
+
+func TestDatasource_ValidateMacros(t *testing.T) {
+	t.Run("it should fail to create a datasource with invalid macros", func(t *testing.T) {
+		_, err := NewDatasource(&invalidMacrosDB{}).NewDatasource(backend.DataSourceInstanceSettings{})
+		assert.ErrorIs(t, err, ErrorInvalidMacroName)
+	})
+
+	t.Run("it should validate the registered macros", func(t *testing.T) {
+		ds := NewDatasource(&disabledMacrosDB{})
+		ds.RegisterMacros(Macros{"foo bar": nil})
+		_, err := ds.NewDatasource(backend.DataSourceInstanceSettings{})
+		assert.ErrorIs(t, err, ErrorInvalidMacroName)
+	})
+}
+
 func TestGetMacroRegex_returns_composed_regular_expression(t *testing.T) {
-	assert.Equal(t, `\$__some_string\b(?:\((.*?\)?)\))?`, getMacroRegex("some_string"))
+	assert.Equal(t, `\$__some_string\b`, getMacroRegex("$__", "some_string"))
+	assert.Equal(t, `@@some_string\b`, getMacroRegex("@@", "some_string"))
 }
 
 func TestGetMatches(t *testing.T) {
 	t.Run("FindAllStringSubmatch returns DefaultMacros", func(t *testing.T) {
 		for macroName := range DefaultMacros {
-			matches, err := getMatches(macroName, fmt.Sprintf("$__%s", macroName))
+			matches, err := getMatches(defaultMacroPrefix, macroName, fmt.Sprintf("$__%s", macroName))
 
 			assert.NoError(t, err)
 			assert.Equal(t, [][]string{{fmt.Sprintf("$__%s", macroName), ""}}, matches)
 		}
 	})
 	t.Run("does not return matches for macro name which is substring", func(t *testing.T) {
-		matches, err := getMatches("timeFilter", "$__timeFilterEpoch(time_column)")
+		matches, err := getMatches(defaultMacroPrefix, "timeFilter", "$__timeFilterEpoch(time_column)")
 
 		assert.NoError(t, err)
 		assert.Nil(t, matches)
 	})
+	t.Run("returns the arguments with nested parentheses", func(t *testing.T) {
+		matches, err := getMatches(defaultMacroPrefix, "timeFilter", "$__timeFilter(cast(coalesce(a, b) as timestamp)) AND 1")
+
+		assert.NoError(t, err)
+		assert.Equal(t, [][]string{{"$__timeFilter(cast(coalesce(a, b) as timestamp))", "cast(coalesce(a, b) as timestamp)"}}, matches)
+	})
 }
@@ -0,0 +1,54 @@
+package sqlds
+
+import (
+	"context"
+)
+
+// Metric is an event counted by the Metrics collector
+type Metric string
+
+const (
+	// MetricQueries counts the queries run by the datasource, including the ones answered from the result cache
+	MetricQueries Metric = "queries"
+	// MetricQueryErrors counts the queries that failed
+	MetricQueryErrors Metric = "query_errors"
+	// MetricRetries counts the queries and connections retried after a transient error or a reconnection
+	MetricRetries Metric = "retries"
+	// MetricCacheHits counts the queries answered from the result cache
+	MetricCacheHits Metric = "cache_hits"
+	// MetricCacheMisses counts the cacheable queries that were not in the result cache
+	MetricCacheMisses Metric = "cache_misses"
+	// MetricConnectionsOpened counts the connections opened to the database
+	MetricConnectionsOpened Metric = "connections_opened"
+)
+
+// Metrics collects the counters of the datasource, e.g. to expose them as Prometheus counters.
+// Inc is called concurrently by the queries, so implementations must be safe for concurrent use.
+type Metrics interface {
+	Inc(metric Metric)
+}
+
+// SetMetrics sets the collector of the datasource counters. Nothing is counted if it's not set.
+// It should be called before the datasource starts handling queries.
+func (ds *sqldatasource) SetMetrics(metrics Metrics) {
+	ds.metrics = metrics
+}
+
+// count increments the counter of the metric, if there is a collector
+func (ds *sqldatasource) count(metric Metric) {
+	if ds.metrics != nil {
+		ds.metrics.Inc(metric)
+	}
+}
+
+// retry is like the retry function, counting the retries
+func (ds *sqldatasource) retry(ctx context.Context, settings DriverSettings, fn func() error) error {
+	attempt := 0
+	return retry(ctx, settings, func() error {
+		if attempt > 0 {
+			ds.count(MetricRetries)
+		}
+		attempt++
+		return fn()
+	})
+}
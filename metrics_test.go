@@ -0,0 +1,135 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// recordingMetrics counts the events in memory
+type recordingMetrics struct {
+	mtx    sync.Mutex
+	counts map[Metric]int
+}
+
+func (m *recordingMetrics) Inc(metric Metric) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.counts == nil {
+		m.counts = map[Metric]int{}
+	}
+	m.counts[metric]++
+}
+
+func (m *recordingMetrics) Count(metric Metric) int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.counts[metric]
+}
+
+func Test_Metrics(t *testing.T) {
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	setup := func(driverSettings DriverSettings, handler func(ctx context.Context, query string) (fakeResult, error)) (*sqldatasource, *recordingMetrics) {
+		fd := &fakeSQLDriver{handler: handler}
+		db := fd.DB()
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: driverSettings}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+		metrics := &recordingMetrics{}
+		ds.SetMetrics(metrics)
+		return ds, metrics
+	}
+	lastWeek := backend.TimeRange{From: time.Now().Add(-8 * 24 * time.Hour), To: time.Now().Add(-7 * 24 * time.Hour)}
+	request := func(queries ...string) *backend.QueryDataRequest {
+		req := &backend.QueryDataRequest{PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings}}
+		for _, q := range queries {
+			req.Queries = append(req.Queries, backend.DataQuery{RefID: q, TimeRange: lastWeek, JSON: []byte(`{"rawSql": "` + q + `", "format": 1}`)})
+		}
+		return req
+	}
+	rows := fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}
+
+	t.Run("it should count the queries and the errors", func(t *testing.T) {
+		ds, metrics := setup(DriverSettings{}, func(ctx context.Context, query string) (fakeResult, error) {
+			if query == "fail" {
+				return fakeResult{}, errors.New("syntax error")
+			}
+			return rows, nil
+		})
+		if _, err := ds.QueryData(context.Background(), request("ok", "fail", "other")); err != nil {
+			t.Fatal(err)
+		}
+		if metrics.Count(MetricQueries) != 3 || metrics.Count(MetricQueryErrors) != 1 {
+			t.Errorf("expecting 3 queries and 1 error, got %v", metrics.counts)
+		}
+	})
+
+	t.Run("it should count the retries", func(t *testing.T) {
+		attempts := 0
+		isTransient := func(err error) bool { return errors.Is(err, errTransient) }
+		ds, metrics := setup(DriverSettings{RetryOn: isTransient, RetryAttempts: 3, RetryBackoff: time.Millisecond}, func(ctx context.Context, query string) (fakeResult, error) {
+			attempts++
+			if attempts <= 2 {
+				return fakeResult{}, errTransient
+			}
+			return rows, nil
+		})
+		if _, err := ds.QueryData(context.Background(), request("A")); err != nil {
+			t.Fatal(err)
+		}
+		if metrics.Count(MetricRetries) != 2 || metrics.Count(MetricQueryErrors) != 0 {
+			t.Errorf("expecting 2 retries and no errors, got %v", metrics.counts)
+		}
+	})
+
+	t.Run("it should count the cache hits and misses", func(t *testing.T) {
+		ds, metrics := setup(DriverSettings{ResultCacheTTL: time.Minute}, func(ctx context.Context, query string) (fakeResult, error) {
+			return rows, nil
+		})
+		for i := 0; i < 3; i++ {
+			if _, err := ds.QueryData(context.Background(), request("A")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if metrics.Count(MetricCacheMisses) != 1 || metrics.Count(MetricCacheHits) != 2 || metrics.Count(MetricQueries) != 3 {
+			t.Errorf("expecting 1 miss, 2 hits and 3 queries, got %v", metrics.counts)
+		}
+	})
+
+	t.Run("it should count the connections", func(t *testing.T) {
+		ds := NewDatasource(&warmupDriver{fakeDriver: fakeDriver{db: &sql.DB{}}})
+		metrics := &recordingMetrics{}
+		ds.SetMetrics(metrics)
+		if _, err := ds.NewDatasource(*settings); err != nil {
+			t.Fatal(err)
+		}
+		if metrics.Count(MetricConnectionsOpened) != 1 {
+			t.Errorf("expecting 1 connection, got %v", metrics.counts)
+		}
+	})
+
+	t.Run("it should not count without a collector", func(t *testing.T) {
+		ds, metrics := setup(DriverSettings{}, func(ctx context.Context, query string) (fakeResult, error) {
+			return rows, nil
+		})
+		ds.SetMetrics(nil)
+		res, err := ds.QueryData(context.Background(), request("A"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := res.Responses["A"].Error; err != nil {
+			t.Fatalf("unexpected query error %v", err)
+		}
+		if len(res.Responses["A"].Frames) != 1 {
+			t.Errorf("expecting 1 frame, got %d", len(res.Responses["A"].Frames))
+		}
+		if len(metrics.counts) != 0 {
+			t.Errorf("expecting the removed collector not to count, got %v", metrics.counts)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package sqlds
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// ErrorPagination is returned when the offset or the page size of a query are negative
+var ErrorPagination = errors.New("invalid pagination")
+
+// defaultPaginationSQL is used when DriverSettings.PaginationSQL is not set
+const defaultPaginationSQL = "LIMIT %[1]d OFFSET %[2]d"
+
+// PageCursor is the position of the next page of a paginated query. It's set as the "cursor" of the Custom metadata of
+// the frames, so that the next page can be requested with its Offset and PageSize.
+type PageCursor struct {
+	Offset   int `json:"offset"`
+	PageSize int `json:"pageSize"`
+}
+
+// paginate appends the LIMIT and OFFSET of the page to the query, using the DriverSettings.PaginationSQL format string.
+// Trailing semicolons are removed first, so the clause applies to the last statement, and a trailing line comment is
+// ended with a line break.
+func paginate(settings DriverSettings, q *Query) (string, error) {
+	if q.Offset < 0 || q.PageSize < 0 {
+		return q.RawSQL, fmt.Errorf("%w: offset %d and page size %d must not be negative", ErrorPagination, q.Offset, q.PageSize)
+	}
+	if q.PageSize == 0 {
+		return q.RawSQL, nil
+	}
+	format := settings.PaginationSQL
+	if format == "" {
+		format = defaultPaginationSQL
+	}
+	rawSQL := strings.TrimRight(q.RawSQL, "; \t\r\n")
+	separator := " "
+	if comments := findComments(rawSQL); len(comments) > 0 {
+		if last := comments[len(comments)-1]; last[1] == len(rawSQL) && strings.HasPrefix(rawSQL[last[0]:], "--") {
+			separator = "\n"
+		}
+	}
+	return rawSQL + separator + fmt.Sprintf(format, q.PageSize, q.Offset), nil
+}
+
+// setPageCursor sets the cursor of the next page in the frames of a paginated query, from the number of rows read from
+// the database before the frames were reshaped. Full pages may be followed by more rows, so they get a cursor, as well as
+// the pages truncated by DriverSettings.MaxRows, whose next page starts after the last row read. The last page, with
+// fewer rows than the page size, doesn't.
+func setPageCursor(frames data.Frames, q *Query, read int64, truncated bool) {
+	if q.PageSize == 0 || (read < int64(q.PageSize) && !truncated) {
+		return
+	}
+	next := q.Offset + q.PageSize
+	if read < int64(q.PageSize) {
+		next = q.Offset + int(read)
+	}
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		custom, ok := frame.Meta.Custom.(map[string]interface{})
+		if !ok {
+			custom = map[string]interface{}{}
+		}
+		custom["cursor"] = PageCursor{Offset: next, PageSize: q.PageSize}
+		frame.Meta.Custom = custom
+	}
+}
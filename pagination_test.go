@@ -0,0 +1,112 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_paginate(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    Query
+		settings DriverSettings
+		output   string
+		err      error
+	}{
+		{name: "no page size", query: Query{RawSQL: "select * from t", Offset: 20}, output: "select * from t"},
+		{name: "first page", query: Query{RawSQL: "select * from t", PageSize: 10}, output: "select * from t LIMIT 10 OFFSET 0"},
+		{name: "next page", query: Query{RawSQL: "select * from t;\n", Offset: 20, PageSize: 10}, output: "select * from t LIMIT 10 OFFSET 20"},
+		{name: "trailing line comment", query: Query{RawSQL: "select * from t -- all rows", PageSize: 10}, output: "select * from t -- all rows\nLIMIT 10 OFFSET 0"},
+		{
+			name:     "custom dialect",
+			query:    Query{RawSQL: "select * from t order by id", Offset: 20, PageSize: 10},
+			settings: DriverSettings{PaginationSQL: "OFFSET %[2]d ROWS FETCH NEXT %[1]d ROWS ONLY"},
+			output:   "select * from t order by id OFFSET 20 ROWS FETCH NEXT 10 ROWS ONLY",
+		},
+		{name: "negative offset", query: Query{RawSQL: "select * from t", Offset: -1, PageSize: 10}, err: ErrorPagination},
+		{name: "negative page size", query: Query{RawSQL: "select * from t", PageSize: -10}, err: ErrorPagination},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rawSQL, err := paginate(tc.settings, &tc.query)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.output, rawSQL)
+		})
+	}
+}
+
+func Test_RunQuery_pagination(t *testing.T) {
+	rows := [][]driver.Value{{int64(1)}, {int64(2)}, {int64(3)}, {int64(4)}, {int64(5)}}
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		// The last page only has one row
+		if query == "select id from t LIMIT 2 OFFSET 4" {
+			return fakeResult{columns: []string{"id"}, rows: rows[4:]}, nil
+		}
+		return fakeResult{columns: []string{"id"}, rows: rows[2:4]}, nil
+	}}
+	db := fd.DB()
+	ds := &sqldatasource{c: &fakeDriver{db: db}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	t.Run("it should return the cursor of the next page", func(t *testing.T) {
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select id from t", "format": 1, "offset": 2, "pageSize": 2}`)}, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, "select id from t LIMIT 2 OFFSET 2", fd.Queries()[0])
+		require.Len(t, frames, 1)
+		require.NotNil(t, frames[0].Meta)
+		assert.Equal(t, PageCursor{Offset: 4, PageSize: 2}, frames[0].Meta.Custom.(map[string]interface{})["cursor"])
+	})
+
+	t.Run("it should not return a cursor for the last page", func(t *testing.T) {
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select id from t", "format": 1, "offset": 4, "pageSize": 2}`)}, "uid1")
+		require.NoError(t, err)
+		assert.Equal(t, "select id from t LIMIT 2 OFFSET 4", fd.Queries()[1])
+		require.Len(t, frames, 1)
+		assert.Equal(t, 1, frames[0].Rows())
+		assert.NotContains(t, frames[0].Meta.Custom, "cursor")
+	})
+}
+
+func Test_RunQuery_pagination_reshaped(t *testing.T) {
+	start := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	rows := [][]driver.Value{
+		{start, "a", 1.0},
+		{start, "b", 2.0},
+		{start.Add(time.Minute), "a", 3.0},
+		{start.Add(time.Minute), "b", 4.0},
+	}
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"time", "metric", "value"}, rows: rows}, nil
+	}}
+	db := fd.DB()
+
+	t.Run("it should count the rows of the time series before they are reshaped", func(t *testing.T) {
+		ds := &sqldatasource{c: &fakeDriver{db: db}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select * from t", "format": 0, "pageSize": 4}`)}, "uid1")
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		assert.Equal(t, 2, frames[0].Rows())
+		assert.Equal(t, PageCursor{Offset: 4, PageSize: 4}, frames[0].Meta.Custom.(map[string]interface{})["cursor"])
+	})
+
+	t.Run("it should continue after the last row of a table truncated by the row limit", func(t *testing.T) {
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{MaxRows: 3}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select * from t", "format": 1, "offset": 4, "pageSize": 10}`)}, "uid1")
+		require.NoError(t, err)
+		require.Len(t, frames, 1)
+		assert.Equal(t, 3, frames[0].Rows())
+		assert.Equal(t, PageCursor{Offset: 7, PageSize: 10}, frames[0].Meta.Custom.(map[string]interface{})["cursor"])
+	})
+}
@@ -3,9 +3,12 @@ package sqlds
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -23,6 +26,20 @@ const (
 	FormatOptionTable
 	// FormatOptionLogs sets the preferred visualization to logs
 	FormatOptionLogs
+	// FormatOptionTrace sets the preferred visualization to trace
+	FormatOptionTrace
+	// FormatOptionAnnotation formats the query results as annotations, with time, timeEnd, title, text and tags columns
+	FormatOptionAnnotation
+)
+
+// TimeSeriesFormat defines the shape of the time series frames
+type TimeSeriesFormat string
+
+const (
+	// TimeSeriesWide pivots the string columns into one field per series, using "LongToWide". This is the default.
+	TimeSeriesWide TimeSeriesFormat = "wide"
+	// TimeSeriesLong leaves the string columns as they are, with a row per time and series
+	TimeSeriesLong TimeSeriesFormat = "long"
 )
 
 // Query is the model that represents the query that users submit from the panel / queryeditor.
@@ -38,27 +55,92 @@ type Query struct {
 	TimeRange     backend.TimeRange `json:"-"`
 	MaxDataPoints int64             `json:"-"`
 	FillMissing   *data.FillMissing `json:"fillMode,omitempty"`
+	TimeZone      string            `json:"timezone,omitempty"`
+	// Args are the values that can be passed as bind parameters with the $__arg macro
+	Args map[string]interface{} `json:"args,omitempty"`
+	// SearchFilter is the search term used by the $__searchFilter macro
+	SearchFilter string `json:"searchFilter,omitempty"`
+	// Limit is the row limit used by the $__limit macro
+	Limit int `json:"limit,omitempty"`
+	// Offset and PageSize paginate the results of the query, appending DriverSettings.PaginationSQL to it.
+	// The results are not paginated if PageSize is zero.
+	Offset   int `json:"offset,omitempty"`
+	PageSize int `json:"pageSize,omitempty"`
+	// Variables are the dashboard variables used by the $__varsJson macro
+	Variables map[string]string `json:"variables,omitempty"`
+	// TimeColumn is the name of the time column of the time series. The first time column is used if empty.
+	TimeColumn string `json:"timeColumn,omitempty"`
+	// TimeSeriesFormat chooses between wide and long time series frames. Wide frames are returned if empty.
+	TimeSeriesFormat TimeSeriesFormat `json:"timeSeriesFormat,omitempty"`
+	// QueryID identifies a run of the query, so that it can be cancelled through the /cancel resource.
+	// It's set by the client, and should be unique.
+	QueryID string `json:"queryId,omitempty"`
+	// SkipInterpolation sends RawSQL to the database as it is, without applying the macros,
+	// e.g. for the databases that use "$__" in their own identifiers
+	SkipInterpolation bool `json:"skipInterpolation,omitempty"`
 
 	// Macros
 	Schema string `json:"schema,omitempty"`
 	Table  string `json:"table,omitempty"`
 	Column string `json:"column,omitempty"`
+
+	ctx       context.Context
+	macroCall *MacroCall
+	// statements are the statements of RawSQL with their bind parameters, set by bindQuery
+	statements    []string
+	statementArgs [][]interface{}
+}
+
+// Context returns the context of the query being interpolated, so that macros can honor cancellation.
+// It returns context.Background() if the query has no context.
+func (q *Query) Context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+	return q.ctx
+}
+
+// MacroCall returns the details of the macro invocation when called from a MacroFunc
+func (q *Query) MacroCall() MacroCall {
+	if q.macroCall == nil {
+		return MacroCall{}
+	}
+	return *q.macroCall
+}
+
+// WithContext copies the Query, but with a different context
+func (q *Query) WithContext(ctx context.Context) *Query {
+	query := q.WithSQL(q.RawSQL)
+	query.ctx = ctx
+	return query
 }
 
 // WithSQL copies the Query, but with a different RawSQL value.
 // This is mostly useful in the Interpolate function, where the RawSQL value is modified in a loop
 func (q *Query) WithSQL(query string) *Query {
 	return &Query{
-		RawSQL:         query,
-		ConnectionArgs: q.ConnectionArgs,
-		RefID:          q.RefID,
-		Interval:       q.Interval,
-		TimeRange:      q.TimeRange,
-		MaxDataPoints:  q.MaxDataPoints,
-		FillMissing:    q.FillMissing,
-		Schema:         q.Schema,
-		Table:          q.Table,
-		Column:         q.Column,
+		RawSQL:            query,
+		ConnectionArgs:    q.ConnectionArgs,
+		RefID:             q.RefID,
+		Interval:          q.Interval,
+		TimeRange:         q.TimeRange,
+		MaxDataPoints:     q.MaxDataPoints,
+		FillMissing:       q.FillMissing,
+		TimeZone:          q.TimeZone,
+		Args:              q.Args,
+		SearchFilter:      q.SearchFilter,
+		Limit:             q.Limit,
+		Offset:            q.Offset,
+		PageSize:          q.PageSize,
+		Variables:         q.Variables,
+		TimeColumn:        q.TimeColumn,
+		TimeSeriesFormat:  q.TimeSeriesFormat,
+		QueryID:           q.QueryID,
+		SkipInterpolation: q.SkipInterpolation,
+		Schema:            q.Schema,
+		Table:             q.Table,
+		Column:            q.Column,
+		ctx:               q.ctx,
 	}
 }
 
@@ -72,17 +154,28 @@ func GetQuery(query backend.DataQuery) (*Query, error) {
 
 	// Copy directly from the well typed query
 	return &Query{
-		RawSQL:         model.RawSQL,
-		Format:         model.Format,
-		ConnectionArgs: model.ConnectionArgs,
-		RefID:          query.RefID,
-		Interval:       query.Interval,
-		TimeRange:      query.TimeRange,
-		MaxDataPoints:  query.MaxDataPoints,
-		FillMissing:    model.FillMissing,
-		Schema:         model.Schema,
-		Table:          model.Table,
-		Column:         model.Column,
+		RawSQL:            model.RawSQL,
+		Format:            model.Format,
+		ConnectionArgs:    model.ConnectionArgs,
+		RefID:             query.RefID,
+		Interval:          query.Interval,
+		TimeRange:         query.TimeRange,
+		MaxDataPoints:     query.MaxDataPoints,
+		FillMissing:       model.FillMissing,
+		TimeZone:          model.TimeZone,
+		Args:              model.Args,
+		SearchFilter:      model.SearchFilter,
+		Limit:             model.Limit,
+		Offset:            model.Offset,
+		PageSize:          model.PageSize,
+		Variables:         model.Variables,
+		TimeColumn:        model.TimeColumn,
+		TimeSeriesFormat:  model.TimeSeriesFormat,
+		QueryID:           model.QueryID,
+		SkipInterpolation: model.SkipInterpolation,
+		Schema:            model.Schema,
+		Table:             model.Table,
+		Column:            model.Column,
 	}, nil
 }
 
@@ -97,17 +190,177 @@ func getErrorFrameFromQuery(query *Query) data.Frames {
 	return frames
 }
 
-// query sends the query to the connection and converts the rows to a dataframe.
-func query(ctx context.Context, db Connection, converters []sqlutil.Converter, fillMode *data.FillMissing, query *Query) (data.Frames, error) {
-	// Query the rows from the database
-	rows, err := db.QueryContext(ctx, query.RawSQL)
+// dbError is an error returned by the database, classified as errType
+type dbError struct {
+	errType error
+	err     error
+}
+
+func (e *dbError) Error() string {
+	return fmt.Sprintf("%s: %s", e.errType.Error(), e.err.Error())
+}
+
+// Is matches the error type, while Unwrap allows to match the original error
+func (e *dbError) Is(target error) bool {
+	return target == e.errType
+}
+
+func (e *dbError) Unwrap() error {
+	return e.err
+}
+
+// queryError wraps an error returned by the database
+func queryError(err error) error {
+	errType := ErrorQuery
+	if errors.Is(err, context.Canceled) {
+		errType = context.Canceled
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		errType = ErrorTimeout
+	}
+
+	return &dbError{errType, err}
+}
+
+// execStatement runs a statement discarding its results
+func execStatement(ctx context.Context, db Connection, statement string, args []interface{}) error {
+	rows, err := db.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return queryError(err)
+	}
+	if err := rows.Close(); err != nil {
+		return queryError(err)
+	}
+	return nil
+}
+
+// setStatementTimeout runs DriverSettings.StatementTimeoutSQL if the query has a timeout, returning the connection to
+// run the query with and the function to release it once the rows are closed.
+// The statement timeout is set in the session, so it must use the same connection as the query.
+func setStatementTimeout(ctx context.Context, db Connection, settings DriverSettings) (Connection, func(), error) {
+	if settings.StatementTimeoutSQL == "" || settings.Timeout <= 0 {
+		return db, func() {}, nil
+	}
+	conn, err := pinConnection(ctx, db)
+	if err != nil {
+		return nil, nil, queryError(err)
+	}
+
+	timeoutSQL := fmt.Sprintf(settings.StatementTimeoutSQL, settings.Timeout.Milliseconds())
+	if err := execStatement(ctx, conn, timeoutSQL, nil); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, func() {
+		if settings.StatementTimeoutResetSQL != "" {
+			if err := resetStatementTimeout(conn, settings); err != nil {
+				backend.Logger.Error("Could not reset the statement timeout", "error", err)
+				discardConnection(conn)
+			}
+		}
+		conn.Close()
+	}, nil
+}
+
+// defaultResetTimeout limits DriverSettings.StatementTimeoutResetSQL if DriverSettings.Timeout is not set
+const defaultResetTimeout = 30 * time.Second
+
+// resetStatementTimeout runs DriverSettings.StatementTimeoutResetSQL on the pinned connection, so that the next queries of
+// the connection don't inherit the statement timeout. It doesn't use the context of the query, which may be done already.
+func resetStatementTimeout(conn Connection, settings DriverSettings) error {
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = defaultResetTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return execStatement(ctx, conn, settings.StatementTimeoutResetSQL, nil)
+}
+
+// discardConnection removes a pinned connection from the pool, by reporting it as bad to database/sql, so that it's
+// closed instead of being reused with the session state of the query
+func discardConnection(conn Connection) {
+	if c, ok := conn.(sqlConn); ok {
+		_ = c.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+}
+
+// sqlConn is a single connection of a *sql.DB
+type sqlConn struct {
+	*sql.Conn
+}
+
+func (c sqlConn) Ping() error {
+	return c.PingContext(context.Background())
+}
+
+// pinConnection returns a single connection of the pool, so that consecutive statements share the same session.
+// Other connections are returned as they are, with a no-op Close.
+func pinConnection(ctx context.Context, db Connection) (Connection, error) {
+	pool, ok := db.(*sql.DB)
+	if !ok {
+		return noCloseConnection{db}, nil
+	}
+	conn, err := pool.Conn(ctx)
 	if err != nil {
-		errType := ErrorQuery
-		if errors.Is(err, context.Canceled) {
-			errType = context.Canceled
+		return nil, err
+	}
+	return sqlConn{conn}, nil
+}
+
+// noCloseConnection is a Connection that is not closed with the query
+type noCloseConnection struct {
+	Connection
+}
+
+func (noCloseConnection) Close() error {
+	return nil
+}
+
+// execStatements runs all the statements of the bound query but the last one, which returns the rows
+func execStatements(ctx context.Context, db Connection, query *Query) error {
+	last := len(query.statements) - 1
+	for i, s := range query.statements[:last] {
+		if err := execStatement(ctx, db, s, query.statementArgs[i]); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// rowLimit returns DriverSettings.MaxRows, or -1 if the rows are not limited
+func rowLimit(settings DriverSettings) int64 {
+	if settings.MaxRows > 0 {
+		return settings.MaxRows
+	}
+	return -1
+}
+
+// query sends the query to the connection and converts the rows to a dataframe.
+func query(ctx context.Context, db Connection, converters []sqlutil.Converter, columnConverters map[string]sqlutil.Converter, settings DriverSettings, query *Query) (data.Frames, error) {
+	query = bindQuery(settings, query)
+	statements, args := query.statements, query.statementArgs
 
-		return getErrorFrameFromQuery(query), fmt.Errorf("%w: %s", errType, err.Error())
+	db, release, err := setStatementTimeout(ctx, db, settings)
+	if err != nil {
+		return getErrorFrameFromQuery(query), err
+	}
+	defer release()
+
+	// Run all the statements but the last one, which returns the frames
+	if err := execStatements(ctx, db, query); err != nil {
+		return getErrorFrameFromQuery(query), err
+	}
+	last := len(statements) - 1
+
+	// Query the rows from the database
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, statements[last], args[last]...)
+	executionTime := time.Since(start)
+	if err != nil {
+		return getErrorFrameFromQuery(query), queryError(err)
 	}
 
 	// Check for an error response
@@ -127,16 +380,365 @@ func query(ctx context.Context, db Connection, converters []sqlutil.Converter, f
 	}()
 
 	// Convert the response to frames
-	res, err := getFrames(rows, -1, converters, fillMode, query)
-	if err != nil {
+	limit := rowLimit(settings)
+	res, err := getFrames(rows, limit, converters, columnConverters, settings, query)
+	if err != nil && !(settings.MultipleResultSets && errors.Is(err, ErrorNoResults)) {
 		return getErrorFrameFromQuery(query), fmt.Errorf("%w: %s", err, "Could not process SQL results")
 	}
+	if !settings.MultipleResultSets {
+		setExecutionTime(res, executionTime)
+		return res, nil
+	}
 
+	// The frames of the following result sets are named after the RefID and the index of the result set
+	for i := 1; rows.NextResultSet(); i++ {
+		resultSet := *query
+		resultSet.RefID = fmt.Sprintf("%s_%d", query.RefID, i)
+		frames, err := getFrames(rows, limit, converters, columnConverters, settings, &resultSet)
+		if errors.Is(err, ErrorNoResults) {
+			continue
+		}
+		if err != nil {
+			return getErrorFrameFromQuery(query), fmt.Errorf("%w: %s", err, "Could not process SQL results")
+		}
+		res = append(res, frames...)
+	}
+	if err := rows.Err(); err != nil {
+		return getErrorFrameFromQuery(query), queryError(err)
+	}
+	if len(res) == 0 {
+		return getErrorFrameFromQuery(query), fmt.Errorf("%w: %s", ErrorNoResults, "Could not process SQL results")
+	}
+
+	setExecutionTime(res, executionTime)
 	return res, nil
 }
 
-func getFrames(rows *sql.Rows, limit int64, converters []sqlutil.Converter, fillMode *data.FillMissing, query *Query) (data.Frames, error) {
-	frame, err := sqlutil.FrameFromRows(rows, limit, converters...)
+// setExecutionTime adds the time taken by the database to run the query to the custom metadata of the frames,
+// as {"executionTimeMs": 123}
+func setExecutionTime(frames data.Frames, executionTime time.Duration) {
+	for _, frame := range frames {
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		custom, ok := frame.Meta.Custom.(map[string]interface{})
+		if !ok {
+			custom = map[string]interface{}{}
+		}
+		custom["executionTimeMs"] = executionTime.Milliseconds()
+		frame.Meta.Custom = custom
+	}
+}
+
+// makeScanRow returns the field names, the row scanner and the converter of each column. The column converters are matched
+// by column name, and take precedence over the converters matched by type name, which take precedence over the
+// DriverSettings.RegexConverters. The type names can be rewritten by DriverSettings.TypeRewrite before matching them.
+// If DriverSettings.CoerceNumericToFloat is set, the numeric columns without a converter use nullable float64 fields.
+// The field names are the column names, renamed by DriverSettings.FieldNameTransform if set.
+// If DriverSettings.UseNullableFields is set, the columns without a driver converter use nullable field types.
+func makeScanRow(rows *sql.Rows, converters []sqlutil.Converter, columnConverters map[string]sqlutil.Converter, settings DriverSettings) ([]string, *sqlutil.ScanRow, []sqlutil.Converter, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	scanner, scanConverters, err := sqlutil.MakeScanRow(types, names, converters...)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, name := range names {
+		if converter, ok := columnConverters[name]; ok {
+			scanner.Set(i, name, converter.InputScanType)
+			scanConverters[i] = converter
+			continue
+		}
+		typeName := types[i].DatabaseTypeName()
+		if settings.TypeRewrite != nil {
+			if rewritten := settings.TypeRewrite(name, typeName); rewritten != typeName {
+				// The converter is chosen again for the new type, using the default one if none matches it
+				typeName = rewritten
+				converter, ok := findConverter(converters, typeName)
+				if !ok {
+					nullable, ok := types[i].Nullable()
+					converter = sqlutil.NewDefaultConverter(name, nullable || !ok, types[i].ScanType())
+				}
+				scanner.Set(i, name, converter.InputScanType)
+				scanConverters[i] = converter
+			}
+		}
+		if _, ok := findConverter(converters, typeName); ok {
+			continue
+		}
+		if converter, ok := matchRegexConverter(settings.RegexConverters, typeName); ok {
+			scanner.Set(i, name, converter.InputScanType)
+			scanConverters[i] = converter
+			continue
+		}
+		if settings.CoerceNumericToFloat && isNumericColumn(types[i]) {
+			converter := floatConverter(settings)
+			scanner.Set(i, name, converter.InputScanType)
+			scanConverters[i] = converter
+			continue
+		}
+		if !settings.UseNullableFields {
+			continue
+		}
+		if converter, ok := nullableConverter(scanConverters[i], settings); ok {
+			scanner.Set(i, name, converter.InputScanType)
+			scanConverters[i] = converter
+		}
+	}
+	if settings.FieldNameTransform != nil {
+		// The converters are matched by the original column names
+		transformed := make([]string, len(names))
+		for i, name := range names {
+			transformed[i] = settings.FieldNameTransform(name)
+		}
+		names = transformed
+	}
+	return names, scanner, scanConverters, nil
+}
+
+// findConverter returns the first converter matching the database type
+func findConverter(converters []sqlutil.Converter, typeName string) (sqlutil.Converter, bool) {
+	for _, c := range converters {
+		if c.InputTypeName == typeName {
+			return c, true
+		}
+	}
+	return sqlutil.Converter{}, false
+}
+
+// nullableConverter returns a converter that scans the values of a default converter as they are returned by the driver,
+// so that NULL values are kept as nil. It returns false if the converter already uses a nullable field type.
+// The numbers returned as strings are parsed with DriverSettings.DecimalSeparator.
+func nullableConverter(converter sqlutil.Converter, settings DriverSettings) (sqlutil.Converter, bool) {
+	fieldType := converter.FrameConverter.FieldType
+	if fieldType.Nullable() || converter.InputScanType.Kind() == reflect.Ptr {
+		return converter, false
+	}
+	t := converter.InputScanType
+	return sqlutil.Converter{
+		Name:          fmt.Sprintf("Nullable %s", converter.Name),
+		InputScanType: reflect.TypeOf((*interface{})(nil)).Elem(),
+		InputTypeName: converter.InputTypeName,
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType: fieldType.NullableType(),
+			ConverterFunc: func(in interface{}) (interface{}, error) {
+				v := reflect.ValueOf(*in.(*interface{}))
+				res := reflect.New(t)
+				if !v.IsValid() {
+					// NULL values result in a nil pointer of the field type
+					return reflect.Zero(res.Type()).Interface(), nil
+				}
+				converted, err := convertValue(v, t, settings.DecimalSeparator)
+				if err != nil {
+					return nil, err
+				}
+				res.Elem().Set(converted)
+				return res.Interface(), nil
+			},
+		},
+	}, true
+}
+
+// isNumericKind reports whether the kind is an integer or a float
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// convertValue converts a value returned by the driver to the type of a field.
+// reflect conversions are only used between numeric kinds or the same kind, because converting an integer to a string
+// with reflect results in the rune of that code point, e.g. 65 to "A". Other values are formatted or parsed as strings,
+// the floats using the decimal separator.
+func convertValue(v reflect.Value, t reflect.Type, decimalSeparator string) (reflect.Value, error) {
+	switch {
+	case v.Type() == t:
+		return v, nil
+	case isNumericKind(v.Kind()) && isNumericKind(t.Kind()), v.Kind() == t.Kind() && v.Type().ConvertibleTo(t):
+		return v.Convert(t), nil
+	}
+
+	var s string
+	switch in := v.Interface().(type) {
+	case []byte:
+		s = string(in)
+	case string:
+		s = in
+	default:
+		s = fmt.Sprint(in)
+	}
+
+	res := reflect.New(t).Elem()
+	switch kind := t.Kind(); {
+	case kind == reflect.String:
+		res.SetString(s)
+		return res, nil
+	case kind == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("unable to convert %s to %s: %w", v.Type(), t, err)
+		}
+		res.SetBool(b)
+		return res, nil
+	case kind >= reflect.Int && kind <= reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("unable to convert %s to %s: %w", v.Type(), t, err)
+		}
+		res.SetInt(n)
+		return res, nil
+	case kind >= reflect.Uint && kind <= reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("unable to convert %s to %s: %w", v.Type(), t, err)
+		}
+		res.SetUint(n)
+		return res, nil
+	case kind == reflect.Float32 || kind == reflect.Float64:
+		f, err := parseFloat(s, decimalSeparator)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("unable to convert %s to %s: %w", v.Type(), t, err)
+		}
+		res.SetFloat(f)
+		return res, nil
+	}
+	return reflect.Value{}, fmt.Errorf("unable to convert %s to %s", v.Type(), t)
+}
+
+// rowReader reads the rows of a result set into frames, supporting the converters matched by column name.
+// The rows past rowLimit are dropped, and if DriverSettings.SkipBrokenRows is set, the rows that can't be scanned or
+// converted are skipped instead of returning an error.
+type rowReader struct {
+	rows       *sql.Rows
+	names      []string
+	scanner    *sqlutil.ScanRow
+	converters []sqlutil.Converter
+	settings   DriverSettings
+	rowLimit   int64
+
+	// count is the number of rows read into the frames, and skipped the number of broken rows
+	count, skipped int64
+	truncated      bool
+}
+
+func newRowReader(rows *sql.Rows, rowLimit int64, converters []sqlutil.Converter, columnConverters map[string]sqlutil.Converter, settings DriverSettings) (*rowReader, error) {
+	names, scanner, converters, err := makeScanRow(rows, converters, columnConverters, settings)
+	if err != nil {
+		return nil, err
+	}
+	return &rowReader{rows: rows, names: names, scanner: scanner, converters: converters, settings: settings, rowLimit: rowLimit}, nil
+}
+
+// newFrame returns an empty frame with the fields of the columns
+func (r *rowReader) newFrame() *data.Frame {
+	return sqlutil.NewFrame(r.names, r.converters...)
+}
+
+// read appends up to n rows to the frame, or all of them if n is negative. It returns false once there are no more rows
+// to read, either because they were all read or because the row limit was reached.
+func (r *rowReader) read(frame *data.Frame, n int) (bool, error) {
+	for appended := 0; n < 0 || appended < n; {
+		if !r.rows.Next() {
+			return false, nil
+		}
+		if r.count == r.rowLimit {
+			frame.AppendNotices(droppedRowsNotice(r.rows, r.rowLimit, r.settings))
+			r.truncated = true
+			return false, nil
+		}
+
+		row := r.scanner.NewScannableRow()
+		err := r.rows.Scan(row...)
+		if err == nil {
+			err = sqlutil.Append(frame, row, r.converters...)
+		}
+		if err != nil {
+			if !r.settings.SkipBrokenRows {
+				return false, err
+			}
+			backend.Logger.Warn("Skipping broken row", "error", err)
+			r.skipped++
+			continue
+		}
+
+		r.count++
+		appended++
+	}
+	return true, nil
+}
+
+// appendSkippedNotice adds the number of skipped rows to the notices of the frame
+func (r *rowReader) appendSkippedNotice(frame *data.Frame) {
+	if r.skipped > 0 {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("Skipped %d row(s) that could not be read", r.skipped),
+		})
+	}
+}
+
+// frameFromRows is like sqlutil.FrameFromRows, but reads the rows with a rowReader.
+// It also returns the number of rows read, including the skipped ones, and whether the rows were truncated at rowLimit.
+func frameFromRows(rows *sql.Rows, rowLimit int64, converters []sqlutil.Converter, columnConverters map[string]sqlutil.Converter, settings DriverSettings) (*data.Frame, int64, bool, error) {
+	reader, err := newRowReader(rows, rowLimit, converters, columnConverters, settings)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	frame := reader.newFrame()
+	if _, err := reader.read(frame, -1); err != nil {
+		return nil, 0, false, err
+	}
+	reader.appendSkippedNotice(frame)
+	return frame, reader.count + reader.skipped, reader.truncated, nil
+}
+
+// droppedRowsNotice returns the notice of the results truncated at rowLimit, once the row past the limit has been read.
+// The remaining rows are only read to count them if DriverSettings.CountDroppedRows is set. Otherwise, the rows are
+// closed so that the database stops sending them, unless the following result sets are read.
+func droppedRowsNotice(rows *sql.Rows, rowLimit int64, settings DriverSettings) data.Notice {
+	text := fmt.Sprintf("Results have been limited to %v because the SQL row limit was reached, more than %v row(s) were returned", rowLimit, rowLimit)
+	if settings.CountDroppedRows {
+		dropped := 1
+		for rows.Next() {
+			dropped++
+		}
+		text = fmt.Sprintf("Results have been limited to %v because the SQL row limit was reached, %d row(s) were dropped", rowLimit, dropped)
+	} else if !settings.MultipleResultSets {
+		if err := rows.Close(); err != nil {
+			backend.Logger.Error(err.Error())
+		}
+	}
+	return data.Notice{Severity: data.NoticeSeverityWarning, Text: text}
+}
+
+// setTimeColumn moves the time column to the first position, so that it's used as the time index of the time series
+func setTimeColumn(frame *data.Frame, name string) error {
+	for i, field := range frame.Fields {
+		if field.Name != name {
+			continue
+		}
+		if field.Type() != data.FieldTypeTime && field.Type() != data.FieldTypeNullableTime {
+			return fmt.Errorf("%w: %s is not a time column", ErrorTimeColumn, name)
+		}
+		fields := append(data.Fields{field}, frame.Fields[:i]...)
+		frame.Fields = append(fields, frame.Fields[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrorTimeColumn, name)
+}
+
+func getFrames(rows *sql.Rows, limit int64, converters []sqlutil.Converter, columnConverters map[string]sqlutil.Converter, settings DriverSettings, query *Query) (data.Frames, error) {
+	frame, read, truncated, err := frameFromRows(rows, limit, converters, columnConverters, settings)
 	if err != nil {
 		return nil, err
 	}
@@ -148,13 +750,44 @@ func getFrames(rows *sql.Rows, limit int64, converters []sqlutil.Converter, fill
 	frame.Meta.ExecutedQueryString = query.RawSQL
 	frame.Meta.PreferredVisualization = data.VisTypeGraph
 
+	frames, err := formatFrame(frame, settings, query)
+	if err != nil {
+		return nil, err
+	}
+	// The rows are counted before the frame is reshaped
+	setPageCursor(frames, query, read, truncated)
+	return frames, nil
+}
+
+// formatFrame converts the frame of the rows to the format of the query
+func formatFrame(frame *data.Frame, settings DriverSettings, query *Query) (data.Frames, error) {
+
 	if query.Format == FormatOptionTable {
 		frame.Meta.PreferredVisualization = data.VisTypeTable
 		return data.Frames{frame}, nil
 	}
 
 	if query.Format == FormatOptionLogs {
-		frame.Meta.PreferredVisualization = data.VisTypeLogs
+		frame, err := toLogsFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+		return data.Frames{frame}, nil
+	}
+
+	if query.Format == FormatOptionAnnotation {
+		frame, err := toAnnotationsFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+		return data.Frames{frame}, nil
+	}
+
+	if query.Format == FormatOptionTrace {
+		frame, err := toTraceFrame(frame)
+		if err != nil {
+			return nil, err
+		}
 		return data.Frames{frame}, nil
 	}
 
@@ -164,12 +797,21 @@ func getFrames(rows *sql.Rows, limit int64, converters []sqlutil.Converter, fill
 		return nil, err
 	}
 
+	if query.TimeColumn != "" {
+		if err := setTimeColumn(frame, query.TimeColumn); err != nil {
+			return nil, err
+		}
+	}
+
 	if count == 0 {
+		if settings.EmptyFramesWithSchema {
+			return data.Frames{frame}, nil
+		}
 		return nil, ErrorNoResults
 	}
 
-	if frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong {
-		frame, err := data.LongToWide(frame, fillMode)
+	if query.TimeSeriesFormat != TimeSeriesLong && frame.TimeSeriesSchema().Type == data.TimeSeriesTypeLong {
+		frame, err := data.LongToWide(frame, settings.FillMode)
 		if err != nil {
 			return nil, err
 		}
@@ -3,10 +3,15 @@ package sqlds
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
 )
 
@@ -75,7 +80,7 @@ func TestQuery_Timeout(t *testing.T) {
 
 		defer conn.Close()
 
-		_, err := query(ctx, conn, []sqlutil.Converter{}, nil, &Query{})
+		_, err := query(ctx, conn, []sqlutil.Converter{}, nil, DriverSettings{}, &Query{})
 
 		if !errors.Is(err, context.Canceled) {
 			t.Fatal("expected error to be context.Canceled, received", err)
@@ -97,10 +102,623 @@ func TestQuery_Timeout(t *testing.T) {
 
 		defer conn.Close()
 
-		_, err := query(ctx, conn, []sqlutil.Converter{}, nil, &Query{})
+		_, err := query(ctx, conn, []sqlutil.Converter{}, nil, DriverSettings{}, &Query{})
 
 		if !errors.Is(err, ErrorQuery) {
 			t.Fatal("expected function to complete, received error: ", err)
 		}
 	})
 }
+
+func TestQuery_StatementTimeoutSQL(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}}
+	settings := DriverSettings{StatementTimeoutSQL: "SET statement_timeout = %d", Timeout: 1500 * time.Millisecond}
+
+	t.Run("it should set the statement timeout before the query", func(t *testing.T) {
+		db := fd.DB()
+		// The query would wait for a second connection if it didn't use the one of the statement timeout
+		db.SetMaxOpenConns(1)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if _, err := query(ctx, db, nil, nil, settings, &Query{RawSQL: "select a from foo"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		expected := []string{"SET statement_timeout = 1500", "select a from foo"}
+		if queries := fd.Queries(); !reflect.DeepEqual(queries, expected) {
+			t.Errorf("expecting queries %v, got %v", expected, queries)
+		}
+	})
+
+	t.Run("it should not set the statement timeout if the query has no timeout", func(t *testing.T) {
+		fd := &fakeSQLDriver{handler: fd.handler}
+		noTimeout := settings
+		noTimeout.Timeout = 0
+		if _, err := query(context.Background(), fd.DB(), nil, nil, noTimeout, &Query{RawSQL: "select a from foo"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if queries := fd.Queries(); !reflect.DeepEqual(queries, []string{"select a from foo"}) {
+			t.Errorf("expecting only the query, got %v", queries)
+		}
+	})
+
+	t.Run("it should reset the statement timeout before releasing the connection", func(t *testing.T) {
+		fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+			session := fakeSession(ctx)
+			switch {
+			case strings.HasPrefix(query, "SET statement_timeout = "):
+				session["statement_timeout"] = strings.TrimPrefix(query, "SET statement_timeout = ")
+			case query == "RESET statement_timeout":
+				delete(session, "statement_timeout")
+			}
+			return fakeResult{columns: []string{"statement_timeout"}, rows: [][]driver.Value{{session["statement_timeout"]}}}, nil
+		}}
+		db := fd.DB()
+		// Both queries use the same connection
+		db.SetMaxOpenConns(1)
+		reset := settings
+		reset.StatementTimeoutResetSQL = "RESET statement_timeout"
+
+		frames, err := query(context.Background(), db, nil, nil, reset, &Query{RawSQL: "show statement_timeout"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if v := frames[0].Fields[0].At(0); v != "1500" {
+			t.Errorf("expecting the query to run with the statement timeout, got %v", v)
+		}
+		frames, err = query(context.Background(), db, nil, nil, DriverSettings{}, &Query{RawSQL: "show statement_timeout"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if v := frames[0].Fields[0].At(0); v != "" {
+			t.Errorf("expecting the next query of the connection to run without the statement timeout, got %v", v)
+		}
+		expected := []string{"SET statement_timeout = 1500", "show statement_timeout", "RESET statement_timeout", "show statement_timeout"}
+		if queries := fd.Queries(); !reflect.DeepEqual(queries, expected) {
+			t.Errorf("expecting queries %v, got %v", expected, queries)
+		}
+	})
+
+	t.Run("it should discard the connection if the statement timeout can't be reset", func(t *testing.T) {
+		fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+			session := fakeSession(ctx)
+			switch {
+			case strings.HasPrefix(query, "SET statement_timeout = "):
+				session["statement_timeout"] = strings.TrimPrefix(query, "SET statement_timeout = ")
+			case query == "RESET statement_timeout":
+				return fakeResult{}, errors.New("reset failed")
+			}
+			return fakeResult{columns: []string{"statement_timeout"}, rows: [][]driver.Value{{session["statement_timeout"]}}}, nil
+		}}
+		db := fd.DB()
+		db.SetMaxOpenConns(1)
+		reset := settings
+		reset.StatementTimeoutResetSQL = "RESET statement_timeout"
+
+		if _, err := query(context.Background(), db, nil, nil, reset, &Query{RawSQL: "show statement_timeout"}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		frames, err := query(context.Background(), db, nil, nil, DriverSettings{}, &Query{RawSQL: "show statement_timeout"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if v := frames[0].Fields[0].At(0); v != "" {
+			t.Errorf("expecting the next query to use a new connection without the statement timeout, got %v", v)
+		}
+	})
+
+	t.Run("it should not close other connections", func(t *testing.T) {
+		conn := &testConnection{}
+		_, err := query(context.Background(), conn, nil, nil, settings, &Query{RawSQL: "select a from foo"})
+		if !errors.Is(err, ErrorQuery) {
+			t.Fatalf("expecting error %v, got %v", ErrorQuery, err)
+		}
+		if conn.QueryRunCount != 1 {
+			t.Errorf("expecting the statement timeout to run once, ran %d times", conn.QueryRunCount)
+		}
+	})
+}
+
+func TestQuery_ColumnConverters(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"price", "amount"},
+			types:   []string{"NUMERIC", "NUMERIC"},
+			rows:    [][]driver.Value{{"1.10", "2.50"}},
+		}, nil
+	}}
+	toFloat := sqlutil.Converter{
+		Name:          "numeric to float",
+		InputScanType: reflect.TypeOf(""),
+		InputTypeName: "NUMERIC",
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType: data.FieldTypeFloat64,
+			ConverterFunc: func(in interface{}) (interface{}, error) {
+				return strconv.ParseFloat(*in.(*string), 64)
+			},
+		},
+	}
+	toString := sqlutil.Converter{
+		Name:          "numeric to string",
+		InputScanType: reflect.TypeOf(""),
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType: data.FieldTypeString,
+			ConverterFunc: func(in interface{}) (interface{}, error) {
+				return *in.(*string), nil
+			},
+		},
+	}
+
+	frames, err := query(context.Background(), fd.DB(), []sqlutil.Converter{toFloat}, map[string]sqlutil.Converter{"price": toString}, DriverSettings{}, &Query{Format: FormatOptionTable})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	fields := frames[0].Fields
+	if fields[0].Type() != data.FieldTypeString || fields[0].At(0) != "1.10" {
+		t.Errorf("expecting the price column to use the column converter, got %v", fields[0].At(0))
+	}
+	if fields[1].Type() != data.FieldTypeFloat64 || fields[1].At(0) != 2.5 {
+		t.Errorf("expecting the amount column to use the type converter, got %v", fields[1].At(0))
+	}
+}
+
+func TestQuery_SkipBrokenRows(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"id", "name"},
+			rows:    [][]driver.Value{{int64(1), "a"}, {"broken", "b"}, {int64(3), "c"}},
+		}, nil
+	}}
+	q := &Query{Format: FormatOptionTable}
+
+	t.Run("it should fail by default", func(t *testing.T) {
+		_, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, q)
+		if err == nil {
+			t.Fatal("expecting an error")
+		}
+	})
+
+	t.Run("it should skip the broken rows", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{SkipBrokenRows: true}, q)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		frame := frames[0]
+		if n, _ := frame.RowLen(); n != 2 {
+			t.Fatalf("expecting 2 rows, got %d", n)
+		}
+		if frame.Fields[0].At(0) != int64(1) || frame.Fields[0].At(1) != int64(3) {
+			t.Errorf("unexpected rows %v %v", frame.Fields[0].At(0), frame.Fields[0].At(1))
+		}
+		if len(frame.Meta.Notices) != 1 || frame.Meta.Notices[0].Severity != data.NoticeSeverityWarning {
+			t.Fatalf("expecting a warning notice, got %v", frame.Meta.Notices)
+		}
+		if !strings.Contains(frame.Meta.Notices[0].Text, "Skipped 1 row(s)") {
+			t.Errorf("unexpected notice %s", frame.Meta.Notices[0].Text)
+		}
+	})
+}
+
+func TestQuery_MaxRows(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"id"},
+			rows:    [][]driver.Value{{int64(1)}, {int64(2)}, {int64(3)}, {int64(4)}, {int64(5)}},
+		}, nil
+	}}
+	q := &Query{Format: FormatOptionTable}
+
+	t.Run("it should truncate the results without reading the rest of them", func(t *testing.T) {
+		fd := &fakeSQLDriver{handler: fd.handler}
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{MaxRows: 2}, q)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		frame := frames[0]
+		if n, _ := frame.RowLen(); n != 2 {
+			t.Fatalf("expecting 2 rows, got %d", n)
+		}
+		if len(frame.Meta.Notices) != 1 || frame.Meta.Notices[0].Severity != data.NoticeSeverityWarning {
+			t.Fatalf("expecting a warning notice, got %v", frame.Meta.Notices)
+		}
+		if !strings.Contains(frame.Meta.Notices[0].Text, "more than 2 row(s) were returned") {
+			t.Errorf("unexpected notice %s", frame.Meta.Notices[0].Text)
+		}
+		if read := fd.RowsRead(); read != 3 {
+			t.Errorf("expecting to read one row past the limit, read %d", read)
+		}
+	})
+
+	t.Run("it should count the dropped rows if enabled", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{MaxRows: 2, CountDroppedRows: true}, q)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if notices := frames[0].Meta.Notices; len(notices) != 1 || !strings.Contains(notices[0].Text, "3 row(s) were dropped") {
+			t.Errorf("unexpected notices %v", notices)
+		}
+	})
+
+	t.Run("it should not add a notice if the results are within the limit", func(t *testing.T) {
+		for _, maxRows := range []int64{0, 5} {
+			frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{MaxRows: maxRows}, q)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if n, _ := frames[0].RowLen(); n != 5 {
+				t.Errorf("expecting 5 rows, got %d", n)
+			}
+			if len(frames[0].Meta.Notices) != 0 {
+				t.Errorf("unexpected notices %v", frames[0].Meta.Notices)
+			}
+		}
+	})
+}
+
+func TestQuery_UseNullableFields(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"id", "value", "enabled"},
+			rows:    [][]driver.Value{{int64(1), 0.5, true}, {int64(2), nil, nil}, {int64(3), 0.0, false}},
+		}, nil
+	}}
+	q := &Query{Format: FormatOptionTable}
+
+	t.Run("it should fail to scan NULL values in non nullable columns by default", func(t *testing.T) {
+		_, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, q)
+		if err == nil {
+			t.Fatal("expecting an error")
+		}
+	})
+
+	t.Run("it should use nullable fields", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{UseNullableFields: true}, q)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		fields := frames[0].Fields
+		expected := []data.FieldType{data.FieldTypeNullableInt64, data.FieldTypeNullableFloat64, data.FieldTypeNullableBool}
+		for i, f := range fields {
+			if f.Type() != expected[i] {
+				t.Errorf("expecting field %s to be %s, got %s", f.Name, expected[i], f.Type())
+			}
+		}
+		if v := fields[1].At(1).(*float64); v != nil {
+			t.Errorf("expecting nil, got %v", *v)
+		}
+		if v := fields[2].At(1).(*bool); v != nil {
+			t.Errorf("expecting nil, got %v", *v)
+		}
+		if v := fields[1].At(2).(*float64); v == nil || *v != 0 {
+			t.Errorf("expecting 0, got %v", v)
+		}
+		if v := fields[2].At(0).(*bool); v == nil || !*v {
+			t.Errorf("expecting true, got %v", v)
+		}
+	})
+}
+
+func Test_nullableConverter(t *testing.T) {
+	convert := func(t *testing.T, scanType reflect.Type, in interface{}) interface{} {
+		c, ok := nullableConverter(sqlutil.Converter{
+			InputScanType:  scanType,
+			FrameConverter: sqlutil.FrameConverter{FieldType: data.FieldTypeFor(reflect.Zero(scanType).Interface())},
+		}, DriverSettings{DecimalSeparator: ","})
+		if !ok {
+			t.Fatal("expecting a nullable converter")
+		}
+		v, err := c.FrameConverter.ConverterFunc(&in)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return v
+	}
+
+	t.Run("it should format numbers converted to strings", func(t *testing.T) {
+		if v := convert(t, reflect.TypeOf(""), int64(65)).(*string); v == nil || *v != "65" {
+			t.Errorf("expecting 65, got %v", v)
+		}
+		if v := convert(t, reflect.TypeOf(""), 0.5).(*string); v == nil || *v != "0.5" {
+			t.Errorf("expecting 0.5, got %v", v)
+		}
+	})
+
+	t.Run("it should convert between numeric types", func(t *testing.T) {
+		if v := convert(t, reflect.TypeOf(float64(0)), int64(2)).(*float64); v == nil || *v != 2 {
+			t.Errorf("expecting 2, got %v", v)
+		}
+	})
+
+	t.Run("it should parse the numbers returned as bytes", func(t *testing.T) {
+		if v := convert(t, reflect.TypeOf(int64(0)), []byte("42")).(*int64); v == nil || *v != 42 {
+			t.Errorf("expecting 42, got %v", v)
+		}
+		if v := convert(t, reflect.TypeOf(float64(0)), []byte("1,5")).(*float64); v == nil || *v != 1.5 {
+			t.Errorf("expecting 1.5 with the decimal separator, got %v", v)
+		}
+		if v := convert(t, reflect.TypeOf(""), []byte("a")).(*string); v == nil || *v != "a" {
+			t.Errorf("expecting a, got %v", v)
+		}
+	})
+
+	t.Run("it should fail to convert invalid values", func(t *testing.T) {
+		c, _ := nullableConverter(sqlutil.Converter{
+			InputScanType:  reflect.TypeOf(int64(0)),
+			FrameConverter: sqlutil.FrameConverter{FieldType: data.FieldTypeInt64},
+		}, DriverSettings{})
+		var in interface{} = "a"
+		if _, err := c.FrameConverter.ConverterFunc(&in); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+}
+
+func TestQuery_MultipleResultSets(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"a"},
+			rows:    [][]driver.Value{{"a1"}, {"a2"}},
+			next: []fakeResult{
+				{columns: []string{"b", "c"}, rows: [][]driver.Value{{"b1", int64(1)}}},
+			},
+		}, nil
+	}}
+	q := &Query{RefID: "A", Format: FormatOptionTable}
+
+	t.Run("it should only return the first result set by default", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, q)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(frames) != 1 {
+			t.Fatalf("expecting 1 frame, got %d", len(frames))
+		}
+	})
+
+	t.Run("it should return a frame for each result set", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{MultipleResultSets: true}, q)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(frames) != 2 {
+			t.Fatalf("expecting 2 frames, got %d", len(frames))
+		}
+		if frames[0].Name != "A" || len(frames[0].Fields) != 1 || frames[0].Fields[0].Len() != 2 {
+			t.Errorf("unexpected first frame %v", frames[0])
+		}
+		if frames[1].Name != "A_1" || len(frames[1].Fields) != 2 || frames[1].Fields[1].At(0) != int64(1) {
+			t.Errorf("unexpected second frame %v", frames[1])
+		}
+	})
+}
+
+func TestQuery_TimeColumn(t *testing.T) {
+	updated := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"updated", "time", "value"},
+			rows: [][]driver.Value{
+				{updated, time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC), 1.0},
+				{updated, time.Date(2021, 7, 1, 11, 0, 0, 0, time.UTC), 2.0},
+			},
+		}, nil
+	}}
+
+	t.Run("it should use the first time column by default", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, &Query{})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if schema := frames[0].TimeSeriesSchema(); frames[0].Fields[schema.TimeIndex].Name != "updated" {
+			t.Errorf("unexpected time column %s", frames[0].Fields[schema.TimeIndex].Name)
+		}
+	})
+
+	t.Run("it should use the time column of the query", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, &Query{TimeColumn: "time"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		frame := frames[0]
+		schema := frame.TimeSeriesSchema()
+		if frame.Fields[schema.TimeIndex].Name != "time" {
+			t.Errorf("unexpected time column %s", frame.Fields[schema.TimeIndex].Name)
+		}
+		if frame.Fields[schema.TimeIndex].At(1) != time.Date(2021, 7, 1, 11, 0, 0, 0, time.UTC) {
+			t.Errorf("unexpected time %v", frame.Fields[schema.TimeIndex].At(1))
+		}
+		if len(frame.Fields) != 3 {
+			t.Errorf("expecting all the columns, got %d", len(frame.Fields))
+		}
+	})
+
+	t.Run("it should return an error if the column is not a time column", func(t *testing.T) {
+		for _, column := range []string{"value", "missing"} {
+			_, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, &Query{TimeColumn: column})
+			if !errors.Is(err, ErrorTimeColumn) {
+				t.Errorf("expecting error %v, got %v", ErrorTimeColumn, err)
+			}
+		}
+	})
+}
+
+func TestQuery_TimeSeriesFormat(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"time", "host", "value"},
+			rows: [][]driver.Value{
+				{time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC), "a", 1.0},
+				{time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC), "b", 2.0},
+				{time.Date(2021, 7, 1, 10, 0, 0, 0, time.UTC), "c", 3.0},
+				{time.Date(2021, 7, 1, 11, 0, 0, 0, time.UTC), "a", 4.0},
+				{time.Date(2021, 7, 1, 11, 0, 0, 0, time.UTC), "b", 5.0},
+				{time.Date(2021, 7, 1, 11, 0, 0, 0, time.UTC), "c", 6.0},
+			},
+		}, nil
+	}}
+
+	tests := []struct {
+		description string
+		format      TimeSeriesFormat
+		fields      int
+		rows        int
+	}{
+		{"it should return wide frames by default", "", 4, 2},
+		{"it should return wide frames", TimeSeriesWide, 4, 2},
+		{"it should return long frames", TimeSeriesLong, 3, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, &Query{TimeSeriesFormat: test.format})
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			frame := frames[0]
+			if len(frame.Fields) != test.fields {
+				t.Errorf("expecting %d fields, got %d", test.fields, len(frame.Fields))
+			}
+			if frame.Rows() != test.rows {
+				t.Errorf("expecting %d rows, got %d", test.rows, frame.Rows())
+			}
+			wide := frame.TimeSeriesSchema().Type == data.TimeSeriesTypeWide
+			if wide != (test.format != TimeSeriesLong) {
+				t.Errorf("unexpected time series type %v", frame.TimeSeriesSchema().Type)
+			}
+		})
+	}
+}
+
+func TestQuery_ExecutionTime(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		time.Sleep(50 * time.Millisecond)
+		return fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(1)}}}, nil
+	}}
+
+	frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, &Query{Format: FormatOptionTable})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	custom, ok := frames[0].Meta.Custom.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expecting custom metadata, got %v", frames[0].Meta.Custom)
+	}
+	if ms, ok := custom["executionTimeMs"].(int64); !ok || ms < 50 || ms > 5000 {
+		t.Errorf("unexpected execution time %v", custom["executionTimeMs"])
+	}
+}
+
+func TestQuery_EmptyFramesWithSchema(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"time", "value"}, rows: [][]driver.Value{}}, nil
+	}}
+
+	t.Run("it should return no results by default", func(t *testing.T) {
+		_, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{}, &Query{})
+		if !errors.Is(err, ErrorNoResults) {
+			t.Errorf("expecting error %v, got %v", ErrorNoResults, err)
+		}
+	})
+
+	t.Run("it should return a frame with the columns and no rows", func(t *testing.T) {
+		frames, err := query(context.Background(), fd.DB(), nil, nil, DriverSettings{EmptyFramesWithSchema: true}, &Query{RefID: "A"})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(frames) != 1 || frames[0].Name != "A" {
+			t.Fatalf("expecting a frame, got %v", frames)
+		}
+		if len(frames[0].Fields) != 2 || frames[0].Fields[0].Name != "time" || frames[0].Fields[1].Name != "value" {
+			t.Errorf("expecting the columns of the query, got %v", frames[0].Fields)
+		}
+		if frames[0].Rows() != 0 {
+			t.Errorf("expecting no rows, got %d", frames[0].Rows())
+		}
+	})
+}
+
+func TestQuery_FieldNameTransform(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"ID", "Price"}, rows: [][]driver.Value{{int64(1), "2.5"}}}, nil
+	}}
+	toString := sqlutil.Converter{
+		Name:          "price converter",
+		InputScanType: reflect.TypeOf(""),
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType:     data.FieldTypeString,
+			ConverterFunc: func(in interface{}) (interface{}, error) { return "$" + *in.(*string), nil },
+		},
+	}
+
+	settings := DriverSettings{FieldNameTransform: strings.ToLower}
+	frames, err := query(context.Background(), fd.DB(), nil, map[string]sqlutil.Converter{"Price": toString}, settings, &Query{Format: FormatOptionTable})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	fields := frames[0].Fields
+	if fields[0].Name != "id" || fields[1].Name != "price" {
+		t.Errorf("expecting the fields to be renamed, got %s and %s", fields[0].Name, fields[1].Name)
+	}
+	if fields[1].At(0) != "$2.5" {
+		t.Errorf("expecting the column converter to match the column name, got %v", fields[1].At(0))
+	}
+}
+
+func TestQuery_TypeRewrite(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{
+			columns: []string{"enabled", "mask", "amount", "code"},
+			types:   []string{"BIT", "BIT", "NUMERIC", "NUMERIC"},
+			rows:    [][]driver.Value{{int64(1), int64(5), "2.5", "007"}},
+		}, nil
+	}}
+	toBool := sqlutil.Converter{
+		Name:          "boolean converter",
+		InputScanType: reflect.TypeOf(int64(0)),
+		InputTypeName: "BOOLEAN",
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType:     data.FieldTypeBool,
+			ConverterFunc: func(in interface{}) (interface{}, error) { return *in.(*int64) != 0, nil },
+		},
+	}
+	toFloat := sqlutil.Converter{
+		Name:          "numeric to float",
+		InputScanType: reflect.TypeOf(""),
+		InputTypeName: "NUMERIC",
+		FrameConverter: sqlutil.FrameConverter{
+			FieldType: data.FieldTypeFloat64,
+			ConverterFunc: func(in interface{}) (interface{}, error) {
+				return strconv.ParseFloat(*in.(*string), 64)
+			},
+		},
+	}
+
+	// The bit masks are not booleans, and the codes are not numbers
+	settings := DriverSettings{TypeRewrite: func(colName, dbType string) string {
+		switch {
+		case dbType == "BIT" && colName != "mask":
+			return "BOOLEAN"
+		case colName == "code":
+			return "VARCHAR"
+		}
+		return dbType
+	}}
+	frames, err := query(context.Background(), fd.DB(), []sqlutil.Converter{toBool, toFloat}, nil, settings, &Query{Format: FormatOptionTable})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	fields := frames[0].Fields
+	if fields[0].Type() != data.FieldTypeBool || fields[0].At(0) != true {
+		t.Errorf("expecting the BIT column to use the boolean converter, got %s %v", fields[0].Type(), fields[0].At(0))
+	}
+	if fields[1].Type() == data.FieldTypeBool {
+		t.Errorf("expecting the mask column to use the default converter, got %s", fields[1].Type())
+	}
+	if fields[2].Type() != data.FieldTypeFloat64 || fields[2].At(0) != 2.5 {
+		t.Errorf("expecting the NUMERIC column to keep its converter, got %s %v", fields[2].Type(), fields[2].At(0))
+	}
+	if fields[3].Type() == data.FieldTypeFloat64 {
+		t.Errorf("expecting the rewritten NUMERIC column to use the default converter, got %s", fields[3].Type())
+	}
+}
@@ -17,6 +17,23 @@ func (r *Response) Set(refID string, res backend.DataResponse) {
 	r.mtx.Unlock()
 }
 
+// Append adds the frames of res to the response of the RefID, after the frames it already has.
+// The first error of the RefID is kept.
+func (r *Response) Append(refID string, res backend.DataResponse) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	existing, ok := r.res.Responses[refID]
+	if !ok {
+		r.res.Responses[refID] = res
+		return
+	}
+	existing.Frames = append(existing.Frames, res.Frames...)
+	if existing.Error == nil {
+		existing.Error = res.Error
+	}
+	r.res.Responses[refID] = existing
+}
+
 func (r *Response) Response() *backend.QueryDataResponse {
 	return r.res
 }
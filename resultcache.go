@@ -0,0 +1,144 @@
+package sqlds
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// defaultResultCacheMaxEntries is the number of results cached if DriverSettings.ResultCacheMaxEntries is not set
+const defaultResultCacheMaxEntries = 100
+
+// resultCacheEntry is a cached query result. The frames are serialized, so that the cached ones can't be modified.
+type resultCacheEntry struct {
+	key           string
+	datasourceUID string
+	frames        [][]byte
+	expires       time.Time
+}
+
+// resultCache is a LRU cache of query results
+type resultCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List
+}
+
+func newResultCache(maxEntries int) *resultCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultResultCacheMaxEntries
+	}
+	return &resultCache{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// resultCacheKey identifies the result of a query by datasource, RefID, time range and the interpolated query
+func resultCacheKey(datasourceUID string, q *Query) (string, error) {
+	// The query fields that are not serialized are added to the key
+	b, err := json.Marshal(q)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%d-%d-%s", datasourceUID, q.RefID, q.TimeRange.From.UnixNano(), q.TimeRange.To.UnixNano(), string(b)), nil
+}
+
+// get returns a copy of the cached frames, or false if they are not cached or have expired
+func (c *resultCache) get(key string) (data.Frames, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*resultCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	frames := make(data.Frames, len(entry.frames))
+	for i, b := range entry.frames {
+		frame, err := data.UnmarshalArrowFrame(b)
+		if err != nil {
+			return nil, false
+		}
+		frames[i] = frame
+	}
+	c.order.MoveToFront(elem)
+	return frames, true
+}
+
+// set caches the frames of the datasource for the given duration, evicting the least recently used result if the cache is full
+func (c *resultCache) set(key, datasourceUID string, frames data.Frames, ttl time.Duration) error {
+	serialized := make([][]byte, len(frames))
+	for i, frame := range frames {
+		b, err := frame.MarshalArrow()
+		if err != nil {
+			return err
+		}
+		serialized[i] = b
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &resultCacheEntry{key, datasourceUID, serialized, time.Now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultCacheEntry).key)
+	}
+	return nil
+}
+
+// deleteDatasources removes the results of the datasources matched by their UID
+func (c *resultCache) deleteDatasources(match func(datasourceUID string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if match(elem.Value.(*resultCacheEntry).datasourceUID) {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// getResultCache returns the result cache of the datasource, creating it on first use
+func (ds *sqldatasource) getResultCache() *resultCache {
+	ds.resultCacheOnce.Do(func() {
+		ds.resultCache = newResultCache(ds.driverSettings.ResultCacheMaxEntries)
+	})
+	return ds.resultCache
+}
+
+// cachedResultKey returns the key of the query result in the cache, or an empty string if the result shouldn't be cached
+func (ds *sqldatasource) cachedResultKey(datasourceUID string, q *Query, settings DriverSettings) string {
+	if settings.ResultCacheTTL == 0 || settings.StreamRows {
+		return ""
+	}
+	if time.Since(q.TimeRange.To) < settings.ResultCacheFreshness {
+		return ""
+	}
+	key, err := resultCacheKey(datasourceUID, q)
+	if err != nil {
+		return ""
+	}
+	return key
+}
@@ -0,0 +1,112 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+func Test_RunQuery_ResultCache(t *testing.T) {
+	lastWeek := backend.TimeRange{From: time.Now().Add(-8 * 24 * time.Hour), To: time.Now().Add(-7 * 24 * time.Hour)}
+	setup := func(settings DriverSettings) (*sqldatasource, *fakeSQLDriver) {
+		fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+			return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}, {"b"}}}, nil
+		}}
+		db := fd.DB()
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: settings}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+		return ds, fd
+	}
+	run := func(t *testing.T, ds *sqldatasource, timeRange backend.TimeRange) data.Frames {
+		t.Helper()
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", TimeRange: timeRange, JSON: []byte(`{"rawSql": "select a from $__table", "table": "t", "format": 1}`)}, "uid1")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return frames
+	}
+
+	t.Run("it should return the cached result", func(t *testing.T) {
+		ds, fd := setup(DriverSettings{ResultCacheTTL: time.Minute})
+		first := run(t, ds, lastWeek)
+		// The cached frames can't be modified through the returned ones
+		first[0].Fields[0].Set(0, "modified")
+		second := run(t, ds, lastWeek)
+
+		if len(fd.Queries()) != 1 {
+			t.Errorf("expecting the query to run once, got %v", fd.Queries())
+		}
+		if len(second) != 1 || second[0].Rows() != 2 || second[0].Fields[0].At(0) != "a" {
+			t.Errorf("unexpected cached frames %v", second)
+		}
+		if second[0].Name != "A" || second[0].Meta.ExecutedQueryString != "select a from t" {
+			t.Errorf("expecting the frame name and metadata to be cached, got %s %v", second[0].Name, second[0].Meta)
+		}
+	})
+
+	t.Run("it should not return the result of another time range", func(t *testing.T) {
+		ds, fd := setup(DriverSettings{ResultCacheTTL: time.Minute})
+		run(t, ds, lastWeek)
+		run(t, ds, backend.TimeRange{From: lastWeek.From.Add(time.Hour), To: lastWeek.To.Add(time.Hour)})
+		if len(fd.Queries()) != 2 {
+			t.Errorf("expecting the query to run twice, got %v", fd.Queries())
+		}
+	})
+
+	t.Run("it should not cache the recent time ranges", func(t *testing.T) {
+		ds, fd := setup(DriverSettings{ResultCacheTTL: time.Minute, ResultCacheFreshness: time.Hour})
+		lastHour := backend.TimeRange{From: time.Now().Add(-time.Hour), To: time.Now()}
+		run(t, ds, lastHour)
+		run(t, ds, lastHour)
+		run(t, ds, lastWeek)
+		run(t, ds, lastWeek)
+		if len(fd.Queries()) != 3 {
+			t.Errorf("expecting only the last week query to be cached, got %v", fd.Queries())
+		}
+	})
+
+	t.Run("it should expire the cached results", func(t *testing.T) {
+		ds, fd := setup(DriverSettings{ResultCacheTTL: time.Millisecond})
+		run(t, ds, lastWeek)
+		time.Sleep(5 * time.Millisecond)
+		run(t, ds, lastWeek)
+		if len(fd.Queries()) != 2 {
+			t.Errorf("expecting the query to run twice, got %v", fd.Queries())
+		}
+	})
+
+	t.Run("it should not cache by default", func(t *testing.T) {
+		ds, fd := setup(DriverSettings{})
+		run(t, ds, lastWeek)
+		run(t, ds, lastWeek)
+		if len(fd.Queries()) != 2 {
+			t.Errorf("expecting the query to run twice, got %v", fd.Queries())
+		}
+	})
+}
+
+func Test_resultCache_evict(t *testing.T) {
+	c := newResultCache(2)
+	for _, key := range []string{"a", "b"} {
+		if err := c.set(key, "uid1", data.Frames{data.NewFrame(key)}, time.Minute); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	// a is used more recently than b
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("expecting a to be cached")
+	}
+	if err := c.set("c", "uid1", data.Frames{data.NewFrame("c")}, time.Minute); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for key, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.get(key); ok != cached {
+			t.Errorf("expecting %s to be cached: %v", key, cached)
+		}
+	}
+}
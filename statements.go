@@ -0,0 +1,231 @@
+package sqlds
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// dollarQuoteRegex matches the opening tag of a Postgres dollar-quoted string (e.g. $$ or $body$)
+var dollarQuoteRegex = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// splitStatements splits rawSQL in statements separated by semicolons.
+// Semicolons within quotes, dollar-quoted strings or comments are not treated as separators.
+// Empty statements are discarded, but at least one statement is always returned.
+func splitStatements(rawSQL string) []string {
+	var (
+		statements []string
+		start      int
+	)
+	add := func(s string) {
+		if s = strings.TrimSpace(s); s != "" {
+			statements = append(statements, s)
+		}
+	}
+
+	for i := 0; i < len(rawSQL); i++ {
+		if end, _ := skipToken(rawSQL, i); end > i {
+			i = end - 1
+			continue
+		}
+		if rawSQL[i] == ';' {
+			add(rawSQL[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(rawSQL) {
+		add(rawSQL[start:])
+	}
+
+	if len(statements) == 0 {
+		return []string{rawSQL}
+	}
+	return statements
+}
+
+// skipToken returns the end of the quoted string or comment starting at rawSQL[i], and whether it's a comment.
+// It returns i if there is no string or comment at that position. Unterminated strings and comments end with rawSQL.
+func skipToken(rawSQL string, i int) (int, bool) {
+	tokenEnd := func(offset int, terminator string) int {
+		if end := strings.Index(rawSQL[offset:], terminator); end >= 0 {
+			return offset + end + len(terminator)
+		}
+		return len(rawSQL)
+	}
+
+	switch c := rawSQL[i]; {
+	case c == '\'' || c == '"' || c == '`':
+		return tokenEnd(i+1, string(c)), false
+	case c == '$':
+		tag := dollarQuoteRegex.FindString(rawSQL[i:])
+		if tag == "" {
+			return i, false
+		}
+		return tokenEnd(i+len(tag), tag), false
+	case strings.HasPrefix(rawSQL[i:], "--"):
+		// The line break is not part of the comment
+		if end := strings.IndexByte(rawSQL[i:], '\n'); end >= 0 {
+			return i + end, true
+		}
+		return len(rawSQL), true
+	case strings.HasPrefix(rawSQL[i:], "/*"):
+		return tokenEnd(i+2, "*/"), true
+	}
+	return i, false
+}
+
+// findComments returns the start and end of each comment in rawSQL, ignoring the comment markers within quotes
+func findComments(rawSQL string) [][]int {
+	var comments [][]int
+	for i := 0; i < len(rawSQL); i++ {
+		end, comment := skipToken(rawSQL, i)
+		if comment {
+			comments = append(comments, []int{i, end})
+		}
+		if end > i {
+			i = end - 1
+		}
+	}
+	return comments
+}
+
+// readOnlyKeywords are the leading keywords of the statements allowed by DriverSettings.ReadOnly
+var readOnlyKeywords = map[string]bool{"SELECT": true, "WITH": true, "SHOW": true}
+
+// sqlToken is a word in upper case, a quoted identifier or literal, or one of the punctuation characters ( ) , and .
+type sqlToken struct {
+	word  string
+	punct byte
+}
+
+// sqlTokens returns the tokens of rawSQL, ignoring the comments and the rest of the punctuation
+func sqlTokens(rawSQL string) []sqlToken {
+	var tokens []sqlToken
+	isWordChar := func(c byte) bool {
+		return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	for i := 0; i < len(rawSQL); i++ {
+		if end, comment := skipToken(rawSQL, i); end > i {
+			if !comment {
+				tokens = append(tokens, sqlToken{word: rawSQL[i:end]})
+			}
+			i = end - 1
+			continue
+		}
+		switch c := rawSQL[i]; {
+		case c == '(' || c == ')' || c == ',' || c == '.':
+			tokens = append(tokens, sqlToken{punct: c})
+		case isWordChar(c):
+			end := i
+			for end < len(rawSQL) && isWordChar(rawSQL[end]) {
+				end++
+			}
+			tokens = append(tokens, sqlToken{word: strings.ToUpper(rawSQL[i:end])})
+			i = end - 1
+		}
+	}
+	return tokens
+}
+
+// closingParen returns the index of the parenthesis closing the one at tokens[i], or -1 if it's not closed
+func closingParen(tokens []sqlToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i].punct {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// checkReadOnly returns ErrorReadOnly if rawSQL contains several statements or a statement that doesn't start with
+// one of the readOnlyKeywords. Only the leading keywords are checked, ignoring the comments, so identifiers like
+// t.update are allowed.
+// It's a safeguard against mistakes, not a replacement for a read-only database user.
+func checkReadOnly(rawSQL string) error {
+	if len(splitStatements(rawSQL)) > 1 {
+		return fmt.Errorf("%w: multiple statements are not allowed", ErrorReadOnly)
+	}
+	return checkReadOnlyStatement(sqlTokens(rawSQL))
+}
+
+// checkReadOnlyStatement checks the leading keyword of the statement. The statements of a WITH clause and the one
+// following them are checked too, as well as SELECT ... INTO, which creates a table.
+func checkReadOnlyStatement(tokens []sqlToken) error {
+	i := 0
+	for i < len(tokens) && tokens[i].punct == '(' {
+		i++
+	}
+	if i == len(tokens) || !readOnlyKeywords[tokens[i].word] {
+		keyword := ""
+		if i < len(tokens) {
+			keyword = tokens[i].word
+		}
+		return fmt.Errorf("%w: %s statements are not allowed", ErrorReadOnly, keyword)
+	}
+
+	switch tokens[i].word {
+	case "WITH":
+		return checkReadOnlyWith(tokens[i+1:])
+	case "SELECT":
+		for j := i + 1; j < len(tokens); j++ {
+			if tokens[j].word == "INTO" && tokens[j-1].punct != '.' {
+				return fmt.Errorf("%w: SELECT ... INTO is not allowed", ErrorReadOnly)
+			}
+		}
+	}
+	return nil
+}
+
+// checkReadOnlyWith checks the statements of the common table expressions following WITH, e.g.
+// [RECURSIVE] name [(columns)] AS [[NOT] MATERIALIZED] (statement), ..., and the statement following them
+func checkReadOnlyWith(tokens []sqlToken) error {
+	errMalformed := fmt.Errorf("%w: the WITH clause can't be parsed", ErrorReadOnly)
+	i := 0
+	if i < len(tokens) && tokens[i].word == "RECURSIVE" {
+		i++
+	}
+	for {
+		// The name of the common table expression and its optional columns
+		if i >= len(tokens) || tokens[i].word == "" {
+			return errMalformed
+		}
+		i++
+		if i < len(tokens) && tokens[i].punct == '(' {
+			if i = closingParen(tokens, i); i < 0 {
+				return errMalformed
+			}
+			i++
+		}
+		if i >= len(tokens) || tokens[i].word != "AS" {
+			return errMalformed
+		}
+		i++
+		if i < len(tokens) && tokens[i].word == "NOT" {
+			i++
+		}
+		if i < len(tokens) && tokens[i].word == "MATERIALIZED" {
+			i++
+		}
+		if i >= len(tokens) || tokens[i].punct != '(' {
+			return errMalformed
+		}
+		end := closingParen(tokens, i)
+		if end < 0 {
+			return errMalformed
+		}
+		if err := checkReadOnlyStatement(tokens[i+1 : end]); err != nil {
+			return err
+		}
+		i = end + 1
+		if i >= len(tokens) || tokens[i].punct != ',' {
+			return checkReadOnlyStatement(tokens[i:])
+		}
+		i++
+	}
+}
@@ -0,0 +1,76 @@
+package sqlds
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_splitStatements(t *testing.T) {
+	tests := []struct {
+		desc     string
+		input    string
+		expected []string
+	}{
+		{desc: "single statement", input: "select 1", expected: []string{"select 1"}},
+		{desc: "trailing semicolon", input: "select 1;", expected: []string{"select 1"}},
+		{desc: "multiple statements", input: "create table foo (id int); insert into foo values (1);\nselect * from foo", expected: []string{"create table foo (id int)", "insert into foo values (1)", "select * from foo"}},
+		{desc: "semicolon within a string literal", input: "insert into foo values ('a;b'); select 'c;d'", expected: []string{"insert into foo values ('a;b')", "select 'c;d'"}},
+		{desc: "semicolon within a quoted identifier", input: `select "a;b" from foo`, expected: []string{`select "a;b" from foo`}},
+		{desc: "semicolon within a dollar-quoted block", input: "create function f() returns int as $$ begin return 1; end; $$ language plpgsql; select f()", expected: []string{"create function f() returns int as $$ begin return 1; end; $$ language plpgsql", "select f()"}},
+		{desc: "semicolon within a tagged dollar-quoted block", input: "do $body$ begin perform 1; end $body$; select 1", expected: []string{"do $body$ begin perform 1; end $body$", "select 1"}},
+		{desc: "positional parameters are not dollar quotes", input: "select $1; select $2", expected: []string{"select $1", "select $2"}},
+		{desc: "semicolon within comments", input: "select 1 -- first; second\n; /* a;b */ select 2", expected: []string{"select 1 -- first; second", "/* a;b */ select 2"}},
+		{desc: "empty query", input: "", expected: []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert.Equal(t, tt.expected, splitStatements(tt.input))
+		})
+	}
+}
+
+func Test_checkReadOnly(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   string
+		allowed bool
+	}{
+		{desc: "select", input: "SELECT * FROM foo", allowed: true},
+		{desc: "lower case select", input: "select * from foo;", allowed: true},
+		{desc: "with", input: "with a as (select 1) select * from a", allowed: true},
+		{desc: "show", input: "SHOW TABLES", allowed: true},
+		{desc: "parenthesized select", input: "(select 1) union (select 2)", allowed: true},
+		{desc: "leading line comment", input: "-- delete from foo\nselect 1", allowed: true},
+		{desc: "leading block comment", input: "/* user=admin */ select 1", allowed: true},
+		{desc: "delete", input: "DELETE FROM foo"},
+		{desc: "drop", input: "drop table foo"},
+		{desc: "leading comment before delete", input: "/* select */ delete from foo"},
+		{desc: "multiple statements", input: "select 1; select 2"},
+		{desc: "select followed by delete", input: "select 1; delete from foo"},
+		{desc: "empty query", input: ""},
+		{desc: "delete in a with clause", input: "WITH d AS (DELETE FROM t RETURNING *) SELECT * FROM d"},
+		{desc: "select into", input: "SELECT * INTO new_table FROM t"},
+		{desc: "insert in a with clause", input: "with a as (select 1) insert into foo select * from a"},
+		{desc: "keywords in literals and comments", input: "select 'delete', \"insert\" /* drop */ from foo -- update\n", allowed: true},
+		{desc: "keywords within identifiers", input: "select created_at, last_update from foo", allowed: true},
+		{desc: "qualified keyword column", input: "select t.update, t.delete, t.into from t", allowed: true},
+		{desc: "keyword as a column", input: "select update from t where drop = 1", allowed: true},
+		{desc: "keyword in a function name", input: "select create_date(t.create) from t", allowed: true},
+		{desc: "several common table expressions", input: "with recursive a (n) as (select 1), b as materialized ((select n from a)) select t.insert from b", allowed: true},
+		{desc: "delete in the second common table expression", input: "with a as (select 1), b as (delete from t returning *) select * from b"},
+		{desc: "update after a common table expression", input: "with a as (select 1) update t set x = 1"},
+		{desc: "malformed with clause", input: "with a select 1"},
+		{desc: "parenthesized select into", input: "(select * into t2 from t)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := checkReadOnly(tt.input)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrorReadOnly)
+			}
+		})
+	}
+}
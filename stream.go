@@ -0,0 +1,172 @@
+package sqlds
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/data/sqlutil"
+)
+
+// defaultStreamChunkSize is the number of rows per frame if DriverSettings.StreamChunkSize is not set
+const defaultStreamChunkSize = 1000
+
+// streamPathPrefix is the prefix of the channel paths used to stream the query results
+const streamPathPrefix = "query/"
+
+// pendingStreamTTL is how long a streamed query waits for a subscriber before it's dropped
+const pendingStreamTTL = time.Minute
+
+// ErrorStreamNotFound is returned when running a stream that doesn't exist, that has already run or that has expired
+var ErrorStreamNotFound = errors.New("stream not found")
+
+// pendingStream is a streamed query waiting for a subscriber. It doesn't hold the connection of the query, which is
+// fetched again when the stream runs, so that it's not kept open after being evicted.
+type pendingStream struct {
+	query         *Query
+	datasourceUID string
+	settings      DriverSettings
+	expires       time.Time
+}
+
+// newStream stores the query so its results can be streamed, returning a frame with the channel to subscribe to.
+// The streams that were never run are dropped once they expire.
+func (ds *sqldatasource) newStream(q *Query, datasourceUID string, settings DriverSettings) (data.Frames, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return getErrorFrameFromQuery(q), err
+	}
+	now := time.Now()
+	deleteMatching(&ds.streams, func(key, value interface{}) bool {
+		return now.After(value.(pendingStream).expires)
+	})
+	path := streamPathPrefix + hex.EncodeToString(id)
+	ds.streams.Store(path, pendingStream{q, datasourceUID, settings, now.Add(pendingStreamTTL)})
+
+	frame := data.NewFrame(q.RefID)
+	frame.Meta = &data.FrameMeta{
+		ExecutedQueryString: q.RawSQL,
+		Channel:             fmt.Sprintf("ds/%s/%s", datasourceUID, path),
+	}
+	return data.Frames{frame}, nil
+}
+
+// SubscribeStream allows subscribing to the channels of the streamed queries
+func (ds *sqldatasource) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if v, ok := ds.streams.Load(req.Path); !ok || time.Now().After(v.(pendingStream).expires) {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK, UseRunStream: true}, nil
+}
+
+// PublishStream rejects all the publications, the streams are read only
+func (ds *sqldatasource) PublishStream(ctx context.Context, req *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream runs a streamed query and sends its results in frames of DriverSettings.StreamChunkSize rows
+func (ds *sqldatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender backend.StreamPacketSender) error {
+	v, ok := ds.streams.LoadAndDelete(req.Path)
+	if !ok || time.Now().After(v.(pendingStream).expires) {
+		return fmt.Errorf("%w: %s", ErrorStreamNotFound, req.Path)
+	}
+	stream := v.(pendingStream)
+
+	// The connection may have been replaced since the query was received
+	_, dbConn, err := ds.getDBConnectionFromQuery(stream.query, stream.datasourceUID)
+	if err != nil {
+		return err
+	}
+
+	if stream.settings.Timeout != 0 {
+		tctx, cancel := context.WithTimeout(ctx, stream.settings.Timeout)
+		defer cancel()
+
+		ctx = tctx
+	}
+
+	db, release, err := setStatementTimeout(ctx, dbConn.db, stream.settings)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The statements are run as in query, only the rows of the last one are streamed
+	query := bindQuery(stream.settings, stream.query)
+	if err := execStatements(ctx, db, query); err != nil {
+		return err
+	}
+	last := len(query.statements) - 1
+	rows, err := db.QueryContext(ctx, query.statements[last], query.statementArgs[last]...)
+	if err != nil {
+		return queryError(err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			backend.Logger.Error(err.Error())
+		}
+	}()
+
+	chunkSize := stream.settings.StreamChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultStreamChunkSize
+	}
+	mutator, mutate := ds.c.(ResponseMutator)
+	return streamFrames(rows, chunkSize, ds.c.Converters(), ds.columnConverters(), stream.settings, query, func(frame *data.Frame) error {
+		frames := data.Frames{frame}
+		if mutate {
+			if frames, err = mutator.MutateResponse(ctx, frames); err != nil {
+				return ds.mapError(err)
+			}
+		}
+		for _, frame := range frames {
+			b, err := data.FrameToJSON(frame, true, true)
+			if err != nil {
+				return err
+			}
+			if err := sender.Send(&backend.StreamPacket{Data: b}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// streamFrames reads the rows in frames of chunkSize rows, calling send for each of them. The rows are limited by
+// DriverSettings.MaxRows and the broken ones skipped if DriverSettings.SkipBrokenRows is set, as in query, with the
+// notices in the last frame.
+func streamFrames(rows *sql.Rows, chunkSize int, converters []sqlutil.Converter, columnConverters map[string]sqlutil.Converter, settings DriverSettings, query *Query, send func(*data.Frame) error) error {
+	reader, err := newRowReader(rows, rowLimit(settings), converters, columnConverters, settings)
+	if err != nil {
+		return err
+	}
+
+	for {
+		frame := reader.newFrame()
+		frame.Name = query.RefID
+		frame.Meta = &data.FrameMeta{ExecutedQueryString: query.RawSQL}
+		more, err := reader.read(frame, chunkSize)
+		if err != nil {
+			return err
+		}
+		if !more {
+			if err := rows.Err(); err != nil {
+				return queryError(err)
+			}
+			reader.appendSkippedNotice(frame)
+			if frame.Rows() > 0 || len(frame.Meta.Notices) > 0 {
+				return send(frame)
+			}
+			return nil
+		}
+		if err := send(frame); err != nil {
+			return err
+		}
+	}
+}
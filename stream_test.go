@@ -0,0 +1,204 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRowsDriver(count int) *fakeSQLDriver {
+	rows := make([][]driver.Value, count)
+	for i := range rows {
+		rows[i] = []driver.Value{int64(i)}
+	}
+	return &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"id"}, rows: rows}, nil
+	}}
+}
+
+type fakeStreamSender struct {
+	packets []*backend.StreamPacket
+}
+
+func (s *fakeStreamSender) Send(packet *backend.StreamPacket) error {
+	s.packets = append(s.packets, packet)
+	return nil
+}
+
+func Test_streamFrames(t *testing.T) {
+	db := newRowsDriver(10000).DB()
+	rows, err := db.Query("select id from foo")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	sizes := []int{}
+	err = streamFrames(rows, 3000, nil, nil, DriverSettings{}, &Query{RefID: "A"}, func(frame *data.Frame) error {
+		assert.Equal(t, "A", frame.Name)
+		sizes = append(sizes, frame.Rows())
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{3000, 3000, 3000, 1000}, sizes)
+}
+
+func Test_RunStream(t *testing.T) {
+	db := newRowsDriver(10000).DB()
+	ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{StreamRows: true, StreamChunkSize: 2500}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select id from foo"}`)}, "uid1")
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+	channel := frames[0].Meta.Channel
+	require.True(t, strings.HasPrefix(channel, "ds/uid1/"+streamPathPrefix), channel)
+	path := strings.TrimPrefix(channel, "ds/uid1/")
+
+	sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: path})
+	require.NoError(t, err)
+	assert.Equal(t, backend.SubscribeStreamStatusOK, sub.Status)
+	assert.True(t, sub.UseRunStream)
+
+	sender := &fakeStreamSender{}
+	require.NoError(t, ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: path}, sender))
+	require.Len(t, sender.packets, 4)
+	for _, packet := range sender.packets {
+		frame := &data.Frame{}
+		require.NoError(t, frame.UnmarshalJSON(packet.Data))
+		assert.Equal(t, 2500, frame.Rows())
+	}
+
+	t.Run("it should not run a stream twice", func(t *testing.T) {
+		err := ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: path}, sender)
+		assert.True(t, errors.Is(err, ErrorStreamNotFound))
+
+		sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: path})
+		require.NoError(t, err)
+		assert.Equal(t, backend.SubscribeStreamStatus(backend.SubscribeStreamStatusNotFound), sub.Status)
+	})
+}
+
+func Test_RunStream_connection(t *testing.T) {
+	fd := newRowsDriver(10)
+	db := fd.DB()
+	ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{StreamRows: true, Timeout: time.Minute, StatementTimeoutSQL: "SET statement_timeout = %d"}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+	newPath := func(t *testing.T) string {
+		t.Helper()
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(`{"rawSql": "select id from foo"}`)}, "uid1")
+		require.NoError(t, err)
+		return strings.TrimPrefix(frames[0].Meta.Channel, "ds/uid1/")
+	}
+
+	t.Run("it should run the stream with the current connection and the statement timeout", func(t *testing.T) {
+		path := newPath(t)
+		replaced := newRowsDriver(10)
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{replaced.DB(), backend.DataSourceInstanceSettings{}})
+
+		require.NoError(t, ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: path}, &fakeStreamSender{}))
+		assert.Empty(t, fd.Queries())
+		assert.Equal(t, []string{"SET statement_timeout = 60000", "select id from foo"}, replaced.Queries())
+	})
+
+	t.Run("it should drop the streams that expired", func(t *testing.T) {
+		path := newPath(t)
+		v, _ := ds.streams.Load(path)
+		stream := v.(pendingStream)
+		stream.expires = time.Now().Add(-time.Second)
+		ds.streams.Store(path, stream)
+
+		sub, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{Path: path})
+		require.NoError(t, err)
+		assert.Equal(t, backend.SubscribeStreamStatus(backend.SubscribeStreamStatusNotFound), sub.Status)
+
+		newPath(t)
+		_, ok := ds.streams.Load(path)
+		assert.False(t, ok)
+		err = ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: path}, &fakeStreamSender{})
+		assert.True(t, errors.Is(err, ErrorStreamNotFound))
+	})
+}
+
+func Test_RunStream_query(t *testing.T) {
+	run := func(t *testing.T, ds *sqldatasource, rawSQL string) []*data.Frame {
+		t.Helper()
+		frames, err := runDataQuery(context.Background(), ds, backend.DataQuery{RefID: "A", JSON: []byte(rawSQL)}, "uid1")
+		require.NoError(t, err)
+		sender := &fakeStreamSender{}
+		require.NoError(t, ds.RunStream(context.Background(), &backend.RunStreamRequest{Path: strings.TrimPrefix(frames[0].Meta.Channel, "ds/uid1/")}, sender))
+		res := []*data.Frame{}
+		for _, packet := range sender.packets {
+			frame := &data.Frame{}
+			require.NoError(t, frame.UnmarshalJSON(packet.Data))
+			res = append(res, frame)
+		}
+		return res
+	}
+
+	t.Run("it should run every statement with its arguments", func(t *testing.T) {
+		fd := newRowsDriver(3)
+		db := fd.DB()
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{StreamRows: true, AllowMultipleStatements: true, PlaceholderStyle: PlaceholderDollar}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+		frames := run(t, ds, `{"rawSql": "set x = $__arg(b); select id from foo where a = $__arg(a) and b = $__arg(b)", "args": {"a": "x", "b": 2}}`)
+		require.Len(t, frames, 1)
+		assert.Equal(t, []string{"set x = $1", "select id from foo where a = $1 and b = $2"}, fd.Queries())
+		assert.Equal(t, [][]interface{}{{float64(2)}, {"x", float64(2)}}, fd.Args())
+		assert.Equal(t, "set x = $1; select id from foo where a = $1 and b = $2", frames[0].Meta.ExecutedQueryString)
+	})
+
+	t.Run("it should limit the rows", func(t *testing.T) {
+		db := newRowsDriver(10).DB()
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{StreamRows: true, StreamChunkSize: 3, MaxRows: 5}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+		frames := run(t, ds, `{"rawSql": "select id from foo"}`)
+		require.Len(t, frames, 2)
+		assert.Equal(t, 3, frames[0].Rows())
+		assert.Equal(t, 2, frames[1].Rows())
+		require.Len(t, frames[1].Meta.Notices, 1)
+		assert.Contains(t, frames[1].Meta.Notices[0].Text, "limited to 5")
+	})
+
+	t.Run("it should skip the broken rows", func(t *testing.T) {
+		fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+			return fakeResult{columns: []string{"id"}, rows: [][]driver.Value{{int64(1)}, {nil}, {int64(3)}}}, nil
+		}}
+		db := fd.DB()
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{StreamRows: true, SkipBrokenRows: true}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+		frames := run(t, ds, `{"rawSql": "select id from foo"}`)
+		require.Len(t, frames, 1)
+		assert.Equal(t, 2, frames[0].Rows())
+		require.Len(t, frames[0].Meta.Notices, 1)
+		assert.Equal(t, "Skipped 1 row(s) that could not be read", frames[0].Meta.Notices[0].Text)
+	})
+
+	t.Run("it should mutate the frames", func(t *testing.T) {
+		db := newRowsDriver(4).DB()
+		d := &responseDriver{fakeDriver: fakeDriver{db: db}, mutate: func(frames data.Frames) (data.Frames, error) {
+			for _, frame := range frames {
+				frame.Name = "mutated"
+			}
+			return frames, nil
+		}}
+		ds := &sqldatasource{c: d, driverSettings: DriverSettings{StreamRows: true, StreamChunkSize: 2}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, backend.DataSourceInstanceSettings{}})
+
+		frames := run(t, ds, `{"rawSql": "select id from foo"}`)
+		require.Len(t, frames, 2)
+		for _, frame := range frames {
+			assert.Equal(t, "mutated", frame.Name)
+		}
+	})
+}
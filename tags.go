@@ -0,0 +1,100 @@
+package sqlds
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// dashboardUIDHeader is the header used by Grafana to send the UID of the dashboard running the queries
+	dashboardUIDHeader = "X-Dashboard-Uid"
+	// panelIDHeader is the header used by Grafana to send the ID of the panel running the queries
+	panelIDHeader = "X-Panel-Id"
+)
+
+// QueryTags identify who runs the queries, so that they can be attributed in the database logs
+type QueryTags struct {
+	User         string
+	DashboardUID string
+	PanelID      string
+}
+
+type queryTagsKey struct{}
+
+// QueryTagsFromContext returns the tags of the request running the query.
+// Drivers can use it in the context received by QueryMutator or the database connection.
+func QueryTagsFromContext(ctx context.Context) QueryTags {
+	tags, _ := ctx.Value(queryTagsKey{}).(QueryTags)
+	return tags
+}
+
+func withQueryTags(ctx context.Context, tags QueryTags) context.Context {
+	return context.WithValue(ctx, queryTagsKey{}, tags)
+}
+
+// getQueryTags returns the user and the dashboard of the request
+func getQueryTags(req *backend.QueryDataRequest) QueryTags {
+	tags := QueryTags{}
+	if req.PluginContext.User != nil {
+		tags.User = req.PluginContext.User.Login
+	}
+	for name, value := range req.Headers {
+		if strings.EqualFold(name, dashboardUIDHeader) {
+			tags.DashboardUID = value
+		}
+		if strings.EqualFold(name, panelIDHeader) {
+			tags.PanelID = value
+		}
+	}
+	return tags
+}
+
+// sanitizeTag removes the characters that could end the comment or break the query
+func sanitizeTag(value string) string {
+	return sanitizeComment(value, "-_.@")
+}
+
+// sanitizeComment removes the characters of the value that are not letters, digits or one of the allowed characters
+func sanitizeComment(value string, allowed string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(allowed, r) {
+			return r
+		}
+		return -1
+	}, value)
+}
+
+// comment returns the tags as a SQL comment, e.g. "/* user=admin dashboard=abc */", or an empty string if there are no tags
+func (t QueryTags) comment() string {
+	var tags []string
+	if user := sanitizeTag(t.User); user != "" {
+		tags = append(tags, fmt.Sprintf("user=%s", user))
+	}
+	if dashboard := sanitizeTag(t.DashboardUID); dashboard != "" {
+		tags = append(tags, fmt.Sprintf("dashboard=%s", dashboard))
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("/* %s */", strings.Join(tags, " "))
+}
+
+// statementComment returns the comment identifying the query and the panel running it, e.g. "/* grafana: refId=A panelId=2 */",
+// or an empty string if both are unknown. The values can't contain the characters used by the bind parameters (e.g. ?, $, : or @).
+func (t QueryTags) statementComment(refID string) string {
+	var labels []string
+	if refID := sanitizeComment(refID, "-_."); refID != "" {
+		labels = append(labels, fmt.Sprintf("refId=%s", refID))
+	}
+	if panel := sanitizeComment(t.PanelID, "-_."); panel != "" {
+		labels = append(labels, fmt.Sprintf("panelId=%s", panel))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("/* grafana: %s */", strings.Join(labels, " "))
+}
@@ -0,0 +1,104 @@
+package sqlds
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryTags_comment(t *testing.T) {
+	tests := []struct {
+		desc     string
+		tags     QueryTags
+		expected string
+	}{
+		{desc: "user and dashboard", tags: QueryTags{User: "admin", DashboardUID: "abc-1"}, expected: "/* user=admin dashboard=abc-1 */"},
+		{desc: "only user", tags: QueryTags{User: "jane@example.com"}, expected: "/* user=jane@example.com */"},
+		{desc: "no tags", expected: ""},
+		{desc: "comment injection", tags: QueryTags{User: "x */ drop table t; /*"}, expected: "/* user=xdroptablet */"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.tags.comment())
+		})
+	}
+}
+
+func TestQueryData_AnnotateQueries(t *testing.T) {
+	var tags QueryTags
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		tags = QueryTagsFromContext(ctx)
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, nil
+	}}
+	db := fd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings, User: &backend.User{Login: "admin"}},
+		Headers:       map[string]string{"X-Dashboard-Uid": "abc"},
+		Queries:       []backend.DataQuery{{RefID: "A", JSON: []byte(`{"rawSql": "select a from t", "format": 1}`)}},
+	}
+
+	for _, annotate := range []bool{false, true} {
+		ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{AnnotateQueries: annotate}}
+		ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+		res, err := ds.QueryData(context.Background(), req)
+		require.NoError(t, err)
+		require.NoError(t, res.Responses["A"].Error)
+
+		expected := "select a from t"
+		if annotate {
+			expected = "/* user=admin dashboard=abc */ select a from t"
+		}
+		queries := fd.Queries()
+		assert.Equal(t, expected, queries[len(queries)-1])
+		assert.Equal(t, expected, res.Responses["A"].Frames[0].Meta.ExecutedQueryString)
+		assert.Equal(t, QueryTags{User: "admin", DashboardUID: "abc"}, tags)
+	}
+}
+
+func TestQueryTags_statementComment(t *testing.T) {
+	tests := []struct {
+		desc     string
+		tags     QueryTags
+		refID    string
+		expected string
+	}{
+		{desc: "RefID and panel", tags: QueryTags{PanelID: "2"}, refID: "A", expected: "/* grafana: refId=A panelId=2 */"},
+		{desc: "only RefID", refID: "A", expected: "/* grafana: refId=A */"},
+		{desc: "unknown RefID and panel", expected: ""},
+		{desc: "bind parameters", tags: QueryTags{PanelID: "$1"}, refID: "?:a@b", expected: "/* grafana: refId=ab panelId=1 */"},
+		{desc: "comment injection", refID: "x */ drop table t; /*", expected: "/* grafana: refId=xdroptablet */"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.tags.statementComment(tc.refID))
+		})
+	}
+}
+
+func TestQueryData_CommentQueries(t *testing.T) {
+	fd := &fakeSQLDriver{handler: func(ctx context.Context, query string) (fakeResult, error) {
+		return fakeResult{columns: []string{"a"}, rows: [][]driver.Value{{"a"}}}, nil
+	}}
+	db := fd.DB()
+	settings := &backend.DataSourceInstanceSettings{UID: "uid1"}
+	req := &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{DataSourceInstanceSettings: settings},
+		Headers:       map[string]string{"X-Panel-Id": "12"},
+		Queries:       []backend.DataQuery{{RefID: "B", JSON: []byte(`{"rawSql": "select a from t where a = $__arg(a)", "args": {"a": "x"}, "format": 1}`)}},
+	}
+
+	ds := &sqldatasource{c: &fakeDriver{db: db}, driverSettings: DriverSettings{CommentQueries: true, PlaceholderStyle: PlaceholderDollar}}
+	ds.storeDBConnection(defaultKey("uid1"), dbConnection{db, *settings})
+	res, err := ds.QueryData(context.Background(), req)
+	require.NoError(t, err)
+	require.NoError(t, res.Responses["B"].Error)
+
+	expected := "/* grafana: refId=B panelId=12 */ select a from t where a = $1"
+	assert.Equal(t, []string{expected}, fd.Queries())
+	assert.Equal(t, [][]interface{}{{"x"}}, fd.Args())
+}
@@ -0,0 +1,33 @@
+package sqlds
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// ErrorTraceColumn is returned when the trace format is used but a required column is missing
+var ErrorTraceColumn = errors.New("trace format requires column")
+
+// traceColumns are the columns required by the trace visualization
+var traceColumns = []string{"traceID", "spanID", "operationName", "startTime", "duration"}
+
+// toTraceFrame validates that the frame contains the columns required by the trace visualization
+func toTraceFrame(frame *data.Frame) (*data.Frame, error) {
+	names := make(map[string]bool, len(frame.Fields))
+	for _, f := range frame.Fields {
+		names[f.Name] = true
+	}
+	for _, column := range traceColumns {
+		if !names[column] {
+			return nil, fmt.Errorf("%w: %s", ErrorTraceColumn, column)
+		}
+	}
+
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.PreferredVisualization = data.VisTypeTrace
+	return frame, nil
+}
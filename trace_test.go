@@ -0,0 +1,40 @@
+package sqlds
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_toTraceFrame(t *testing.T) {
+	now := time.Now()
+	t.Run("it should set the trace visualization", func(t *testing.T) {
+		frame, err := toTraceFrame(data.NewFrame("A",
+			data.NewField("traceID", nil, []string{"t1"}),
+			data.NewField("spanID", nil, []string{"s1"}),
+			data.NewField("parentSpanID", nil, []string{""}),
+			data.NewField("operationName", nil, []string{"select"}),
+			data.NewField("startTime", nil, []time.Time{now}),
+			data.NewField("duration", nil, []float64{1.5}),
+		))
+		require.NoError(t, err)
+		require.NotNil(t, frame.Meta)
+		assert.Equal(t, data.VisType(data.VisTypeTrace), frame.Meta.PreferredVisualization)
+		assert.Len(t, frame.Fields, 6)
+	})
+
+	t.Run("it should return an error naming the missing column", func(t *testing.T) {
+		_, err := toTraceFrame(data.NewFrame("A",
+			data.NewField("traceID", nil, []string{"t1"}),
+			data.NewField("operationName", nil, []string{"select"}),
+			data.NewField("startTime", nil, []time.Time{now}),
+			data.NewField("duration", nil, []float64{1.5}),
+		))
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrorTraceColumn)
+		assert.Contains(t, err.Error(), "spanID")
+	})
+}